@@ -1,16 +1,18 @@
 module github.com/tiket-oss/remiro
 
-go 1.12
+go 1.16
 
 require (
 	contrib.go.opencensus.io/exporter/prometheus v0.1.0
+	contrib.go.opencensus.io/exporter/zipkin v0.1.1
 	github.com/BurntSushi/toml v0.3.1
-	github.com/gomodule/redigo v1.7.0
+	github.com/gomodule/redigo v1.8.9
+	github.com/openzipkin/zipkin-go v0.1.6
 	github.com/rafaeljusto/redigomock v0.0.0-20190202135759-257e089e14a1
 	github.com/secmask/go-redisproto v0.0.0-20190520094750-7963d3e44e33
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/pflag v1.0.3
-	github.com/stretchr/testify v1.2.2
+	github.com/stretchr/testify v1.7.0
 	github.com/tidwall/redcon v1.0.0
 	go.opencensus.io v0.22.0
 )
@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessLogConfig holds the configuration of the access log, which has a JSON
+// record for every command served
+type AccessLogConfig struct {
+	// Output is where records are written, either "stdout" or the path of a
+	// file records are appended to. The access log is disabled if it's empty.
+	Output string
+
+	// SampleRate is the fraction of commands logged, between 0 and 1.
+	// Every command is logged if it's not set.
+	SampleRate float64
+
+	// SlowerThan, if set, restricts the access log to the commands
+	// which took longer than it to be served
+	SlowerThan duration
+}
+
+func (c AccessLogConfig) validate(problems *ConfigError) {
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		problems.add("AccessLog.SampleRate must be between 0 and 1")
+	}
+	if c.SlowerThan.Duration < 0 {
+		problems.add("AccessLog.SlowerThan must not be negative")
+	}
+}
+
+// accessLog writes access log records to the output of its configuration,
+// which is opened when the first record is written
+type accessLog struct {
+	config AccessLogConfig
+	logger *log.Logger
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// newAccessLog returns the access log described by config, or nil if it's disabled
+func newAccessLog(config AccessLogConfig) *accessLog {
+	if config.Output == "" {
+		return nil
+	}
+
+	a := &accessLog{config: config}
+	a.logger = &log.Logger{
+		Out:       a,
+		Formatter: &log.JSONFormatter{},
+		Hooks:     make(log.LevelHooks),
+		Level:     log.InfoLevel,
+	}
+
+	return a
+}
+
+func (a *accessLog) Write(p []byte) (int, error) {
+	if a.config.Output == "stdout" {
+		return os.Stdout.Write(p)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		file, err := os.OpenFile(a.config.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return 0, err
+		}
+		a.file = file
+	}
+
+	return a.file.Write(p)
+}
+
+// Close closes the file of the access log, if any
+func (a *accessLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// sampled reports whether a command served in latency should be logged
+func (a *accessLog) sampled(latency time.Duration) bool {
+	if latency < a.config.SlowerThan.Duration {
+		return false
+	}
+
+	rate := a.config.SampleRate
+	return rate == 0 || rate == 1 || rand.Float64() < rate
+}
+
+// accessRecord collects what happened while serving a command, for the access log
+type accessRecord struct {
+	client    string
+	command   string
+	key       string
+	route     string
+	migration map[string]string
+
+	// backends is guarded by mu, as the reads of a hedged GET are sent concurrently,
+	// and the slower one may still be given up on after the command is served
+	mu       sync.Mutex
+	backends []backendCall
+}
+
+// backendCall is a command sent to "source" or "destination" while serving a command
+type backendCall struct {
+	Target    string  `json:"target"`
+	Command   string  `json:"command"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type accessRecordKey struct{}
+
+func withAccessRecord(ctx context.Context, record *accessRecord) context.Context {
+	return context.WithValue(ctx, accessRecordKey{}, record)
+}
+
+// accessRecordFrom returns the access record in ctx, or nil if there's none
+func accessRecordFrom(ctx context.Context) *accessRecord {
+	record, _ := ctx.Value(accessRecordKey{}).(*accessRecord)
+	return record
+}
+
+// The methods of accessRecord can be called on a nil record, which
+// is what commands have when the access log is disabled.
+
+func (a *accessRecord) setRoute(route string) {
+	if a != nil {
+		a.route = route
+	}
+}
+
+func (a *accessRecord) addBackend(target, command string, latencyMs float64, err error) {
+	if a == nil {
+		return
+	}
+
+	call := backendCall{Target: target, Command: commandTag(command), LatencyMs: latencyMs}
+	if err != nil {
+		call.Error = err.Error()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.backends = append(a.backends, call)
+}
+
+// calls returns the commands sent to "source" and "destination" so far
+func (a *accessRecord) calls() []backendCall {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return append([]backendCall(nil), a.backends...)
+}
+
+// migrated records a migration step, either "copy" or "delete", and its outcome
+func (a *accessRecord) migrated(step string, ok bool) {
+	if a == nil {
+		return
+	}
+
+	if a.migration == nil {
+		a.migration = make(map[string]string)
+	}
+	a.migration[step] = outcomeOf(ok)
+}
+
+// log writes record to the access log, along with the user of the connection and
+// the reply sent, if the command is sampled
+func (a *accessLog) log(record *accessRecord, user string, reply *replyRecorder, latency time.Duration) {
+	if !a.sampled(latency) {
+		return
+	}
+
+	fields := log.Fields{
+		"client":     record.client,
+		"command":    record.command,
+		"latency_ms": float64(latency) / float64(time.Millisecond),
+		"reply":      replyTypeName(reply.replyType),
+	}
+	if user != "" {
+		fields["user"] = user
+	}
+	if record.key != "" {
+		fields["key"] = record.key
+	}
+	if record.route != "" {
+		fields["route"] = record.route
+	}
+	if backends := record.calls(); len(backends) > 0 {
+		fields["backends"] = backends
+	}
+	if len(record.migration) > 0 {
+		fields["migration"] = record.migration
+	}
+	if err := reply.err(); err != nil {
+		fields["error"] = err.Error()
+	}
+
+	a.logger.WithFields(fields).Info("access")
+}
+
+var replyTypeNames = map[byte]string{
+	'+': "simple_string",
+	'-': "error",
+	':': "integer",
+	'$': "bulk_string",
+	'*': "array",
+	'_': "null",
+	',': "double",
+	'#': "boolean",
+	'!': "bulk_error",
+	'=': "verbatim_string",
+	'(': "big_number",
+	'%': "map",
+	'~': "set",
+	'|': "attribute",
+	'>': "push",
+}
+
+func replyTypeName(replyType byte) string {
+	if replyType == 0 {
+		return "none"
+	}
+	if name, ok := replyTypeNames[replyType]; ok {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_redisHandler_AccessLog(t *testing.T) {
+	var (
+		key, value = "mykey", "hello"
+		rawMessage = fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+	)
+
+	t.Run(`[Given] the access log is enabled
+			 [And] a key is not available in "destination"
+			 [And] the key is available in "source"
+		    [When] a GET request for the key is received
+		    [Then] log a record of the request with its route, backends and migration`, func(t *testing.T) {
+
+		path := tempFilePath(t)
+		defer os.Remove(path)
+
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings.deleteOnGet = true
+		handler.settings.config.Logging = LoggingConfig{Keys: logHash}
+		handler.settings.accessLog = newAccessLog(AccessLogConfig{Output: path})
+
+		dstMock.Command("GET", []byte(key)).Expect(nil)
+		dstMock.Command("SET", []byte(key), value).Expect("OK")
+		srcMock.Command("GET", []byte(key)).Expect(value)
+		srcMock.Command("DEL", []byte(key)).Expect(int64(1))
+
+		serveRequest(t, handler, rawMessage)
+		handler.settings.accessLog.Close()
+
+		records := readAccessLog(t, path)
+		if !assert.Len(t, records, 1, "a record should be logged") {
+			return
+		}
+
+		record := records[0]
+		assert.Equal(t, "GET", record["command"], "command should be logged")
+		assert.Equal(t, "hash:"+keyHash([]byte(key)), record["key"], "key should be logged according to the logging policy")
+		assert.Equal(t, "default", record["user"], "user should be logged")
+		assert.Equal(t, "source", record["route"], "route should be logged")
+		assert.Equal(t, "bulk_string", record["reply"], "reply type should be logged")
+		assert.Equal(t, map[string]interface{}{"copy": "success", "delete": "success"}, record["migration"], "migration should be logged")
+		assert.Contains(t, record, "client", "client should be logged")
+		assert.Contains(t, record, "latency_ms", "latency should be logged")
+
+		var backends []string
+		for _, backend := range record["backends"].([]interface{}) {
+			call := backend.(map[string]interface{})
+			backends = append(backends, fmt.Sprintf("%s %s", call["target"], call["command"]))
+		}
+		assert.Equal(t, []string{"destination GET", "source GET", "destination SET", "source DEL"}, backends, "backends touched should be logged in order")
+	})
+
+	t.Run(`[Given] the access log is restricted to slow commands
+		    [When] a request is served faster than the threshold
+		    [Then] don't log the request`, func(t *testing.T) {
+
+		path := tempFilePath(t)
+		defer os.Remove(path)
+
+		handler, _, dstMock := initHandlerMock()
+		handler.settings.accessLog = newAccessLog(AccessLogConfig{Output: path, SlowerThan: duration{time.Hour}})
+
+		dstMock.Command("GET", []byte(key)).Expect(value)
+
+		serveRequest(t, handler, rawMessage)
+		handler.settings.accessLog.Close()
+
+		assert.Empty(t, readAccessLog(t, path), "no record should be logged")
+	})
+}
+
+func Test_redisHandler_AccessLog_AUTH(t *testing.T) {
+	t.Run(`[Given] the access log and the slow log log every command
+		    [When] an AUTH request is received
+		    [Then] never log the password`, func(t *testing.T) {
+
+		path := tempFilePath(t)
+		defer os.Remove(path)
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.password = "hunter2"
+		handler.settings.accessLog = newAccessLog(AccessLogConfig{Output: path})
+		handler.settings.config.Slowlog = SlowlogConfig{SlowerThan: duration{time.Nanosecond}}
+
+		reply := serveRequest(t, handler, "*2\r\n$4\r\nAUTH\r\n$7\r\nhunter2\r\n")
+		assert.Equal(t, "+OK\r\n", reply)
+		handler.settings.accessLog.Close()
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Contains(t, string(content), "AUTH", "request should be logged")
+		assert.NotContains(t, string(content), "hunter2", "password should not be in the access log")
+
+		entries, err := json.Marshal(handler.slowlog.get(-1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Contains(t, string(entries), "AUTH", "request should be in the slow log")
+		assert.NotContains(t, string(entries), "hunter2", "password should not be in the slow log")
+	})
+}
+
+func Test_accessLog_sampled(t *testing.T) {
+	t.Run(`[Given] a sample rate
+		    [When] many commands are served
+		    [Then] log about the sample rate of the commands`, func(t *testing.T) {
+
+		a := newAccessLog(AccessLogConfig{Output: "stdout", SampleRate: 0.25})
+
+		var sampled int
+		for i := 0; i < 10000; i++ {
+			if a.sampled(time.Millisecond) {
+				sampled++
+			}
+		}
+
+		assert.InDelta(t, 2500, sampled, 300, "about a quarter of the commands should be logged")
+	})
+}
+
+// serveRequest serves handler and sends msg to it, returning the reply
+func serveRequest(t *testing.T, handler *redisHandler, msg string) (reply string) {
+	fatal := make(chan error)
+	signal := make(chan error)
+	s := NewServer(":0", handler)
+	go func() {
+		defer s.Close()
+
+		if err := s.ListenServeAndSignal(signal); err != nil {
+			fatal <- err
+		}
+	}()
+
+	done := make(chan bool)
+	go func() {
+		defer func() {
+			done <- true
+		}()
+
+		err := <-signal
+		if err != nil {
+			fatal <- err
+		}
+
+		reply, err = doRequest(s.Addr().String(), msg)
+		if err != nil {
+			fatal <- err
+		}
+	}()
+
+	waitForComplete(t, done, fatal)
+	return reply
+}
+
+func tempFilePath(t *testing.T) string {
+	file, err := ioutil.TempFile("", "remiro-access-*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	return file.Name()
+}
+
+func readAccessLog(t *testing.T, path string) []map[string]interface{} {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
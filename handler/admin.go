@@ -0,0 +1,302 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminConfig holds the configuration of the admin API
+type AdminConfig struct {
+	// Token authenticates requests to the admin API, sent as a bearer token.
+	// The admin API is disabled if it's empty.
+	Token     string
+	TokenFile string
+}
+
+// adminSettings are the settings which can be viewed and changed with the admin API.
+// Fields left out of a change are kept as they are.
+type adminSettings struct {
+	DeleteOnGet *bool `json:"DeleteOnGet,omitempty"`
+	DeleteOnSet *bool `json:"DeleteOnSet,omitempty"`
+}
+
+// Admin serves the admin API, which allows changing the behaviour of remiro at
+// runtime. Requests must bear the token of the configuration:
+//   - GET /admin/settings returns the settings which can be changed
+//   - PATCH /admin/settings changes some of them, e.g. {"DeleteOnGet": false}
+//   - POST /admin/migrate?key=<key> migrates a key from "source" to "destination"
+//   - GET /admin/verify?key=<key> compares the values of a key in both
+func (r *redisHandler) Admin(w http.ResponseWriter, req *http.Request) {
+	if !r.authorizedAdmin(w, req) {
+		return
+	}
+
+	switch req.URL.Path {
+	case "/admin/settings":
+		switch req.Method {
+		case http.MethodGet:
+			r.getAdminSettings(w)
+		case http.MethodPatch:
+			r.changeAdminSettings(w, req)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPatch)
+		}
+
+	case "/admin/migrate":
+		if req.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		r.adminMigrateKey(w, req)
+
+	case "/admin/verify":
+		if req.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		r.adminVerifyKey(w, req)
+
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// authorizedAdmin tells whether req bears the admin token, replying an error if it
+// doesn't. Without a token, the endpoints requiring it are disabled.
+func (r *redisHandler) authorizedAdmin(w http.ResponseWriter, req *http.Request) bool {
+	s := r.acquireSettings()
+	token := s.config.Admin.Token
+	s.inUse.Done()
+
+	if token == "" {
+		http.NotFound(w, req)
+		return false
+	}
+	if !validBearerToken(req, token) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="remiro"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func validBearerToken(req *http.Request, token string) bool {
+	const prefix = "Bearer "
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(header[len(prefix):]), []byte(token)) == 1
+}
+
+// adminErrorStatus returns the status replied to an admin request which failed
+// with err, returned by a backend
+func adminErrorStatus(err error) int {
+	if err == context.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
+
+func (r *redisHandler) getAdminSettings(w http.ResponseWriter) {
+	s := r.acquireSettings()
+	defer s.inUse.Done()
+
+	writeJSON(w, http.StatusOK, adminSettings{
+		DeleteOnGet: &s.config.DeleteOnGet,
+		DeleteOnSet: &s.config.DeleteOnSet,
+	})
+}
+
+// changeAdminSettings applies a change of settings by reloading the current
+// configuration with the change. The change lasts until the configuration
+// file is reloaded. The current configuration is read while holding reloadMu,
+// so that a configuration file reloaded concurrently isn't undone.
+func (r *redisHandler) changeAdminSettings(w http.ResponseWriter, req *http.Request) {
+	var change adminSettings
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&change); err != nil {
+		http.Error(w, "invalid settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	r.settingsMu.RLock()
+	config := r.settings.config
+	r.settingsMu.RUnlock()
+
+	logChange := func(setting string, from, to bool) {
+		log.WithFields(log.Fields{
+			"context": "Admin API",
+			"client":  req.RemoteAddr,
+			"setting": setting,
+			"from":    from,
+			"to":      to,
+		}).Info("Setting has been changed")
+	}
+
+	previous := config
+	if change.DeleteOnGet != nil {
+		config.DeleteOnGet = *change.DeleteOnGet
+	}
+	if change.DeleteOnSet != nil {
+		config.DeleteOnSet = *change.DeleteOnSet
+	}
+
+	if err := r.reload(config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if previous.DeleteOnGet != config.DeleteOnGet {
+		logChange("DeleteOnGet", previous.DeleteOnGet, config.DeleteOnGet)
+	}
+	if previous.DeleteOnSet != config.DeleteOnSet {
+		logChange("DeleteOnSet", previous.DeleteOnSet, config.DeleteOnSet)
+	}
+
+	r.getAdminSettings(w)
+}
+
+// keyMigration is the outcome of migrating a key with the admin API
+type keyMigration struct {
+	// Result is either "copied", "already_migrated" if the key is in
+	// "destination" already, or "not_found" if it's in neither
+	Result  string `json:"result"`
+	Deleted bool   `json:"deleted"`
+}
+
+func (r *redisHandler) adminMigrateKey(w http.ResponseWriter, req *http.Request) {
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+
+	s := r.acquireSettings()
+	defer s.inUse.Done()
+
+	ctx, cancel := context.WithTimeout(req.Context(), s.config.backgroundTimeout())
+	defer cancel()
+
+	migration, err := migrateKey(ctx, s, []byte(key))
+	fields := log.Fields{
+		"context": "Admin API",
+		"client":  req.RemoteAddr,
+		"key":     s.config.Logging.key("GET", []byte(key)),
+	}
+	if isRateLimited(err) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		log.WithFields(fields).Error(err)
+		http.Error(w, err.Error(), adminErrorStatus(err))
+		return
+	}
+
+	fields["result"] = migration.Result
+	fields["deleted"] = migration.Deleted
+	log.WithFields(fields).Info("Key has been migrated")
+	writeJSON(w, http.StatusOK, migration)
+}
+
+// migrateKey copies key from "source" to "destination" if it's not in "destination"
+// already, deleting it from "source" afterwards if DeleteOnGet is set, like GET does.
+// Every step is retried according to the retry policy.
+func migrateKey(ctx context.Context, s *settings, key []byte) (keyMigration, error) {
+	_, err := redis.Bytes(s.doWithRetry(ctx, "destination", "GET", key))
+	if err == nil {
+		return keyMigration{Result: "already_migrated"}, nil
+	}
+	if err != redis.ErrNil {
+		return keyMigration{}, err
+	}
+
+	val, err := redis.Bytes(s.doWithRetry(ctx, "source", "GET", key))
+	if err == redis.ErrNil {
+		return keyMigration{Result: "not_found"}, nil
+	}
+	if err != nil {
+		return keyMigration{}, err
+	}
+
+	_, err = s.doWithRetry(ctx, "destination", "SET", key, val)
+	go recordCopy("ADMIN", err == nil, len(val))
+	if err != nil {
+		return keyMigration{}, err
+	}
+
+	migration := keyMigration{Result: "copied"}
+	if s.deleteOnGet {
+		err := s.deleteKey(ctx, key)
+		go recordDeletion("ADMIN", routeSource, err == nil)
+		if err != nil {
+			return migration, err
+		}
+		migration.Deleted = true
+	}
+
+	return migration, nil
+}
+
+// keyVerification is the outcome of comparing the values of a key in both backends
+type keyVerification struct {
+	InSource      bool `json:"in_source"`
+	InDestination bool `json:"in_destination"`
+	Match         bool `json:"match"`
+}
+
+func (r *redisHandler) adminVerifyKey(w http.ResponseWriter, req *http.Request) {
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+
+	s := r.acquireSettings()
+	defer s.inUse.Done()
+
+	ctx, cancel := context.WithTimeout(req.Context(), s.config.backgroundTimeout())
+	defer cancel()
+
+	getValue := func(target string) ([]byte, bool, error) {
+		val, err := redis.Bytes(s.doWithRetry(ctx, target, "GET", []byte(key)))
+		if err == redis.ErrNil {
+			return nil, false, nil
+		}
+		return val, err == nil, err
+	}
+
+	srcVal, inSource, err := getValue("source")
+	if err != nil {
+		http.Error(w, "source: "+err.Error(), adminErrorStatus(err))
+		return
+	}
+	dstVal, inDestination, err := getValue("destination")
+	if err != nil {
+		http.Error(w, "destination: "+err.Error(), adminErrorStatus(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, keyVerification{
+		InSource:      inSource,
+		InDestination: inDestination,
+		Match:         inSource && inDestination && string(srcVal) == string(dstVal),
+	})
+}
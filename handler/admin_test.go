@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_redisHandler_Admin(t *testing.T) {
+	const token = "s3cr3t"
+
+	initAdminHandler := func() (*redisHandler, *redigomock.Conn, *redigomock.Conn) {
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings.config.Source.Addr = "redis-source:6379"
+		handler.settings.config.Destination.Addr = "redis-destination:6379"
+		handler.settings.config.Admin.Token = token
+		return handler, srcMock, dstMock
+	}
+
+	adminRequest := func(handler *redisHandler, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.Admin(w, req)
+		return w
+	}
+
+	t.Run(`[Given] no admin token is set in the configuration
+		    [When] the admin API is requested
+		    [Then] returns not found`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+
+		w := httptest.NewRecorder()
+		handler.Admin(w, httptest.NewRequest("GET", "/admin/settings", nil))
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run(`[When] the admin API is requested with an invalid token
+		   [Then] returns unauthorized`, func(t *testing.T) {
+
+		handler, _, _ := initAdminHandler()
+
+		for _, header := range []string{"", "Bearer wrong", token} {
+			req := httptest.NewRequest("GET", "/admin/settings", nil)
+			req.Header.Set("Authorization", header)
+			w := httptest.NewRecorder()
+			handler.Admin(w, req)
+
+			assert.Equal(t, http.StatusUnauthorized, w.Code, "authorization %q should be refused", header)
+		}
+	})
+
+	t.Run(`[When] settings are changed with the admin API
+		   [Then] apply the change, leaving the other settings as they are`, func(t *testing.T) {
+
+		handler, _, _ := initAdminHandler()
+		handler.settings.config.DeleteOnSet = true
+
+		w := adminRequest(handler, "PATCH", "/admin/settings", `{"DeleteOnGet": true}`)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"DeleteOnGet": true, "DeleteOnSet": true}`, w.Body.String(), "changed settings should be returned")
+		assert.True(t, handler.settings.deleteOnGet, "DeleteOnGet should be applied")
+		assert.True(t, handler.settings.deleteOnSet, "DeleteOnSet should be kept")
+	})
+
+	t.Run(`[When] an unknown setting is changed with the admin API
+		   [Then] returns bad request`, func(t *testing.T) {
+
+		handler, _, _ := initAdminHandler()
+
+		w := adminRequest(handler, "PATCH", "/admin/settings", `{"DeleteOnGett": true}`)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run(`[Given] a key is available in "source" only
+			 [And] deleteOnGet set to true
+		    [When] the key is migrated with the admin API
+		    [Then] copy the key to "destination" and delete it from "source"`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initAdminHandler()
+		handler.settings.deleteOnGet = true
+
+		dstMock.Command("GET", []byte("mykey")).Expect(nil)
+		srcMock.Command("GET", []byte("mykey")).Expect([]byte("hello"))
+		dstSET := dstMock.Command("SET", []byte("mykey"), []byte("hello")).Expect("OK")
+		srcDEL := srcMock.Command("DEL", []byte("mykey")).Expect(int64(1))
+
+		w := adminRequest(handler, "POST", "/admin/migrate?key=mykey", "")
+
+		var migration keyMigration
+		if err := json.Unmarshal(w.Body.Bytes(), &migration); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, keyMigration{Result: "copied", Deleted: true}, migration)
+		assert.True(t, dstSET.Called, "key should be copied to destination")
+		assert.True(t, srcDEL.Called, "key should be deleted from source")
+	})
+
+	t.Run(`[Given] a key has the same value in "source" and "destination"
+		    [When] the key is verified with the admin API
+		    [Then] report the values as matching`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initAdminHandler()
+
+		srcMock.Command("GET", []byte("mykey")).Expect([]byte("hello"))
+		dstMock.Command("GET", []byte("mykey")).Expect([]byte("hello"))
+
+		w := adminRequest(handler, "GET", "/admin/verify?key=mykey", "")
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"in_source": true, "in_destination": true, "match": true}`, w.Body.String())
+	})
+
+	t.Run(`[Given] the configuration file is being reloaded
+		    [When] settings are changed with the admin API meanwhile
+		    [Then] apply the change on top of the reloaded configuration, rather than undoing it`, func(t *testing.T) {
+
+		handler, _, _ := initAdminHandler()
+		reloaded := handler.settings.config
+		reloaded.CommandTimeout = duration{time.Second}
+
+		handler.reloadMu.Lock()
+		changed := make(chan *httptest.ResponseRecorder)
+		go func() { changed <- adminRequest(handler, "PATCH", "/admin/settings", `{"DeleteOnGet": true}`) }()
+		time.Sleep(10 * time.Millisecond)
+		assert.NoError(t, handler.reload(reloaded))
+		handler.reloadMu.Unlock()
+
+		assert.Equal(t, http.StatusOK, (<-changed).Code)
+		assert.True(t, handler.settings.deleteOnGet, "change should be applied")
+		assert.Equal(t, time.Second, handler.settings.config.CommandTimeout.Duration, "reloaded configuration should be kept")
+	})
+
+	t.Run(`[Given] no command timeout, and "source" not replying
+		    [When] a key is migrated with the admin API
+		    [Then] give up once the timeout of health checks has passed`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initAdminHandler()
+		handler.settings.config.Health = HealthConfig{Timeout: duration{20 * time.Millisecond}}
+		slowDial(handler.settings.sourcePool, srcMock, time.Hour)
+
+		dstMock.Command("GET", []byte("mykey")).Expect(nil)
+		srcMock.Command("GET", []byte("mykey")).Expect([]byte("hello"))
+
+		start := time.Now()
+		w := adminRequest(handler, "POST", "/admin/migrate?key=mykey", "")
+
+		assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+		assert.True(t, time.Since(start) < time.Second, "source should not be waited for")
+	})
+}
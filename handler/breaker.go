@@ -0,0 +1,297 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBreakerMinRequests = 20
+	defaultBreakerWindow      = 10 * time.Second
+	defaultBreakerOpenTimeout = 5 * time.Second
+)
+
+// States of a circuit breaker
+const (
+	breakerClosed   = "closed"
+	breakerHalfOpen = "half_open"
+	breakerOpen     = "open"
+)
+
+// breakerStateValues are the values of the states recorded by the breaker/state metric
+var breakerStateValues = map[string]int64{
+	breakerClosed:   0,
+	breakerHalfOpen: 1,
+	breakerOpen:     2,
+}
+
+// Policies applied while the circuit breaker of a backend is open
+const (
+	// breakerPolicyError replies an error to the commands which need the backend
+	breakerPolicyError = "error"
+
+	// breakerPolicyNil replies nil to GET for keys missing in "destination"
+	// while "source" is unavailable, as if they were missing in both
+	breakerPolicyNil = "nil"
+
+	// breakerPolicySource replies to GET with the value of "source", without
+	// migrating it, while "destination" is unavailable
+	breakerPolicySource = "source"
+)
+
+// BreakerConfig holds the configuration of the circuit breaker of a backend.
+// Once the breaker is open, commands are refused without being sent to the
+// backend until OpenTimeout has passed, after which a single command is let
+// through as a probe: the breaker closes if it succeeds and opens again otherwise.
+type BreakerConfig struct {
+	// FailureRate is the fraction of failed commands, between 0 and 1, at
+	// which the breaker opens. The breaker is disabled if it's not set.
+	FailureRate float64
+
+	// SlowerThan is the latency above which a command counts as failed.
+	// Latency isn't taken into account if it's not set.
+	SlowerThan duration
+
+	// MinRequests is the number of commands in a window below which the
+	// breaker doesn't open whatever the failure rate, it defaults to 20
+	MinRequests int
+
+	// Window is the period failures are counted over, it defaults to 10s
+	Window duration
+
+	// OpenTimeout is how long the breaker stays open before a command is
+	// let through as a probe, it defaults to 5s
+	OpenTimeout duration
+}
+
+func (c BreakerConfig) validate(name string, problems *ConfigError) {
+	if c.FailureRate < 0 || c.FailureRate > 1 {
+		problems.add("%s.Breaker.FailureRate must be between 0 and 1", name)
+	}
+	if c.SlowerThan.Duration < 0 {
+		problems.add("%s.Breaker.SlowerThan must not be negative", name)
+	}
+	if c.MinRequests < 0 {
+		problems.add("%s.Breaker.MinRequests must not be negative", name)
+	}
+	if c.Window.Duration < 0 {
+		problems.add("%s.Breaker.Window must not be negative", name)
+	}
+	if c.OpenTimeout.Duration < 0 {
+		problems.add("%s.Breaker.OpenTimeout must not be negative", name)
+	}
+}
+
+func (c BreakerConfig) enabled() bool {
+	return c.FailureRate > 0
+}
+
+func (c BreakerConfig) minRequests() int {
+	if c.MinRequests == 0 {
+		return defaultBreakerMinRequests
+	}
+	return c.MinRequests
+}
+
+func (c BreakerConfig) window() time.Duration {
+	if c.Window.Duration == 0 {
+		return defaultBreakerWindow
+	}
+	return c.Window.Duration
+}
+
+func (c BreakerConfig) openTimeout() time.Duration {
+	if c.OpenTimeout.Duration == 0 {
+		return defaultBreakerOpenTimeout
+	}
+	return c.OpenTimeout.Duration
+}
+
+// unavailableError is returned for commands which aren't sent to a backend
+// because its circuit breaker is open
+type unavailableError struct {
+	target string
+}
+
+func (e unavailableError) Error() string {
+	return e.target + " is unavailable, its circuit breaker is open"
+}
+
+func isUnavailable(err error) bool {
+	_, ok := err.(unavailableError)
+	return ok
+}
+
+// breaker is the circuit breaker of a backend. A nil breaker is a disabled
+// one, which lets every command through.
+type breaker struct {
+	target string
+	config BreakerConfig
+
+	mu          sync.Mutex
+	state       string
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	probing     bool
+}
+
+// newBreaker returns the circuit breaker of target, or nil if config disables it
+func newBreaker(target string, config BreakerConfig) *breaker {
+	if !config.enabled() {
+		return nil
+	}
+
+	return &breaker{
+		target:      target,
+		config:      config,
+		state:       breakerClosed,
+		windowStart: time.Now(),
+	}
+}
+
+// currentState returns the state of the breaker, or an empty string if it's disabled
+func (b *breaker) currentState() string {
+	if b == nil {
+		return ""
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// ready reports whether a connection to the backend may be dialed, which
+// it may unless allow would refuse the command it's dialed for
+func (b *breaker) ready() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= b.config.openTimeout()
+	case breakerHalfOpen:
+		return !b.probing
+	default:
+		return true
+	}
+}
+
+// allow reports whether a command may be sent to the backend. Every command
+// allowed must be followed by a call to either record or release.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.config.openTimeout() {
+			return false
+		}
+		b.transition(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record records the outcome of an allowed command which took latency
+func (b *breaker) record(failed bool, latency time.Duration) {
+	if b == nil {
+		return
+	}
+	if b.config.SlowerThan.Duration > 0 && latency > b.config.SlowerThan.Duration {
+		failed = true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerHalfOpen:
+		b.probing = false
+		if failed {
+			b.open()
+		} else {
+			b.transition(breakerClosed)
+			b.resetWindow(time.Now())
+		}
+	case breakerClosed:
+		now := time.Now()
+		if now.Sub(b.windowStart) >= b.config.window() {
+			b.resetWindow(now)
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.requests >= b.config.minRequests() &&
+			float64(b.failures)/float64(b.requests) >= b.config.FailureRate {
+			b.open()
+		}
+	}
+	// Commands allowed before the breaker opened don't change anything once it's open
+}
+
+// release gives back an allowed command which hasn't reached the backend after all
+func (b *breaker) release() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *breaker) open() {
+	b.openedAt = time.Now()
+	b.transition(breakerOpen)
+}
+
+func (b *breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+func (b *breaker) transition(state string) {
+	b.state = state
+	go recordBreakerTransition(b.target, state)
+
+	entry := log.WithFields(log.Fields{"context": "Circuit breaker", "target": b.target})
+	if state == breakerOpen {
+		entry.Warnf("Circuit breaker is open, %s is considered unavailable", b.target)
+	} else {
+		entry.Infof("Circuit breaker is %s", state)
+	}
+}
+
+// breakerFailure reports whether err, returned by a redis.Conn, is a sign of
+// the backend being unhealthy, unlike error replies to a command
+func breakerFailure(err error) bool {
+	if err == nil || err == context.Canceled {
+		return false
+	}
+	_, isReply := err.(redis.Error)
+	return !isReply
+}
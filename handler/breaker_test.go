@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_breaker(t *testing.T) {
+	config := BreakerConfig{
+		FailureRate: 0.5,
+		MinRequests: 4,
+		OpenTimeout: duration{10 * time.Millisecond},
+	}
+
+	t.Run(`[Given] a closed breaker
+		    [When] the failure rate reaches the threshold
+		    [Then] open the breaker only once enough commands have been counted`, func(t *testing.T) {
+
+		b := newBreaker("source", config)
+
+		b.record(true, 0)
+		b.record(true, 0)
+		assert.Equal(t, breakerClosed, b.currentState(), "breaker should stay closed below MinRequests")
+
+		b.record(false, 0)
+		b.record(false, 0)
+		assert.Equal(t, breakerOpen, b.currentState(), "breaker should open at the failure rate")
+		assert.False(t, b.allow(), "commands should be refused while the breaker is open")
+		assert.False(t, b.ready(), "connections should not be dialed while the breaker is open")
+	})
+
+	t.Run(`[Given] an open breaker
+		    [When] the open timeout has passed
+		    [Then] let a single probe through, closing the breaker if it succeeds`, func(t *testing.T) {
+
+		b := newBreaker("source", BreakerConfig{FailureRate: 1, MinRequests: 1, OpenTimeout: config.OpenTimeout})
+		b.record(true, 0)
+		time.Sleep(2 * config.OpenTimeout.Duration)
+
+		assert.True(t, b.allow(), "a probe should be let through")
+		assert.Equal(t, breakerHalfOpen, b.currentState())
+		assert.False(t, b.allow(), "a single probe should be let through at a time")
+
+		b.record(false, 0)
+		assert.Equal(t, breakerClosed, b.currentState(), "a successful probe should close the breaker")
+		assert.True(t, b.allow())
+	})
+
+	t.Run(`[Given] a half-open breaker
+		    [When] the probe fails
+		    [Then] open the breaker again`, func(t *testing.T) {
+
+		b := newBreaker("source", BreakerConfig{FailureRate: 1, MinRequests: 1, OpenTimeout: config.OpenTimeout})
+		b.record(true, 0)
+		time.Sleep(2 * config.OpenTimeout.Duration)
+
+		assert.True(t, b.allow(), "a probe should be let through")
+		b.record(true, 0)
+		assert.Equal(t, breakerOpen, b.currentState(), "a failed probe should open the breaker")
+		assert.False(t, b.allow())
+	})
+
+	t.Run(`[Given] a breaker with a latency threshold
+		    [When] commands are slower than the threshold
+		    [Then] count them as failures`, func(t *testing.T) {
+
+		b := newBreaker("destination", BreakerConfig{FailureRate: 1, MinRequests: 2, SlowerThan: duration{time.Millisecond}})
+
+		b.record(false, 5*time.Millisecond)
+		b.record(false, 5*time.Millisecond)
+
+		assert.Equal(t, breakerOpen, b.currentState(), "slow commands should open the breaker")
+	})
+
+	t.Run(`[When] the breaker is disabled
+		   [Then] let every command through`, func(t *testing.T) {
+
+		b := newBreaker("source", BreakerConfig{})
+		b.record(true, 0)
+
+		assert.Nil(t, b, "breaker should be disabled")
+		assert.True(t, b.allow())
+		assert.True(t, b.ready())
+	})
+}
+
+func Test_breakerFailure(t *testing.T) {
+	assert.False(t, breakerFailure(nil))
+	assert.False(t, breakerFailure(redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")),
+		"error replies should not count as failures")
+	assert.True(t, breakerFailure(errors.New("connection refused")))
+}
+
+func Test_redisHandler_HandleGET_breaker(t *testing.T) {
+	var (
+		key, value = "mykey", "hello"
+		rawGET     = fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+	)
+
+	t.Run(`[Given] the breaker of "source" is open
+			 [And] SourceDown set to "nil"
+		    [When] a key missing in "destination" is requested
+		    [Then] reply nil without sending the command to "source"`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings.config.SourceDown = breakerPolicyNil
+		handler.settings.sourceBreaker = openBreaker("source")
+		dstMock.Command("GET", []byte(key)).Expect(nil)
+		srcGET := srcMock.Command("GET", []byte(key)).Expect(value)
+
+		reply := serveRequest(t, handler, rawGET)
+
+		assert.Equal(t, "$-1\r\n", reply)
+		assert.False(t, srcGET.Called, "source should not be requested")
+	})
+
+	t.Run(`[Given] the breaker of "source" is open
+		    [When] a key missing in "destination" is requested
+		    [Then] reply an error by default`, func(t *testing.T) {
+
+		handler, _, dstMock := initHandlerMock()
+		handler.settings.sourceBreaker = openBreaker("source")
+		dstMock.Command("GET", []byte(key)).Expect(nil)
+
+		reply := serveRequest(t, handler, rawGET)
+
+		assert.Equal(t, "-ERR source is unavailable, its circuit breaker is open\r\n", reply)
+	})
+
+	t.Run(`[Given] the breaker of "destination" is open
+			 [And] DestinationDown set to "source"
+		    [When] a key is requested
+		    [Then] reply the value of "source" without migrating it`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings.config.DestinationDown = breakerPolicySource
+		handler.settings.deleteOnGet = true
+		handler.settings.destinationBreaker = openBreaker("destination")
+		dstGET := dstMock.Command("GET", []byte(key)).Expect(nil)
+		srcMock.Command("GET", []byte(key)).Expect(value)
+		srcDEL := srcMock.Command("DEL", []byte(key)).Expect(int64(1))
+
+		reply := serveRequest(t, handler, rawGET)
+
+		assert.Equal(t, fmt.Sprintf("$%d\r\n%s\r\n", len(value), value), reply)
+		assert.False(t, dstGET.Called, "destination should not be requested")
+		assert.False(t, srcDEL.Called, "key should not be deleted from source")
+	})
+}
+
+func Test_redisHandler_Readiness_breaker(t *testing.T) {
+	t.Run(`[Given] the breaker of "destination" is enabled
+		    [When] readiness is checked
+		    [Then] report the state of the breaker`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings.destinationBreaker = newBreaker("destination", BreakerConfig{FailureRate: 0.5})
+		srcMock.Command("PING").Expect("PONG")
+		dstMock.Command("PING").Expect("PONG")
+
+		w := httptest.NewRecorder()
+		handler.Readiness(w, httptest.NewRequest("GET", "/readyz", nil))
+
+		var reports map[string]backendReport
+		if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, breakerClosed, reports["destination"].Breaker, "state of the breaker should be reported")
+		assert.Empty(t, reports["source"].Breaker, "disabled breaker should not be reported")
+	})
+}
+
+// openBreaker returns a breaker of target which is open, and stays so for an hour
+func openBreaker(target string) *breaker {
+	b := newBreaker(target, BreakerConfig{FailureRate: 1, MinRequests: 1, OpenTimeout: duration{time.Hour}})
+	b.record(true, 0)
+	return b
+}
@@ -0,0 +1,305 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/redcon"
+)
+
+// idleCheckInterval is how often clients are checked for being idle for longer than Clients.Timeout
+const idleCheckInterval = time.Second
+
+// Errors replied to connections refused for exceeding a limit, before closing them
+const (
+	errMaxClientsMsg      = "ERR max number of clients reached"
+	errMaxClientsPerIPMsg = "ERR max number of clients reached for this address"
+)
+
+// Reasons a connection is refused for
+const (
+	// rejectedMaxClients is a connection refused as MaxClients clients are connected
+	rejectedMaxClients = "max_clients"
+
+	// rejectedMaxPerIP is a connection refused as MaxPerIP clients are connected from its address
+	rejectedMaxPerIP = "max_per_ip"
+
+	// rejectedDenied is a connection from an address which isn't allowed
+	rejectedDenied = "denied"
+
+	// rejectedShuttingDown is a connection refused as remiro is shutting down
+	rejectedShuttingDown = "shutting_down"
+)
+
+// ClientsConfig holds the limits of client connections
+type ClientsConfig struct {
+	// MaxClients is the maximum number of connected clients. Unlimited if it's not set.
+	MaxClients int
+
+	// MaxPerIP is the maximum number of clients connected from a single IP
+	// address. Unlimited if it's not set.
+	MaxPerIP int
+
+	// Allow lists the networks, in CIDR notation, or IP addresses clients may
+	// connect from. Clients may connect from anywhere if it's empty.
+	Allow []string
+
+	// Deny lists the networks, in CIDR notation, or IP addresses clients may
+	// not connect from, even if they're allowed by Allow.
+	Deny []string
+
+	// Timeout is how long a client may stay idle, without a command being
+	// served, before its connection is closed, like the timeout of Redis.
+	// Clients are never closed for being idle if it's not set.
+	Timeout duration
+
+	// CountCommands counts the commands received from each client IP address in
+	// the client/command/count metric. It's disabled by default, as every address
+	// makes a time series of its own.
+	CountCommands bool
+}
+
+func (c ClientsConfig) validate(problems *ConfigError) {
+	if c.MaxClients < 0 {
+		problems.add("Clients.MaxClients must not be negative")
+	}
+	if c.MaxPerIP < 0 {
+		problems.add("Clients.MaxPerIP must not be negative")
+	}
+	if _, err := parseNetworks(c.Allow); err != nil {
+		problems.add("Clients.Allow: %s", err)
+	}
+	if _, err := parseNetworks(c.Deny); err != nil {
+		problems.add("Clients.Deny: %s", err)
+	}
+	if c.Timeout.Duration < 0 {
+		problems.add("Clients.Timeout must not be negative")
+	}
+}
+
+// parseNetworks parses networks in CIDR notation, an IP address standing for
+// the network of this single address
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is neither a network nor an IP address", value)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			value = fmt.Sprintf("%s/%d", value, bits)
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither a network nor an IP address", value)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// clientFilter tells the addresses clients may connect from, see ClientsConfig
+type clientFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newClientFilter returns the filter of config, which must be valid
+func newClientFilter(config ClientsConfig) clientFilter {
+	allow, _ := parseNetworks(config.Allow)
+	deny, _ := parseNetworks(config.Deny)
+	return clientFilter{allow: allow, deny: deny}
+}
+
+// allowed tells whether a client may connect from addr, which includes its port
+func (f clientFilter) allowed(addr string) bool {
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(clientIP(addr))
+	if ip == nil {
+		return false
+	}
+	for _, network := range f.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, network := range f.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// client is a connected client, kept as the context of its connection
+type client struct {
+	conn redcon.Conn
+	ip   string
+
+	// lastActive is when the last command of the client has been served, in
+	// nanoseconds since the epoch, and busy is 1 while a command is served
+	lastActive int64
+	busy       int32
+
+	// monitoring is 1 once the client has sent MONITOR, its connection being
+	// detached from the server
+	monitoring int32
+}
+
+// clients tracks connected clients, to enforce the limits of ClientsConfig
+type clients struct {
+	mu    sync.Mutex
+	conns map[*client]bool
+	perIP map[string]int
+}
+
+// add registers a client connecting from addr, unless it would exceed
+// maxClients or maxPerIP, in which case the reason it's refused is returned
+func (cs *clients) add(conn redcon.Conn, maxClients, maxPerIP int) (*client, string) {
+	c := &client{conn: conn, ip: clientIP(conn.RemoteAddr()), lastActive: time.Now().UnixNano()}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if maxClients > 0 && len(cs.conns) >= maxClients {
+		return nil, rejectedMaxClients
+	}
+	if maxPerIP > 0 && cs.perIP[c.ip] >= maxPerIP {
+		return nil, rejectedMaxPerIP
+	}
+
+	if cs.conns == nil {
+		cs.conns = make(map[*client]bool)
+		cs.perIP = make(map[string]int)
+	}
+	cs.conns[c] = true
+	cs.perIP[c.ip]++
+	return c, ""
+}
+
+func (cs *clients) remove(c *client) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if !cs.conns[c] {
+		return
+	}
+	delete(cs.conns, c)
+	if cs.perIP[c.ip]--; cs.perIP[c.ip] <= 0 {
+		delete(cs.perIP, c.ip)
+	}
+}
+
+// idle returns the clients which haven't had a command served since before. Like
+// Redis, monitoring clients are never idle, as they're only streamed commands.
+func (cs *clients) idle(before time.Time) []*client {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var idle []*client
+	for c := range cs.conns {
+		if atomic.LoadInt32(&c.monitoring) == 1 {
+			continue
+		}
+		if atomic.LoadInt32(&c.busy) == 0 && atomic.LoadInt64(&c.lastActive) < before.UnixNano() {
+			idle = append(idle, c)
+		}
+	}
+	return idle
+}
+
+// clientOf returns the client of conn, nil if it hasn't been accepted by the handler
+func clientOf(conn redcon.Conn) *client {
+	c, _ := conn.Context().(*client)
+	return c
+}
+
+// begin flags the client as busy while a command is served, returning a
+// function to call once it's served
+func (c *client) begin() func() {
+	if c == nil {
+		return func() {}
+	}
+
+	atomic.StoreInt32(&c.busy, 1)
+	return func() {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+		atomic.StoreInt32(&c.busy, 0)
+	}
+}
+
+// monitor flags the client as monitoring, before its connection is detached
+func (c *client) monitor() {
+	if c != nil {
+		atomic.StoreInt32(&c.monitoring, 1)
+	}
+}
+
+// detached tells whether the connection of the client has been detached by MONITOR
+func (c *client) detached() bool {
+	return c != nil && atomic.LoadInt32(&c.monitoring) == 1
+}
+
+// rejectConn refuses a connection, replying why if it exceeds a limit
+func rejectConn(conn redcon.Conn, reason string) bool {
+	log.WithFields(log.Fields{"client": conn.RemoteAddr(), "reason": reason}).Debug("Refusing connection")
+
+	switch reason {
+	case rejectedMaxClients:
+		conn.WriteError(errMaxClientsMsg)
+	case rejectedMaxPerIP:
+		conn.WriteError(errMaxClientsPerIPMsg)
+	}
+	go recordClientRejected(reason)
+	return false
+}
+
+// closeIdleClients closes the connections of clients idle for longer than Clients.Timeout
+func (r *redisHandler) closeIdleClients() {
+	s := r.acquireSettings()
+	timeout := s.config.Clients.Timeout.Duration
+	s.inUse.Done()
+	if timeout <= 0 {
+		return
+	}
+
+	for _, c := range r.clients.idle(time.Now().Add(-timeout)) {
+		log.Tracef("Closing connection from %s, idle for longer than %s", c.conn.RemoteAddr(), timeout)
+		// The network connection is closed rather than conn, as conn isn't safe
+		// for concurrent use; the client is then closed by the server
+		if err := c.conn.NetConn().Close(); err == nil {
+			go recordClientConn(clientTimedOut)
+		}
+	}
+}
+
+// closeIdleClientsPeriodically closes idle clients every idleCheckInterval, until the handler is shut down
+func (r *redisHandler) closeIdleClientsPeriodically() {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.activity.done():
+			return
+		case <-ticker.C:
+			r.closeIdleClients()
+		}
+	}
+}
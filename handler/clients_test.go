@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/redcon"
+)
+
+func TestClientsConfig_validate(t *testing.T) {
+	t.Run(`[When] a client connection configuration is validated
+		   [Then] returns error if limits are negative, or networks are invalid`, func(t *testing.T) {
+
+		problems := &ConfigError{}
+		ClientsConfig{
+			MaxClients: -1,
+			MaxPerIP:   -1,
+			Allow:      []string{"10.0.0.0/8", "localhost"},
+			Deny:       []string{"10.0.0.0/33"},
+			Timeout:    duration{-time.Second},
+		}.validate(problems)
+
+		assert.Len(t, problems.Problems, 5, "every problem should be reported")
+
+		problems = &ConfigError{}
+		ClientsConfig{Allow: []string{"10.0.0.0/8", "127.0.0.1", "::1", "fd00::/8"}}.validate(problems)
+
+		assert.Empty(t, problems.Problems)
+	})
+}
+
+func Test_clientFilter_allowed(t *testing.T) {
+	var tc = []struct {
+		desc    string
+		config  ClientsConfig
+		addr    string
+		allowed bool
+	}{
+		{"no lists", ClientsConfig{}, "10.0.0.1:50000", true},
+		{"allowed network", ClientsConfig{Allow: []string{"10.0.0.0/8"}}, "10.1.2.3:50000", true},
+		{"network not allowed", ClientsConfig{Allow: []string{"10.0.0.0/8"}}, "192.168.0.1:50000", false},
+		{"denied address", ClientsConfig{Deny: []string{"10.0.0.1"}}, "10.0.0.1:50000", false},
+		{"address not denied", ClientsConfig{Deny: []string{"10.0.0.1"}}, "10.0.0.2:50000", true},
+		{"denied within allowed", ClientsConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.0/24"}}, "10.0.0.1:50000", false},
+		{"allowed IPv6", ClientsConfig{Allow: []string{"::1"}}, "[::1]:50000", true},
+	}
+
+	t.Run(`[When] the address of a client is checked
+		   [Then] deny it if it's in Deny, or Allow is set and it's not in it`, func(t *testing.T) {
+
+		for _, tt := range tc {
+			assert.Equal(t, tt.allowed, newClientFilter(tt.config).allowed(tt.addr), tt.desc)
+		}
+	})
+}
+
+func Test_redisHandler_Accept(t *testing.T) {
+	t.Run(`[Given] at most 2 clients, and 1 per IP address
+		    [When] clients connect
+		    [Then] refuse them beyond either limit, replying why
+		     [And] accept them again once a client is closed`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.config.Clients = ClientsConfig{MaxClients: 2, MaxPerIP: 1}
+
+		first := &fakeClientConn{addr: "10.0.0.1:50000"}
+		assert.True(t, handler.Accept(first))
+
+		sameIP := &fakeClientConn{addr: "10.0.0.1:50001"}
+		assert.False(t, handler.Accept(sameIP))
+		assert.Equal(t, []string{errMaxClientsPerIPMsg}, sameIP.errors)
+
+		assert.True(t, handler.Accept(&fakeClientConn{addr: "10.0.0.2:50000"}))
+
+		third := &fakeClientConn{addr: "10.0.0.3:50000"}
+		assert.False(t, handler.Accept(third))
+		assert.Equal(t, []string{errMaxClientsMsg}, third.errors)
+
+		handler.Closed(first, nil)
+		assert.True(t, handler.Accept(sameIP))
+	})
+
+	t.Run(`[Given] clients denied from 10.0.0.0/8
+		    [When] a client connects from 10.0.0.1
+		    [Then] refuse it`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.clientFilter = newClientFilter(ClientsConfig{Deny: []string{"10.0.0.0/8"}})
+
+		assert.False(t, handler.Accept(&fakeClientConn{addr: "10.0.0.1:50000"}))
+		assert.True(t, handler.Accept(&fakeClientConn{addr: "192.168.0.1:50000"}))
+	})
+}
+
+func Test_redisHandler_closeIdleClients(t *testing.T) {
+	t.Run(`[Given] a timeout of 1 minute
+		    [When] idle clients are closed
+		    [Then] close the clients idle for longer, but not those serving a command or monitoring`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.config.Clients = ClientsConfig{Timeout: duration{time.Minute}}
+
+		idle, idlePeer := newFakeClientConn("10.0.0.1:50000")
+		active, activePeer := newFakeClientConn("10.0.0.2:50000")
+		busy, busyPeer := newFakeClientConn("10.0.0.3:50000")
+		monitoring, monitoringPeer := newFakeClientConn("10.0.0.4:50000")
+		for _, conn := range []*fakeClientConn{idle, active, busy, monitoring} {
+			assert.True(t, handler.Accept(conn))
+		}
+		longAgo := time.Now().Add(-time.Hour).UnixNano()
+		atomic.StoreInt64(&clientOf(idle).lastActive, longAgo)
+		atomic.StoreInt64(&clientOf(busy).lastActive, longAgo)
+		atomic.StoreInt64(&clientOf(monitoring).lastActive, longAgo)
+		clientOf(busy).begin()
+		clientOf(monitoring).monitor()
+
+		handler.closeIdleClients()
+
+		assert.True(t, closed(idlePeer), "idle client should be closed")
+		assert.False(t, closed(activePeer), "active client should not be closed")
+		assert.False(t, closed(busyPeer), "client serving a command should not be closed")
+		assert.False(t, closed(monitoringPeer), "monitoring client should not be closed")
+	})
+}
+
+// fakeClientConn is a client connection accepted by a handler, without a server
+type fakeClientConn struct {
+	redcon.Conn
+	addr    string
+	ctx     interface{}
+	netConn net.Conn
+	errors  []string
+}
+
+// newFakeClientConn returns a client connection from addr, along with the other
+// end of its network connection
+func newFakeClientConn(addr string) (*fakeClientConn, net.Conn) {
+	server, client := net.Pipe()
+	return &fakeClientConn{addr: addr, netConn: server}, client
+}
+
+func (c *fakeClientConn) RemoteAddr() string         { return c.addr }
+func (c *fakeClientConn) Context() interface{}       { return c.ctx }
+func (c *fakeClientConn) SetContext(ctx interface{}) { c.ctx = ctx }
+func (c *fakeClientConn) NetConn() net.Conn          { return c.netConn }
+func (c *fakeClientConn) WriteError(msg string)      { c.errors = append(c.errors, msg) }
+
+// closed tells whether the other end of conn has been closed
+func closed(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	return err == io.EOF
+}
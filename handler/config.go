@@ -0,0 +1,319 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gomodule/redigo/redis"
+)
+
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// ClientConfig holds the configuration for Redis client
+type ClientConfig struct {
+	Addr         string
+	Password     string
+	PasswordFile string
+	MaxIdleConns int
+	IdleTimeout  duration
+
+	// ConnectTimeout, ReadTimeout and WriteTimeout bound the time spent
+	// connecting to Redis, and reading and writing a command. They're
+	// unbounded if not set.
+	ConnectTimeout duration
+	ReadTimeout    duration
+	WriteTimeout   duration
+
+	// MaxActive is the maximum number of connections of a pool, idle or in
+	// use. It's unlimited if not set.
+	MaxActive int
+
+	// Wait makes commands wait for a connection once a pool has MaxActive
+	// connections in use, for at most WaitTimeout if set, instead of failing
+	// right away
+	Wait        bool
+	WaitTimeout duration
+
+	// MaxConnLifetime is how long a connection is used for before being
+	// closed. Connections are kept open indefinitely if it's not set.
+	MaxConnLifetime duration
+
+	// TestOnBorrow is how long a connection may be idle before it's checked
+	// with PING on being taken from its pool. Connections aren't checked if
+	// it's not set.
+	TestOnBorrow duration
+
+	Breaker BreakerConfig
+}
+
+// RedisConfig holds configuration for initializing redisHandler
+type RedisConfig struct {
+	Password     string
+	PasswordFile string
+	DeleteOnGet  bool
+	DeleteOnSet  bool
+	Source       ClientConfig
+	Destination  ClientConfig
+
+	// SourceDown is how GET replies for keys missing in "destination" while
+	// "source" is unavailable, either "error" (default) or "nil"
+	SourceDown string
+
+	// DestinationDown is how GET replies while "destination" is unavailable,
+	// either "error" (default) or "source" to read keys from "source" without
+	// migrating them
+	DestinationDown string
+
+	// Degraded is how commands are served while "destination" is down
+	Degraded DegradedConfig
+
+	// CommandTimeout bounds the time spent serving a command, every command
+	// sent to Redis for it included. It's unbounded if not set.
+	CommandTimeout duration
+
+	// Retry is the retry policy of reads and of the commands migrating keys
+	Retry RetryConfig
+
+	// Hedge is how GET reads "source" as well while "destination" is slow to reply
+	Hedge HedgeConfig
+
+	// RateLimit limits the commands of clients and users, and those sent to "source"
+	RateLimit RateLimitConfig
+
+	// Clients limits the connections of clients
+	Clients ClientsConfig
+
+	// StatsInterval is how often sampled metrics, such as the number
+	// of keys remaining in source, are collected
+	StatsInterval duration
+
+	// LatencyBuckets are the bucket boundaries, in milliseconds, of
+	// the latency distribution metrics
+	LatencyBuckets []float64
+
+	Tracing TracingConfig
+	Logging LoggingConfig
+
+	AccessLog AccessLogConfig
+	Slowlog   SlowlogConfig
+	Health    HealthConfig
+	Admin     AdminConfig
+}
+
+// TracingConfig holds the configuration for exporting trace spans
+type TracingConfig struct {
+	// Exporter is where spans are sent, either "zipkin" or "stdout".
+	// Tracing is disabled if it's empty.
+	Exporter string
+
+	// Endpoint is the URL of the collector spans are reported to by the
+	// "zipkin" exporter, e.g. http://localhost:9411/api/v2/spans
+	Endpoint string
+
+	// SampleRate is the fraction of commands traced, between 0 and 1.
+	// Every command is traced if it's not set.
+	SampleRate float64
+}
+
+// ConfigError reports every problem found in a configuration
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func (e *ConfigError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+func (e *ConfigError) orNil() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// LoadConfig reads the TOML configuration file at configPath, overrides it with
+// environment variables, reads password files, and then validates the result.
+// In other words, a field set by an environment variable takes precedence over
+// the one set in the file, and a PasswordFile takes precedence over a Password.
+// The file is skipped if configPath is empty.
+//
+// Keys in the file which don't match any configuration field are reported as
+// invalid, to catch typos that would otherwise be silently ignored.
+func LoadConfig(configPath string) (RedisConfig, error) {
+	var config RedisConfig
+	problems := &ConfigError{}
+
+	if configPath != "" {
+		meta, err := toml.DecodeFile(configPath, &config)
+		if err != nil {
+			return config, err
+		}
+
+		for _, key := range meta.Undecoded() {
+			problems.add("unknown key %q", key.String())
+		}
+	}
+
+	config.applyEnv(problems)
+	config.resolvePasswordFiles(problems)
+	if err, ok := config.Validate().(*ConfigError); ok {
+		problems.Problems = append(problems.Problems, err.Problems...)
+	}
+
+	return config, problems.orNil()
+}
+
+// Validate checks whether the configuration can be used to run remiro. The
+// returned error, if any, is a *ConfigError listing every problem found.
+func (c RedisConfig) Validate() error {
+	problems := &ConfigError{}
+	c.Source.validate("Source", problems)
+	c.Destination.validate("Destination", problems)
+
+	if c.CommandTimeout.Duration < 0 {
+		problems.add("CommandTimeout must not be negative")
+	}
+	if c.StatsInterval.Duration < 0 {
+		problems.add("StatsInterval must not be negative")
+	}
+	for i, bound := range c.LatencyBuckets {
+		if bound < 0 || (i > 0 && bound <= c.LatencyBuckets[i-1]) {
+			problems.add("LatencyBuckets must be non-negative and in increasing order")
+			break
+		}
+	}
+
+	switch c.SourceDown {
+	case "", breakerPolicyError, breakerPolicyNil:
+	default:
+		problems.add("SourceDown %q is not one of %q or %q", c.SourceDown, breakerPolicyError, breakerPolicyNil)
+	}
+	switch c.DestinationDown {
+	case "", breakerPolicyError, breakerPolicySource:
+	default:
+		problems.add("DestinationDown %q is not one of %q or %q", c.DestinationDown, breakerPolicyError, breakerPolicySource)
+	}
+
+	c.Degraded.validate(problems)
+	c.Retry.validate(problems)
+	c.Hedge.validate(problems)
+	c.RateLimit.validate(problems)
+	c.Clients.validate(problems)
+	c.Tracing.validate(problems)
+	c.Logging.validate(problems)
+	c.AccessLog.validate(problems)
+	c.Slowlog.validate(problems)
+	c.Health.validate(problems)
+
+	if c.Source.Addr != "" && c.Source.Addr == c.Destination.Addr {
+		problems.add("Source.Addr and Destination.Addr must not be the same address")
+	}
+
+	return problems.orNil()
+}
+
+// backgroundTimeout bounds the commands remiro sends on its own rather than for a
+// client command, such as replayed writes or those of the admin API: CommandTimeout,
+// or the timeout of health checks if it's not set
+func (c RedisConfig) backgroundTimeout() time.Duration {
+	if c.CommandTimeout.Duration > 0 {
+		return c.CommandTimeout.Duration
+	}
+	return c.Health.timeout()
+}
+
+func (c ClientConfig) validate(name string, problems *ConfigError) {
+	if c.Addr == "" {
+		problems.add("%s.Addr is required", name)
+	} else if _, port, err := net.SplitHostPort(c.Addr); err != nil {
+		problems.add("%s.Addr %q is not a valid \"host:port\" address", name, c.Addr)
+	} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		problems.add("%s.Addr %q has an invalid port", name, c.Addr)
+	}
+
+	if c.MaxIdleConns < 0 {
+		problems.add("%s.MaxIdleConns must not be negative", name)
+	}
+	if c.IdleTimeout.Duration < 0 {
+		problems.add("%s.IdleTimeout must not be negative", name)
+	}
+	if c.ConnectTimeout.Duration < 0 {
+		problems.add("%s.ConnectTimeout must not be negative", name)
+	}
+	if c.ReadTimeout.Duration < 0 {
+		problems.add("%s.ReadTimeout must not be negative", name)
+	}
+	if c.WriteTimeout.Duration < 0 {
+		problems.add("%s.WriteTimeout must not be negative", name)
+	}
+	if c.MaxActive < 0 {
+		problems.add("%s.MaxActive must not be negative", name)
+	}
+	if c.WaitTimeout.Duration < 0 {
+		problems.add("%s.WaitTimeout must not be negative", name)
+	} else if c.WaitTimeout.Duration > 0 && !c.Wait {
+		problems.add("%s.WaitTimeout requires %s.Wait to be set", name, name)
+	}
+	if c.MaxConnLifetime.Duration < 0 {
+		problems.add("%s.MaxConnLifetime must not be negative", name)
+	}
+	if c.TestOnBorrow.Duration < 0 {
+		problems.add("%s.TestOnBorrow must not be negative", name)
+	}
+	c.Breaker.validate(name, problems)
+}
+
+func (c TracingConfig) validate(problems *ConfigError) {
+	switch c.Exporter {
+	case "", exporterStdout:
+	case exporterZipkin:
+		if u, err := url.Parse(c.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			problems.add("Tracing.Endpoint %q is not a valid URL", c.Endpoint)
+		}
+	default:
+		problems.add("Tracing.Exporter %q is not one of %q or %q", c.Exporter, exporterZipkin, exporterStdout)
+	}
+
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		problems.add("Tracing.SampleRate must be between 0 and 1")
+	}
+}
+
+// Ping connects to the Redis server described by the configuration and sends
+// a PING command, returning any error that happened along the way.
+func (c ClientConfig) Ping(timeout time.Duration) error {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(timeout),
+		redis.DialReadTimeout(timeout),
+		redis.DialWriteTimeout(timeout),
+	}
+	if c.Password != "" {
+		options = append(options, redis.DialPassword(c.Password))
+	}
+
+	conn, err := redis.Dial("tcp", c.Addr, options...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = redis.String(conn.Do("PING"))
+	return err
+}
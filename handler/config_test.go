@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Run(`[Given] a valid configuration file
+		    [When] the configuration is loaded
+		    [Then] returns the configuration`, func(t *testing.T) {
+
+		path := writeConfigFile(t, `
+DeleteOnGet = true
+
+[Source]
+Addr = "redis-source:6379"
+MaxIdleConns = 50
+IdleTimeout = "30s"
+
+[Destination]
+Addr = "redis-destination:6379"
+`)
+		defer os.Remove(path)
+
+		config, err := LoadConfig(path)
+
+		assert.NoError(t, err, "loading should not return error")
+		assert.True(t, config.DeleteOnGet, "DeleteOnGet should be set")
+		assert.Equal(t, "redis-source:6379", config.Source.Addr, "Source.Addr should be set")
+		assert.Equal(t, 30*time.Second, config.Source.IdleTimeout.Duration, "Source.IdleTimeout should be set")
+	})
+
+	t.Run(`[Given] a configuration file holding unknown keys and invalid values
+		    [When] the configuration is loaded
+		    [Then] returns error listing every problem`, func(t *testing.T) {
+
+		path := writeConfigFile(t, `
+DeleteOnGett = true
+
+[Source]
+Addr = "redis-source"
+MaxIdleConns = -1
+
+[Destination]
+Adr = "redis-destination:6379"
+`)
+		defer os.Remove(path)
+
+		_, err := LoadConfig(path)
+
+		if assert.IsType(t, &ConfigError{}, err, "error should be a configuration error") {
+			assert.ElementsMatch(t, []string{
+				`unknown key "DeleteOnGett"`,
+				`unknown key "Destination.Adr"`,
+				`Source.Addr "redis-source" is not a valid "host:port" address`,
+				`Source.MaxIdleConns must not be negative`,
+				`Destination.Addr is required`,
+			}, err.(*ConfigError).Problems)
+		}
+	})
+
+	t.Run(`[Given] a configuration file path that doesn't exist
+		    [When] the configuration is loaded
+		    [Then] returns error`, func(t *testing.T) {
+
+		_, err := LoadConfig("does-not-exist.toml")
+
+		assert.Error(t, err, "loading should return error")
+	})
+}
+
+func TestRedisConfig_Validate(t *testing.T) {
+	var tc = []struct {
+		source, destination string
+		valid               bool
+	}{
+		{"redis-source:6379", "redis-destination:6379", true},
+		{":6379", "127.0.0.1:6380", true},
+		{"[::1]:6379", "127.0.0.1:6380", true},
+		{"redis-source:6379", "redis-source:6379", false},
+		{"redis-source:redis", "redis-destination:6379", false},
+		{"redis-source:70000", "redis-destination:6379", false},
+		{"redis-source:6379", "", false},
+	}
+
+	t.Run(`[When] a configuration is validated
+		   [Then] returns error only if backend addresses are invalid`, func(t *testing.T) {
+
+		for _, tt := range tc {
+			config := RedisConfig{
+				Source:      ClientConfig{Addr: tt.source},
+				Destination: ClientConfig{Addr: tt.destination},
+			}
+
+			err := config.Validate()
+
+			assert.Equal(t, tt.valid, err == nil, "validating %q and %q", tt.source, tt.destination)
+		}
+	})
+}
+
+func TestRedisConfig_Validate_breaker(t *testing.T) {
+	t.Run(`[When] a configuration with circuit breakers is validated
+		   [Then] returns error if thresholds or policies are invalid`, func(t *testing.T) {
+
+		config := RedisConfig{
+			Source:      ClientConfig{Addr: "redis-source:6379", Breaker: BreakerConfig{FailureRate: 1.5}},
+			Destination: ClientConfig{Addr: "redis-destination:6379", Breaker: BreakerConfig{Window: duration{-time.Second}}},
+			SourceDown:  "source",
+		}
+
+		err, ok := config.Validate().(*ConfigError)
+		if !assert.True(t, ok, "configuration should be invalid") {
+			return
+		}
+		assert.Len(t, err.Problems, 3, "every problem should be reported")
+	})
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "remiro-*.toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+
+	return file.Name()
+}
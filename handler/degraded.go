@@ -0,0 +1,579 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	defaultDegradedQueueSize     = 10000
+	defaultDegradedCheckInterval = time.Second
+)
+
+// Policies applied to writes in degraded mode
+const (
+	// degradedWritesReject replies an error to writes
+	degradedWritesReject = "reject"
+
+	// degradedWritesSource writes SET to "source", the key being deleted from
+	// "destination" once it's back so that its new value is migrated
+	degradedWritesSource = "source"
+
+	// degradedWritesQueue queues writes to replay them to "destination" once it's
+	// back. Writes are replayed at least once, see replay.
+	degradedWritesQueue = "queue"
+)
+
+var (
+	errQueueFull  = errors.New("queue of writes is full")
+	errQueueInUse = errors.New("the queue file can't be changed while writes are queued")
+
+	errDegradedMsg    = "ERR destination is down, writes are rejected in degraded mode"
+	errUnsupportedMsg = "ERR destination is down, this command isn't supported in degraded mode"
+	errQueueFullMsg   = "ERR destination is down and the queue of writes is full"
+	errQueueFailedMsg = "ERR destination is down and the write couldn't be queued"
+	queuedReplyMsg    = "QUEUED"
+	degradedPolicies  = []string{degradedWritesReject, degradedWritesSource, degradedWritesQueue}
+)
+
+// writeCommands are the writes which can be served in degraded mode, according to
+// the Writes policy. Other commands which aren't in readOnlyCommands, such as
+// INFO, SELECT, MULTI or CONFIG, are rejected in degraded mode, as they can
+// neither be served by "source" nor replayed to "destination" later.
+var writeCommands = map[string]bool{
+	"APPEND": true, "BITFIELD": true, "BITOP": true, "DECR": true, "DECRBY": true,
+	"DEL": true, "EXPIRE": true, "EXPIREAT": true, "GEOADD": true, "GETSET": true,
+	"HDEL": true, "HINCRBY": true, "HINCRBYFLOAT": true, "HMSET": true, "HSET": true,
+	"HSETNX": true, "INCR": true, "INCRBY": true, "INCRBYFLOAT": true, "LINSERT": true,
+	"LPOP": true, "LPUSH": true, "LPUSHX": true, "LREM": true, "LSET": true,
+	"LTRIM": true, "MSET": true, "MSETNX": true, "PERSIST": true, "PEXPIRE": true,
+	"PEXPIREAT": true, "PFADD": true, "PFMERGE": true, "PSETEX": true, "RENAME": true,
+	"RENAMENX": true, "RPOP": true, "RPOPLPUSH": true, "RPUSH": true, "RPUSHX": true,
+	"SADD": true, "SDIFFSTORE": true, "SET": true, "SETBIT": true, "SETEX": true,
+	"SETNX": true, "SETRANGE": true, "SINTERSTORE": true, "SMOVE": true, "SPOP": true,
+	"SREM": true, "SUNIONSTORE": true, "UNLINK": true, "ZADD": true, "ZINCRBY": true,
+	"ZINTERSTORE": true, "ZPOPMAX": true, "ZPOPMIN": true, "ZREM": true, "ZREMRANGEBYLEX": true,
+	"ZREMRANGEBYRANK": true, "ZREMRANGEBYSCORE": true, "ZUNIONSTORE": true,
+}
+
+// DegradedConfig holds the configuration of degraded mode, which remiro enters
+// once "destination" is down and leaves once it answers PING again. Reads are
+// served by "source" in degraded mode, without migrating keys.
+type DegradedConfig struct {
+	// Enabled makes remiro enter degraded mode once a command fails because
+	// "destination" is down: its circuit breaker is open, or it failed with
+	// a network error or timed out
+	Enabled bool
+
+	// Writes is how writes are served in degraded mode, either "reject"
+	// (default), "source" to write SET to "source", or "queue" to replay
+	// writes to "destination" once it's back
+	Writes string
+
+	// QueueSize is the maximum number of writes queued, it defaults to 10000
+	QueueSize int
+
+	// QueueMaxBytes is the maximum size of the writes queued, encoded in
+	// RESP. It's unlimited if not set.
+	QueueMaxBytes int64
+
+	// QueueFile is the path of the append-only file queued writes are kept
+	// in, so that they survive a restart. They're kept in memory only if
+	// it's not set.
+	QueueFile string
+
+	// Fsync is how often the queue file is synced to disk, like appendfsync
+	// of Redis: "always", "everysec" (default) or "no"
+	Fsync string
+
+	// CheckInterval is how often "destination" is checked with PING in
+	// degraded mode, it defaults to 1s
+	CheckInterval duration
+}
+
+func (c DegradedConfig) validate(problems *ConfigError) {
+	if c.Writes != "" && !containsString(degradedPolicies, c.Writes) {
+		problems.add("Degraded.Writes %q is not one of %q", c.Writes, degradedPolicies)
+	}
+	if c.QueueSize < 0 {
+		problems.add("Degraded.QueueSize must not be negative")
+	}
+	if c.QueueMaxBytes < 0 {
+		problems.add("Degraded.QueueMaxBytes must not be negative")
+	}
+	if c.Fsync != "" && !containsString(fsyncPolicies, c.Fsync) {
+		problems.add("Degraded.Fsync %q is not one of %q", c.Fsync, fsyncPolicies)
+	}
+	if c.CheckInterval.Duration < 0 {
+		problems.add("Degraded.CheckInterval must not be negative")
+	}
+}
+
+func (c DegradedConfig) queueSize() int {
+	if c.QueueSize == 0 {
+		return defaultDegradedQueueSize
+	}
+	return c.QueueSize
+}
+
+func (c DegradedConfig) fsync() string {
+	if c.Fsync == "" {
+		return fsyncEverySec
+	}
+	return c.Fsync
+}
+
+func (c DegradedConfig) checkInterval() time.Duration {
+	if c.CheckInterval.Duration == 0 {
+		return defaultDegradedCheckInterval
+	}
+	return c.CheckInterval.Duration
+}
+
+// queuedWrite is a write received in degraded mode, to be sent to "destination" once it's back
+type queuedWrite struct {
+	command string
+	args    []interface{}
+}
+
+// degradedMode keeps track of remiro being in degraded mode, and of the writes
+// queued meanwhile. It outlives configuration reloads.
+type degradedMode struct {
+	mu    sync.Mutex
+	since time.Time
+	queue []queuedWrite
+
+	// bytes is the size of the queued writes, encoded in RESP
+	bytes int64
+
+	// file backs the queue if QueueFile is set
+	file *queueFile
+}
+
+// active reports whether remiro is in degraded mode
+func (d *degradedMode) active() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return !d.since.IsZero()
+}
+
+// enter puts remiro in degraded mode, reporting whether it wasn't in degraded mode already
+func (d *degradedMode) enter() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.since.IsZero() {
+		return false
+	}
+	d.since = time.Now()
+	return true
+}
+
+// leave takes remiro out of degraded mode if no write is queued, reporting
+// whether it did and how long remiro has been in degraded mode
+func (d *degradedMode) leave() (time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.queue) > 0 || d.since.IsZero() {
+		return 0, false
+	}
+	elapsed := time.Since(d.since)
+	d.since = time.Time{}
+	return elapsed, true
+}
+
+// enqueue queues w, appending it to the queue file if any. It returns errQueueFull
+// if the queue has reached QueueSize or QueueMaxBytes of config.
+func (d *degradedMode) enqueue(w queuedWrite, config DegradedConfig) error {
+	encoded := w.encode()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.queue) >= config.queueSize() ||
+		(config.QueueMaxBytes > 0 && d.bytes+int64(len(encoded)) > config.QueueMaxBytes) {
+		return errQueueFull
+	}
+	if d.file != nil {
+		if err := d.file.append(encoded); err != nil {
+			return err
+		}
+	}
+
+	d.queue = append(d.queue, w)
+	d.bytes += int64(len(encoded))
+	return nil
+}
+
+// full reports whether the queue has reached QueueSize or QueueMaxBytes of config
+func (d *degradedMode) full(config DegradedConfig) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.queue) >= config.queueSize() || (config.QueueMaxBytes > 0 && d.bytes >= config.QueueMaxBytes)
+}
+
+// next returns the oldest queued write, if any, leaving it queued
+func (d *degradedMode) next() (queuedWrite, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.queue) == 0 {
+		return queuedWrite{}, false
+	}
+	return d.queue[0], true
+}
+
+// pop removes the oldest queued write, once it has been replayed, marking it
+// as replayed in the queue file so that it isn't replayed again after a restart
+func (d *degradedMode) pop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.bytes -= int64(len(d.queue[0].encode()))
+	d.queue[0] = queuedWrite{}
+	d.queue = d.queue[1:]
+
+	if d.file == nil {
+		return
+	}
+	if len(d.queue) == 0 {
+		if err := d.file.truncate(); err != nil {
+			log.WithFields(log.Fields{"context": "Emptying queue file", "path": d.file.path}).Error(err)
+		}
+	} else if err := d.file.markReplayed(); err != nil {
+		log.WithFields(log.Fields{"context": "Marking queued write as replayed", "path": d.file.path}).Error(err)
+	}
+}
+
+// status returns when remiro entered degraded mode, which is the zero time if it
+// isn't in degraded mode, and the writes queued
+func (d *degradedMode) status() degradedStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status := degradedStatus{Since: d.since, Queued: len(d.queue), QueuedBytes: d.bytes}
+	if d.file != nil {
+		status.QueueFile = d.file.path
+	}
+	return status
+}
+
+// useFile makes the queue backed by the file at path, synced according to fsync,
+// loading the writes it holds. The queue is kept in memory only if path is empty.
+// It returns the number of writes loaded, and errQueueInUse if the queue would be
+// backed by another file while writes are queued.
+func (d *degradedMode) useFile(path, fsync string) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.file != nil && d.file.path == path {
+		d.file.setFsync(fsync)
+		return 0, nil
+	}
+	if d.file == nil && path == "" {
+		return 0, nil
+	}
+	if len(d.queue) > 0 {
+		return 0, errQueueInUse
+	}
+
+	if d.file != nil {
+		if err := d.file.close(); err != nil {
+			log.WithFields(log.Fields{"context": "Closing queue file", "path": d.file.path}).Warn(err)
+		}
+		d.file = nil
+	}
+	if path == "" {
+		return 0, nil
+	}
+
+	file, writes, err := openQueueFile(path, fsync)
+	if err != nil {
+		return 0, err
+	}
+	d.file = file
+	d.queue = writes
+	for _, w := range writes {
+		d.bytes += int64(len(w.encode()))
+	}
+	return len(writes), nil
+}
+
+// close closes the queue file, if any, the queued writes remaining in it
+func (d *degradedMode) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.close()
+	d.file = nil
+	return err
+}
+
+// destinationDown reports whether err, returned for a command sent to "destination",
+// means that it's down. A command timing out as a whole doesn't, as the time may
+// have been spent on "source".
+func destinationDown(err error) bool {
+	if err == nil || err == context.DeadlineExceeded {
+		return false
+	}
+
+	switch classifyError(err) {
+	case errorClassUnavailable, errorClassNetwork, errorClassTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// degradedFor reports whether commands must be served in degraded mode, entering
+// it first if it's enabled and err, returned for a command sent to "destination",
+// means that "destination" is down. err may be nil.
+func (r *redisHandler) degradedFor(s *settings, err error) bool {
+	if !s.config.Degraded.Enabled {
+		return false
+	}
+
+	if destinationDown(err) && r.degraded.enter() {
+		log.WithField("context", "Degraded mode").Warnf("Destination is down, entering degraded mode: %v", err)
+		go recordDegraded(true)
+		go r.recoverDestination()
+	}
+
+	return r.degraded.active()
+}
+
+// openQueueFile makes the queue of writes backed by the QueueFile of config. Writes
+// left in it, e.g. by a previous run of remiro, are loaded and replayed once
+// "destination" answers PING, remiro being in degraded mode meanwhile.
+func (r *redisHandler) openQueueFile(config DegradedConfig) {
+	entry := log.WithFields(log.Fields{"context": "Opening queue file", "path": config.QueueFile})
+
+	loaded, err := r.degraded.useFile(config.QueueFile, config.fsync())
+	if err != nil {
+		entry.Error(err)
+		return
+	}
+	if loaded > 0 {
+		entry.Warnf("Loaded %d queued writes, to be replayed to destination", loaded)
+		if r.degraded.enter() {
+			go recordDegraded(true)
+			go r.recoverDestination()
+		}
+	}
+}
+
+// recoverDestination checks "destination" with PING every CheckInterval until it
+// answers, then replays the queued writes and leaves degraded mode. It gives up
+// once the handler is shut down.
+func (r *redisHandler) recoverDestination() {
+	for {
+		s := r.acquireSettings()
+		interval := s.config.Degraded.checkInterval()
+		s.inUse.Done()
+
+		select {
+		case <-r.activity.done():
+			if status := r.degraded.status(); status.Queued > 0 && status.QueueFile == "" {
+				log.WithField("context", "Degraded mode").Warnf("Shutting down with %d writes still queued, they are lost", status.Queued)
+			} else if status.Queued > 0 {
+				log.WithField("context", "Degraded mode").Warnf("Shutting down with %d writes still queued, they are kept in %s", status.Queued, status.QueueFile)
+			}
+			return
+		case <-time.After(interval):
+		}
+
+		s = r.acquireSettings()
+		elapsed, recovered := r.replay(s)
+		s.inUse.Done()
+
+		if recovered {
+			log.WithField("context", "Degraded mode").Infof("Destination is back, leaving degraded mode after %s", elapsed)
+			go recordDegraded(false)
+			return
+		}
+	}
+}
+
+// replay sends the queued writes to "destination" in order, if it answers PING, and
+// leaves degraded mode once none is queued. Every write is bounded by CommandTimeout,
+// or by the timeout of health checks if it's not set. A write is only dropped from
+// the queue once "destination" replied to it: writes failing with an error reply
+// are dropped, as they would have failed all the same if they had been sent, while
+// writes failing otherwise, e.g. as "destination" is down again, times out, or its
+// pool is exhausted, are kept queued and replayed again later. Writes are thus
+// replayed at least once: a write whose reply wasn't read may have been applied,
+// and is then applied twice.
+func (r *redisHandler) replay(s *settings) (time.Duration, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Health.timeout())
+	conn := s.getConn(ctx, "destination")
+	_, err := s.do(ctx, conn, "destination", "PING")
+	conn.Close()
+	cancel()
+	if err != nil {
+		return 0, false
+	}
+
+	for {
+		w, ok := r.degraded.next()
+		if !ok {
+			if elapsed, left := r.degraded.leave(); left {
+				return elapsed, true
+			}
+			// A write has been queued meanwhile
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.config.backgroundTimeout())
+		conn := s.getConn(ctx, "destination")
+		_, err := s.do(ctx, conn, "destination", w.command, w.args...)
+		conn.Close()
+		cancel()
+		if _, replied := err.(redis.Error); err != nil && !replied {
+			if !notSent(err) {
+				log.WithFields(log.Fields{
+					"context": "Replaying queued write",
+					"command": s.config.Logging.args(writeArgs(w)),
+				}).Warnf("%s, the write is kept queued and may be applied twice", err)
+			}
+			return 0, false
+		}
+
+		if err != nil {
+			log.WithFields(log.Fields{
+				"context": "Replaying queued write",
+				"command": s.config.Logging.args(writeArgs(w)),
+			}).Error(err)
+		}
+		go recordDegradedWrite(w.command, degradedActionOf(err))
+		r.degraded.pop()
+	}
+}
+
+// notSent tells whether a command failing with err is known not to have been sent
+func notSent(err error) bool {
+	if isUnavailable(err) || poolExhausted(err) || isRateLimited(err) {
+		return true
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// writeDegraded serves a write received in degraded mode according to the Writes
+// policy. Commands which aren't writeCommands are rejected, whatever the policy.
+func (r *redisHandler) writeDegraded(ctx context.Context, conn redcon.Conn, s *settings, cmd redcon.Command, command string) {
+	record := accessRecordFrom(ctx)
+	policy := s.config.Degraded.Writes
+
+	switch {
+	case !writeCommands[command]:
+		go recordDegradedWrite(command, degradedRejected)
+		conn.WriteError(errUnsupportedMsg)
+
+	case policy == degradedWritesQueue:
+		if !r.queueWrite(conn, s, cmd, command, newQueuedWrite(command, cmd.Args[1:])) {
+			return
+		}
+		go recordDegradedWrite(command, degradedQueued)
+		record.setRoute(routeQueue)
+		conn.WriteString(queuedReplyMsg)
+
+	case policy == degradedWritesSource && command == "SET" && len(cmd.Args) > 1:
+		// The deletion of the key from "destination" is only queued once the
+		// key has been written to "source", as it would otherwise delete its
+		// latest value. The queue is checked beforehand so that SET isn't
+		// written to "source" if the deletion can't be queued.
+		if r.degraded.full(s.config.Degraded) {
+			go recordDegradedWrite(command, degradedRejected)
+			conn.WriteError(errQueueFullMsg)
+			return
+		}
+
+		srcConn := s.getConn(ctx, "source")
+		defer srcConn.Close()
+
+		record.setRoute(routeFallback)
+		reply, err := redis.String(s.do(ctx, srcConn, "source", command, toInterfaceSlice(cmd.Args[1:])...))
+		if err == redis.ErrNil {
+			// SET with NX or XX whose condition isn't met hasn't written the key
+			go recordDegradedWrite(command, degradedSource)
+			conn.WriteNull()
+			return
+		}
+		if err != nil {
+			go recordDegradedWrite(command, degradedRejected)
+			if _, ok := err.(redis.Error); ok {
+				conn.WriteError(err.Error())
+			} else {
+				logAndReplyError(conn, s, cmd, err)
+			}
+			return
+		}
+
+		// The previous value of the key in "destination" must not outlive this
+		// one, which is only in "source"
+		if !r.queueWrite(conn, s, cmd, command, newQueuedWrite("DEL", cmd.Args[1:2])) {
+			return
+		}
+		go recordDegradedWrite(command, degradedSource)
+		conn.WriteString(reply)
+
+	default:
+		// Only SET is written to "source", as other writes would make
+		// "source" and "destination" diverge
+		go recordDegradedWrite(command, degradedRejected)
+		conn.WriteError(errDegradedMsg)
+	}
+}
+
+// queueWrite queues w for the write cmd, whose uppercased name is command,
+// replying an error if it can't be queued
+func (r *redisHandler) queueWrite(conn redcon.Conn, s *settings, cmd redcon.Command, command string, w queuedWrite) bool {
+	err := r.degraded.enqueue(w, s.config.Degraded)
+	if err == nil {
+		return true
+	}
+
+	go recordDegradedWrite(command, degradedRejected)
+	if err == errQueueFull {
+		conn.WriteError(errQueueFullMsg)
+	} else {
+		log.WithFields(log.Fields{
+			"context": "Queuing write",
+			"command": s.config.Logging.args(cmd.Args),
+		}).Error(err)
+		conn.WriteError(errQueueFailedMsg)
+	}
+	return false
+}
+
+// newQueuedWrite returns a write of command with args, copied as the arguments
+// of commands are only valid while the command is served
+func newQueuedWrite(command string, args [][]byte) queuedWrite {
+	w := queuedWrite{command: command, args: make([]interface{}, len(args))}
+	for i, arg := range args {
+		w.args[i] = append([]byte(nil), arg...)
+	}
+	return w
+}
+
+// writeArgs returns the command and arguments of w, suitable for logging
+func writeArgs(w queuedWrite) [][]byte {
+	args := [][]byte{[]byte(w.command)}
+	for _, arg := range w.args {
+		args = append(args, arg.([]byte))
+	}
+	return args
+}
@@ -0,0 +1,353 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_redisHandler_HandleGET_degraded(t *testing.T) {
+	t.Run(`[Given] degraded mode is enabled and "destination" is down
+		    [When] GET requests are received
+		    [Then] read the keys from "source" without migrating them
+		     [And] don't send further commands to "destination"`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings.config.Degraded = DegradedConfig{Enabled: true, CheckInterval: duration{time.Hour}}
+		dials := flakyDial(handler.settings.destinationPool, 10, dstMock)
+		defer handler.activity.stop()
+
+		srcMock.Command("GET", []byte("mykey")).Expect([]byte("myvalue"))
+		setCmd := dstMock.Command("SET", []byte("mykey"), "myvalue").Expect("OK")
+
+		for i := 0; i < 2; i++ {
+			reply := serveRequest(t, handler, "*2\r\n$3\r\nGET\r\n$5\r\nmykey\r\n")
+
+			assert.Equal(t, "$7\r\nmyvalue\r\n", reply)
+		}
+		assert.False(t, setCmd.Called, "key should not be migrated in degraded mode")
+		assert.Equal(t, 1, *dials, "destination should not be tried again in degraded mode")
+		assert.True(t, handler.degraded.active(), "remiro should be in degraded mode")
+	})
+
+	t.Run(`[Given] degraded mode is disabled and "destination" is down
+		    [When] a GET request is received
+		    [Then] reply with an error`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		flakyDial(handler.settings.destinationPool, 10, dstMock)
+		srcMock.Command("GET", []byte("mykey")).Expect([]byte("myvalue"))
+
+		reply := serveRequest(t, handler, "*2\r\n$3\r\nGET\r\n$5\r\nmykey\r\n")
+
+		assert.Equal(t, "-Unexpected server error\r\n", reply)
+		assert.False(t, handler.degraded.active())
+	})
+}
+
+func Test_redisHandler_HandleDefault_degraded(t *testing.T) {
+	t.Run(`[Given] remiro is in degraded mode
+		    [When] a read request is received
+		    [Then] forward it to "source"`, func(t *testing.T) {
+
+		handler, srcMock, _ := initHandlerMock()
+		handler.settings.config.Degraded = DegradedConfig{Enabled: true}
+		handler.degraded.enter()
+		srcCmd := srcMock.Command("TTL", []byte("mykey")).Expect([]byte(":10\r\n"))
+
+		reply := serveRequest(t, handler, "*2\r\n$3\r\nTTL\r\n$5\r\nmykey\r\n")
+
+		assert.Equal(t, ":10\r\n", reply)
+		assert.True(t, srcCmd.Called, "source should be read")
+	})
+}
+
+func Test_redisHandler_writeDegraded(t *testing.T) {
+	t.Run(`[Given] remiro is in degraded mode, rejecting writes
+		    [When] write requests are received
+		    [Then] reject them`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.config.Degraded = DegradedConfig{Enabled: true}
+		handler.degraded.enter()
+
+		for _, msg := range []string{
+			"*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n$7\r\nmyvalue\r\n",
+			"*2\r\n$4\r\nINCR\r\n$5\r\nmykey\r\n",
+		} {
+			reply := serveRequest(t, handler, msg)
+
+			assert.Equal(t, "-"+errDegradedMsg+"\r\n", reply)
+		}
+	})
+
+	t.Run(`[Given] remiro is in degraded mode, writing to "source"
+		    [When] SET and INCR requests are received
+		    [Then] write SET to "source", queuing the deletion of the key from "destination"
+		     [And] reject INCR`, func(t *testing.T) {
+
+		handler, srcMock, _ := initHandlerMock()
+		handler.settings.config.Degraded = DegradedConfig{Enabled: true, Writes: degradedWritesSource}
+		handler.degraded.enter()
+		srcCmd := srcMock.Command("SET", []byte("mykey"), []byte("myvalue")).Expect("OK")
+
+		reply := serveRequest(t, handler, "*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n$7\r\nmyvalue\r\n")
+
+		assert.Equal(t, "+OK\r\n", reply)
+		assert.True(t, srcCmd.Called, "SET should be sent to source")
+		w, ok := handler.degraded.next()
+		assert.True(t, ok, "deletion of the key should be queued")
+		assert.Equal(t, queuedWrite{command: "DEL", args: []interface{}{[]byte("mykey")}}, w)
+
+		reply = serveRequest(t, handler, "*2\r\n$4\r\nINCR\r\n$5\r\nmykey\r\n")
+
+		assert.Equal(t, "-"+errDegradedMsg+"\r\n", reply)
+	})
+
+	t.Run(`[Given] remiro is in degraded mode, writing to "source"
+		    [When] a SET request fails to be written to "source"
+		    [Then] reply an error without queuing the deletion of the key from "destination"`, func(t *testing.T) {
+
+		handler, srcMock, _ := initHandlerMock()
+		handler.settings.config.Degraded = DegradedConfig{Enabled: true, Writes: degradedWritesSource}
+		handler.degraded.enter()
+		srcMock.Command("SET", []byte("mykey"), []byte("myvalue")).
+			ExpectError(&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")})
+
+		reply := serveRequest(t, handler, "*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n$7\r\nmyvalue\r\n")
+
+		assert.Equal(t, "-Unexpected server error\r\n", reply)
+		assert.Equal(t, 0, handler.degraded.status().Queued, "deletion of the key should not be queued")
+	})
+
+	t.Run(`[Given] remiro is in degraded mode, queuing writes up to 2
+		    [When] write requests are received
+		    [Then] queue them until the queue is full`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.config.Degraded = DegradedConfig{Enabled: true, Writes: degradedWritesQueue, QueueSize: 2}
+		handler.degraded.enter()
+
+		reply := serveRequest(t, handler, "*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n$7\r\nmyvalue\r\n")
+		assert.Equal(t, "+QUEUED\r\n", reply)
+
+		reply = serveRequest(t, handler, "*2\r\n$4\r\nINCR\r\n$7\r\ncounter\r\n")
+		assert.Equal(t, "+QUEUED\r\n", reply)
+
+		reply = serveRequest(t, handler, "*2\r\n$4\r\nINCR\r\n$7\r\ncounter\r\n")
+		assert.Equal(t, "-"+errQueueFullMsg+"\r\n", reply)
+
+		assert.Equal(t, 2, handler.degraded.status().Queued)
+	})
+}
+
+func Test_redisHandler_writeDegraded_unsupported(t *testing.T) {
+	t.Run(`[Given] remiro is in degraded mode, queuing writes
+		    [When] commands which are neither reads nor writes are received
+		    [Then] reject them without queuing them`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.config.Degraded = DegradedConfig{Enabled: true, Writes: degradedWritesQueue}
+		handler.degraded.enter()
+
+		for _, msg := range []string{
+			"*1\r\n$4\r\nINFO\r\n",
+			"*1\r\n$5\r\nMULTI\r\n",
+			"*2\r\n$6\r\nSELECT\r\n$1\r\n1\r\n",
+			"*3\r\n$6\r\nCONFIG\r\n$3\r\nGET\r\n$7\r\ntimeout\r\n",
+		} {
+			reply := serveRequest(t, handler, msg)
+
+			assert.Equal(t, "-"+errUnsupportedMsg+"\r\n", reply)
+		}
+		assert.Equal(t, 0, handler.degraded.status().Queued, "commands should not be queued")
+	})
+}
+
+func Test_redisHandler_recoverDestination(t *testing.T) {
+	t.Run(`[Given] degraded mode is enabled, queuing writes
+		    [When] "destination" goes down and comes back
+		    [Then] queue writes meanwhile, replay them once it's back and leave degraded mode`, func(t *testing.T) {
+
+		handler, _, dstMock := initHandlerMock()
+		handler.settings.config.Degraded = DegradedConfig{
+			Enabled:       true,
+			Writes:        degradedWritesQueue,
+			CheckInterval: duration{10 * time.Millisecond},
+		}
+		down := switchableDial(dstMock, handler.settings.destinationPool, handler.settings.destinationRawPool)
+		defer handler.activity.stop()
+
+		atomic.StoreInt32(down, 1)
+		reply := serveRequest(t, handler, "*2\r\n$4\r\nINCR\r\n$7\r\ncounter\r\n")
+		assert.Equal(t, "-Unexpected server error\r\n", reply, "a write which may have been sent should fail")
+		assert.True(t, handler.degraded.active(), "remiro should be in degraded mode")
+
+		reply = serveRequest(t, handler, "*3\r\n$3\r\nSET\r\n$5\r\nmykey\r\n$7\r\nmyvalue\r\n")
+		assert.Equal(t, "+QUEUED\r\n", reply)
+		reply = serveRequest(t, handler, "*2\r\n$4\r\nINCR\r\n$7\r\ncounter\r\n")
+		assert.Equal(t, "+QUEUED\r\n", reply)
+
+		dstMock.Command("PING").Expect("PONG")
+		setCmd := dstMock.Command("SET", []byte("mykey"), []byte("myvalue")).Expect("OK")
+		incrCmd := dstMock.Command("INCR", []byte("counter")).Expect(int64(1))
+		atomic.StoreInt32(down, 0)
+
+		assert.Eventually(t, func() bool { return !handler.degraded.active() }, time.Second, 10*time.Millisecond,
+			"remiro should leave degraded mode")
+		assert.True(t, setCmd.Called, "queued SET should be replayed")
+		assert.Equal(t, 1, dstMock.Stats(incrCmd), "queued INCR should be replayed once")
+	})
+}
+
+func Test_redisHandler_replay(t *testing.T) {
+	t.Run(`[Given] a write queued, and "destination" answering PING but not the write
+		    [When] queued writes are replayed with a command timeout of 10ms
+		    [Then] give up replaying once the write times out, keeping it queued`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.config.CommandTimeout = duration{10 * time.Millisecond}
+		handler.degraded.enter()
+		handler.degraded.enqueue(newQueuedWrite("INCR", [][]byte{[]byte("counter")}), DegradedConfig{})
+
+		pinged := false
+		stuck := redigomock.NewConn()
+		stuck.Command("INCR", []byte("counter")).Expect(int64(1))
+		handler.settings.destinationPool.Dial = func() (redis.Conn, error) {
+			if !pinged {
+				pinged = true
+				ping := redigomock.NewConn()
+				ping.Command("PING").Expect("PONG")
+				return contextConn{ping}, nil
+			}
+			return slowConn{contextConn{stuck}, time.Hour}, nil
+		}
+
+		start := time.Now()
+		_, recovered := handler.replay(handler.settings)
+
+		assert.False(t, recovered, "remiro should stay in degraded mode")
+		assert.True(t, time.Since(start) < time.Second, "replay should not wait for destination")
+		assert.Equal(t, 1, handler.degraded.status().Queued, "write should stay queued")
+	})
+}
+
+func Test_redisHandler_replay_errors(t *testing.T) {
+	t.Run(`[Given] writes queued, and "destination" answering PING
+		    [When] the first write fails as the pool of "destination" is exhausted
+		    [Then] keep it queued, rather than losing it`, func(t *testing.T) {
+
+		handler, _, dstMock := initHandlerMock()
+		handler.degraded.enter()
+		handler.degraded.enqueue(newQueuedWrite("INCR", [][]byte{[]byte("counter")}), DegradedConfig{})
+		handler.degraded.enqueue(newQueuedWrite("SET", [][]byte{[]byte("mykey"), []byte("hello")}), DegradedConfig{})
+
+		dstMock.Command("PING").Expect("PONG")
+		dstMock.Command("INCR", []byte("counter")).ExpectError(poolExhaustedError{pool: "destination"})
+		setCmd := dstMock.Command("SET", []byte("mykey"), []byte("hello")).Expect("OK")
+
+		_, recovered := handler.replay(handler.settings)
+
+		assert.False(t, recovered, "remiro should stay in degraded mode")
+		assert.Equal(t, 2, handler.degraded.status().Queued, "writes should stay queued")
+		assert.False(t, setCmd.Called, "writes should be replayed in order")
+	})
+
+	t.Run(`[Given] writes queued, and "destination" answering PING
+		    [When] the first write fails with an error reply
+		    [Then] drop it, and replay the next one`, func(t *testing.T) {
+
+		handler, _, dstMock := initHandlerMock()
+		handler.degraded.enter()
+		handler.degraded.enqueue(newQueuedWrite("INCR", [][]byte{[]byte("mykey")}), DegradedConfig{})
+		handler.degraded.enqueue(newQueuedWrite("SET", [][]byte{[]byte("mykey"), []byte("hello")}), DegradedConfig{})
+
+		dstMock.Command("PING").Expect("PONG")
+		dstMock.Command("INCR", []byte("mykey")).ExpectError(redis.Error("ERR value is not an integer or out of range"))
+		setCmd := dstMock.Command("SET", []byte("mykey"), []byte("hello")).Expect("OK")
+
+		_, recovered := handler.replay(handler.settings)
+
+		assert.True(t, recovered, "remiro should leave degraded mode")
+		assert.True(t, setCmd.Called, "next write should be replayed")
+	})
+}
+
+func Test_destinationDown(t *testing.T) {
+	t.Run(`[When] errors returned for "destination" are checked
+		   [Then] only report it as down for network errors, timeouts and an open breaker`, func(t *testing.T) {
+
+		assert.True(t, destinationDown(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}))
+		assert.True(t, destinationDown(unavailableError{"destination"}))
+		assert.False(t, destinationDown(nil))
+		assert.False(t, destinationDown(redis.ErrNil))
+		assert.False(t, destinationDown(redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")))
+		assert.False(t, destinationDown(poolExhaustedError{pool: "destination"}))
+	})
+}
+
+func TestDegradedConfig_validate(t *testing.T) {
+	t.Run(`[When] a degraded mode configuration is validated
+		   [Then] returns error if the write or fsync policy is unknown, or limits are negative`, func(t *testing.T) {
+
+		problems := &ConfigError{}
+		DegradedConfig{
+			Enabled:       true,
+			Writes:        "drop",
+			QueueSize:     -1,
+			QueueMaxBytes: -1,
+			Fsync:         "sometimes",
+			CheckInterval: duration{-time.Second},
+		}.validate(problems)
+
+		assert.Len(t, problems.Problems, 5, "every problem should be reported")
+	})
+}
+
+func Test_redisHandler_Status_degraded(t *testing.T) {
+	t.Run(`[Given] remiro is in degraded mode with a queued write
+		    [When] the status is requested
+		    [Then] report it`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		srcMock.Command("PING").Expect("PONG")
+		dstMock.Command("PING").ExpectError(errors.New("connection refused"))
+		handler.degraded.enter()
+		handler.degraded.enqueue(newQueuedWrite("SET", [][]byte{[]byte("mykey"), []byte("myvalue")}), DegradedConfig{})
+
+		w := httptest.NewRecorder()
+		handler.Status(w, httptest.NewRequest("GET", "/status", nil))
+
+		var status handlerStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "Degraded", status.Status)
+		if assert.NotNil(t, status.Degraded) {
+			assert.Equal(t, 1, status.Degraded.Queued)
+		}
+	})
+}
+
+// switchableDial makes the connections of pools fail to be dialed with a network
+// error while the returned flag is set to 1, dialing mock otherwise
+func switchableDial(mock *redigomock.Conn, pools ...*redis.Pool) *int32 {
+	down := new(int32)
+	for _, pool := range pools {
+		pool.Dial = func() (redis.Conn, error) {
+			if atomic.LoadInt32(down) == 1 {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+			}
+			return contextConn{mock}, nil
+		}
+	}
+	return down
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+)
+
+// disconnectCheckInterval is how often the connection of a client is checked
+// for being closed while one of its commands is served
+const disconnectCheckInterval = 100 * time.Millisecond
+
+// withClientDisconnect returns a copy of ctx which is canceled once the client
+// of netConn disconnects. As most commands are served well within a check
+// interval, the connection is only checked for commands taking longer. A client
+// disconnecting with commands still to be read isn't noticed, as the connection
+// is only peeked at.
+// The returned cancel function must be called once the command is served.
+func withClientDisconnect(ctx context.Context, netConn net.Conn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	sysConn, ok := netConn.(syscall.Conn)
+	if !ok {
+		return ctx, cancel
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return ctx, cancel
+	}
+
+	timer := time.AfterFunc(disconnectCheckInterval, func() {
+		ticker := time.NewTicker(disconnectCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			if peerClosed(rawConn) {
+				cancel()
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+
+	return ctx, func() {
+		timer.Stop()
+		cancel()
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package handler
+
+import "syscall"
+
+// peerClosed always reports the peer as connected, as the socket can't be
+// peeked at on this platform
+func peerClosed(conn syscall.RawConn) bool {
+	return false
+}
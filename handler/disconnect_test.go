@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_withClientDisconnect(t *testing.T) {
+	connect := func(t *testing.T) (client, server net.Conn) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		client, err = net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err = listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return client, server
+	}
+
+	t.Run(`[Given] a command is being served
+		    [When] the client disconnects
+		    [Then] cancel the context of the command`, func(t *testing.T) {
+
+		client, server := connect(t)
+		defer server.Close()
+
+		ctx, cancel := withClientDisconnect(context.Background(), server)
+		defer cancel()
+
+		client.Close()
+		select {
+		case <-ctx.Done():
+			assert.Equal(t, context.Canceled, ctx.Err())
+		case <-time.After(5 * disconnectCheckInterval):
+			t.Error("context should be canceled once the client disconnects")
+		}
+	})
+
+	t.Run(`[Given] a command is being served
+		    [When] the client pipelines another command
+		    [Then] keep the context of the command going`, func(t *testing.T) {
+
+		client, server := connect(t)
+		defer client.Close()
+		defer server.Close()
+
+		ctx, cancel := withClientDisconnect(context.Background(), server)
+		defer cancel()
+
+		client.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+		time.Sleep(3 * disconnectCheckInterval)
+
+		assert.NoError(t, ctx.Err(), "context should not be canceled while the client is connected")
+	})
+}
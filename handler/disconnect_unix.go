@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package handler
+
+import "syscall"
+
+// peerClosed reports whether the peer of conn has closed the connection, by
+// peeking at the socket without consuming the commands pipelined by the peer
+func peerClosed(conn syscall.RawConn) bool {
+	var closed bool
+	err := conn.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			// Nothing to read, the peer is still there
+			return true
+		}
+		closed = err != nil || n == 0
+		return true
+	})
+
+	return closed || err != nil
+}
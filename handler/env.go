@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"encoding"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// EnvPrefix is the prefix of environment variables overriding the configuration
+const EnvPrefix = "REMIRO_"
+
+// EnvName returns the environment variable name for a configuration field path,
+// e.g. ["Source", "MaxIdleConns"] gives REMIRO_SOURCE_MAX_IDLE_CONNS.
+func EnvName(path ...string) string {
+	parts := make([]string, len(path))
+	for i, name := range path {
+		parts[i] = toScreamingSnake(name)
+	}
+
+	return EnvPrefix + strings.Join(parts, "_")
+}
+
+func toScreamingSnake(name string) string {
+	runes := []rune(name)
+
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+
+	return b.String()
+}
+
+// applyEnv overrides the configuration fields for which an environment variable is set.
+// Every field, including the ones of nested configuration, has its own variable
+// named after its path, see EnvName.
+func (c *RedisConfig) applyEnv(problems *ConfigError) {
+	applyEnvToStruct(reflect.ValueOf(c).Elem(), nil, problems)
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+func applyEnvToStruct(v reflect.Value, path []string, problems *ConfigError) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		fieldPath := append(append([]string(nil), path...), field.Name)
+		fieldValue := v.Field(i)
+
+		isText := reflect.PtrTo(field.Type).Implements(textUnmarshalerType)
+		if field.Type.Kind() == reflect.Struct && !isText {
+			applyEnvToStruct(fieldValue, fieldPath, problems)
+			continue
+		}
+
+		name := EnvName(fieldPath...)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromText(fieldValue, value); err != nil {
+			problems.add("%s %q is not a valid value for %s", name, value, strings.Join(fieldPath, "."))
+		}
+	}
+}
+
+// setFromText parses text into v, according to the type of v
+func setFromText(v reflect.Value, text string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(text))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(text, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(text, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		// Slices are given as comma separated values
+		var items []string
+		if text != "" {
+			items = strings.Split(text, ",")
+		}
+		slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setFromText(slice.Index(i), strings.TrimSpace(item)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	default:
+		return strconv.ErrSyntax
+	}
+
+	return nil
+}
+
+// resolvePasswordFiles reads the passwords of the configuration whose
+// PasswordFile is set, replacing the Password set along with it, if any.
+// The same goes for the token of the admin API.
+func (c *RedisConfig) resolvePasswordFiles(problems *ConfigError) {
+	readPasswordFile(&c.Password, c.PasswordFile, "PasswordFile", problems)
+	readPasswordFile(&c.Source.Password, c.Source.PasswordFile, "Source.PasswordFile", problems)
+	readPasswordFile(&c.Destination.Password, c.Destination.PasswordFile, "Destination.PasswordFile", problems)
+	readPasswordFile(&c.Admin.Token, c.Admin.TokenFile, "Admin.TokenFile", problems)
+}
+
+func readPasswordFile(password *string, path, name string, problems *ConfigError) {
+	if path == "" {
+		return
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		problems.add("%s: %v", name, err)
+		return
+	}
+
+	// Secret files commonly end with a line break which isn't part of the secret
+	*password = strings.TrimRight(string(content), "\r\n")
+}
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvName(t *testing.T) {
+	var tc = []struct {
+		path []string
+		name string
+	}{
+		{[]string{"DeleteOnGet"}, "REMIRO_DELETE_ON_GET"},
+		{[]string{"Source", "MaxIdleConns"}, "REMIRO_SOURCE_MAX_IDLE_CONNS"},
+		{[]string{"Destination", "PasswordFile"}, "REMIRO_DESTINATION_PASSWORD_FILE"},
+		{[]string{"MaxConnsPerIP"}, "REMIRO_MAX_CONNS_PER_IP"},
+		{[]string{"TLSConfig"}, "REMIRO_TLS_CONFIG"},
+	}
+
+	for _, tt := range tc {
+		assert.Equal(t, tt.name, EnvName(tt.path...))
+	}
+}
+
+func TestLoadConfig_Overrides(t *testing.T) {
+	path := writeConfigFile(t, `
+Password = "from-file"
+DeleteOnGet = true
+
+[Source]
+Addr = "redis-source:6379"
+Password = "from-file"
+IdleTimeout = "30s"
+
+[Destination]
+Addr = "redis-destination:6379"
+`)
+	defer os.Remove(path)
+
+	t.Run(`[Given] environment variables are set for some configuration fields
+		    [When] the configuration is loaded
+		    [Then] the environment variables take precedence over the file`, func(t *testing.T) {
+
+		defer setEnv(map[string]string{
+			"REMIRO_DELETE_ON_GET":        "false",
+			"REMIRO_SOURCE_ADDR":          "10.0.0.1:6379",
+			"REMIRO_SOURCE_IDLE_TIMEOUT":  "1m",
+			"REMIRO_DESTINATION_PASSWORD": "from-env",
+		})()
+
+		config, err := LoadConfig(path)
+
+		assert.NoError(t, err, "loading should not return error")
+		assert.False(t, config.DeleteOnGet, "DeleteOnGet should be overridden")
+		assert.Equal(t, "10.0.0.1:6379", config.Source.Addr, "Source.Addr should be overridden")
+		assert.Equal(t, time.Minute, config.Source.IdleTimeout.Duration, "Source.IdleTimeout should be overridden")
+		assert.Equal(t, "from-env", config.Destination.Password, "Destination.Password should be overridden")
+		assert.Equal(t, "from-file", config.Password, "Password should be kept")
+	})
+
+	t.Run(`[Given] an environment variable with an invalid value
+		    [When] the configuration is loaded
+		    [Then] returns error`, func(t *testing.T) {
+
+		defer setEnv(map[string]string{"REMIRO_SOURCE_MAX_IDLE_CONNS": "many"})()
+
+		_, err := LoadConfig(path)
+
+		assert.IsType(t, &ConfigError{}, err, "error should be a configuration error")
+	})
+
+	t.Run(`[Given] a password file is set along with a password
+		    [When] the configuration is loaded
+		    [Then] the password is read from the file`, func(t *testing.T) {
+
+		secret, err := ioutil.TempFile("", "remiro-secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(secret.Name())
+		secret.WriteString("from-secret\n")
+		secret.Close()
+
+		defer setEnv(map[string]string{"REMIRO_SOURCE_PASSWORD_FILE": secret.Name()})()
+
+		config, err := LoadConfig(path)
+
+		assert.NoError(t, err, "loading should not return error")
+		assert.Equal(t, "from-secret", config.Source.Password, "Source.Password should be read from the file")
+	})
+
+	t.Run(`[Given] a password file that doesn't exist
+		    [When] the configuration is loaded
+		    [Then] returns error`, func(t *testing.T) {
+
+		defer setEnv(map[string]string{"REMIRO_PASSWORD_FILE": "does-not-exist"})()
+
+		_, err := LoadConfig(path)
+
+		assert.IsType(t, &ConfigError{}, err, "error should be a configuration error")
+	})
+}
+
+// setEnv sets environment variables, returning a function restoring them
+func setEnv(vars map[string]string) func() {
+	for name, value := range vars {
+		os.Setenv(name, value)
+	}
+
+	return func() {
+		for name := range vars {
+			os.Unsetenv(name)
+		}
+	}
+}
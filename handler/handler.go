@@ -7,17 +7,15 @@ package handler
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"contrib.go.opencensus.io/exporter/prometheus"
-	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
-	"go.opencensus.io/tag"
 
 	"github.com/gomodule/redigo/redis"
 	log "github.com/sirupsen/logrus"
@@ -31,6 +29,13 @@ type Handler interface {
 	Closed(conn redcon.Conn, err error)
 
 	HealthCheck(w http.ResponseWriter, req *http.Request)
+	Liveness(w http.ResponseWriter, req *http.Request)
+	Readiness(w http.ResponseWriter, req *http.Request)
+	Status(w http.ResponseWriter, req *http.Request)
+	Admin(w http.ResponseWriter, req *http.Request)
+	Slowlog(w http.ResponseWriter, req *http.Request)
+	Reload(config RedisConfig) error
+	Shutdown(ctx context.Context) error
 }
 
 // Run creates a new Listener with specified address on TCP network.
@@ -49,63 +54,160 @@ func NewServer(addr string, handler Handler) *redcon.Server {
 
 // RunInstrumentation creates and run a HTTP server which provides a couple of endpoints:
 // - /health to check server health
+// - /livez, /readyz and /status to check whether remiro is alive, ready to
+//   serve commands, and its detailed status
 // - /metrics to provide instrumentation metrics
-func RunInstrumentation(addr string, handler Handler, errSignal chan error) error {
+// - /slowlog to list the commands that took a long time to serve, see Slowlog
+// - /admin/ to change the behaviour of remiro at runtime, see Admin
+//
+// The returned server can be used to shut the instrumentation down.
+func RunInstrumentation(addr string, handler Handler, errSignal chan error) (*http.Server, error) {
+	configureViews(handler)
 	if err := view.Register(views...); err != nil {
-		return err
+		return nil, err
 	}
 
 	pe, err := prometheus.NewExporter(prometheus.Options{
 		Namespace: "remiro",
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	view.RegisterExporter(pe)
+	if instrumented, ok := handler.(instrumentedHandler); ok {
+		go instrumented.collectStats()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", pe)
+	mux.Handle("/health", http.HandlerFunc(handler.HealthCheck))
+	mux.Handle("/livez", http.HandlerFunc(handler.Liveness))
+	mux.Handle("/readyz", http.HandlerFunc(handler.Readiness))
+	mux.Handle("/status", http.HandlerFunc(handler.Status))
+	mux.Handle("/admin/", http.HandlerFunc(handler.Admin))
+	mux.Handle("/slowlog", http.HandlerFunc(handler.Slowlog))
+	server := &http.Server{Addr: addr, Handler: mux}
 	go func() {
-		mux := http.NewServeMux()
-		mux.Handle("/metrics", pe)
-		mux.Handle("/health", http.HandlerFunc(handler.HealthCheck))
-		if err := http.ListenAndServe(addr, mux); err != nil {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			errSignal <- err
 		}
 	}()
 
-	return nil
+	return server, nil
 }
 
 // redisHandler is an implementation of Handler
 type redisHandler struct {
-	sourcePool        *redis.Pool
-	destinationPool   *redis.Pool
-	deleteOnGet       bool
-	deleteOnSet       bool
+	settings          *settings
+	settingsMu        sync.RWMutex
+	reloadMu          sync.Mutex
 	deletedKey        map[string]bool
 	authenticatedAddr map[string]bool
-	password          string
+	activity          activity
+	slowlog           slowlog
+	monitors          monitors
+	degraded          degradedMode
+	clients           clients
+	connectedClients  int64
 	sync.Mutex
 }
 
 var (
-	replyTypeBytes = []byte{'+', '-', ':', '$', '*'}
-	noAuthCmd      = []string{"AUTH", "QUIT"}
-	errAuthMsg     = "NOAUTH Authentication required."
+	noAuthCmd  = []string{"AUTH", "QUIT"}
+	errAuthMsg = "NOAUTH Authentication required."
+
+	// errStreamingMsg is replied to commands after which Redis streams replies,
+	// such as SUBSCRIBE, as commands proxied to "destination" have a single reply
+	errStreamingMsg = "ERR '%s' is not supported by remiro"
 )
 
 func (r *redisHandler) Handle(conn redcon.Conn, cmd redcon.Command) {
+	if !r.activity.begin() {
+		conn.WriteError(errShutdownMsg)
+		conn.Close()
+		return
+	}
+	defer r.activity.end()
+	defer clientOf(conn).begin()()
+
+	// While draining, every connection is closed after serving its current
+	// command so that it can't bring in new commands. Pipelined commands
+	// which haven't been served yet are discarded without being run.
+	defer func() {
+		if r.activity.isDraining() {
+			conn.ReadPipeline()
+			conn.Close()
+		}
+	}()
+
 	startTime := time.Now()
-	reqCtx, err := tag.New(context.Background())
-	if err != nil {
-		log.WithField("context", "Error when recording command").Warn(err)
+	command := strings.ToUpper(string(cmd.Args[0]))
+	recorder := &replyRecorder{Conn: conn}
+	conn = recorder
+	ctx, span := startCommandSpan(command, cmd.Args[1:])
+	defer func() {
+		endSpan(span, recorder.err())
+		recordRequest(command, !recorder.failed(), sinceInMs(startTime))
+	}()
+
+	s := r.acquireSettings()
+	defer s.inUse.Done()
+
+	if s.config.Clients.CountCommands {
+		go recordClientCommand(conn.RemoteAddr())
 	}
-	defer stats.Record(reqCtx, reqLatencyMs.M(sinceInMs(startTime)))
 
-	log.Tracef("Receiving command from %s: %v", conn.RemoteAddr(), logCmd(cmd.Args))
+	// Commands sent to Redis are given up once the client disconnects or
+	// the command times out, rather than waiting on a stuck Redis
+	ctx, cancel := withClientDisconnect(ctx, conn.NetConn())
+	defer cancel()
+	if timeout := s.config.CommandTimeout.Duration; timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
 
-	command := strings.ToUpper(string(cmd.Args[0]))
-	if !r.authorizedConn(conn, command) {
+	if log.IsLevelEnabled(log.TraceLevel) {
+		log.Tracef("Receiving command from %s: %v", conn.RemoteAddr(), s.config.Logging.args(cmd.Args))
+	}
+
+	var record *accessRecord
+	if s.accessLog != nil || s.config.Slowlog.enabled() || r.monitors.active() {
+		record = &accessRecord{client: conn.RemoteAddr(), command: commandTag(command)}
+		if len(cmd.Args) > 1 {
+			record.key = s.config.Logging.key(command, cmd.Args[1])
+		}
+		ctx = withAccessRecord(ctx, record)
+		defer func() {
+			latency := time.Since(startTime)
+			if s.accessLog != nil {
+				s.accessLog.log(record, r.user(conn, s), recorder, latency)
+			}
+			if command != "SLOWLOG" && s.config.Slowlog.slow(latency) {
+				r.slowlog.add(s.config.Slowlog.maxLen(), slowlogEntry{
+					Time:     startTime,
+					Duration: latency,
+					Args:     slowlogArgs(s.config.Logging.args(cmd.Args)),
+					Client:   record.client,
+					Backends: record.calls(),
+				})
+			}
+			if command != "MONITOR" && r.monitors.active() {
+				r.monitors.broadcast(monitorLine(startTime, record.client, s.config.Logging.args(cmd.Args), record))
+			}
+		}()
+	}
+
+	if limit, ok := s.rateLimiter.allowCommand(conn.RemoteAddr(), r.user(conn, s)); !ok {
+		conn.WriteError(s.config.RateLimit.message())
+		go recordRateLimited(command, limit)
+		return
+	}
+
+	if !r.authorizedConn(conn, s, command) {
 		conn.WriteError(errAuthMsg)
+		go recordError(targetRemiro, command, errorClassAuth)
 		return
 	}
 
@@ -116,98 +218,172 @@ func (r *redisHandler) Handle(conn redcon.Conn, cmd redcon.Command) {
 			args = toInterfaceSlice(cmd.Args[1:])
 		}
 
-		dstConn := r.destinationPool.Get()
-		defer dstConn.Close()
+		var reply string
+		var err error
+		var hedged hedgedGet
+		degraded := r.degradedFor(s, nil)
+		if !degraded {
+			hedged = s.getDestination(ctx, args)
+			if hedged.sourceFirst {
+				// A value read from "source" isn't migrated, as "destination" may hold a newer one
+				go recordLookup("GET", routeHedge)
+				record.setRoute(routeHedge)
+				conn.WriteBulkString(hedged.source.reply)
+				break
+			}
 
-		reply, err := redis.String(dstConn.Do(command, args...))
-		go recordRedisCmd("destination", "GET")
-		if err == nil {
-			conn.WriteBulkString(reply)
+			reply, err = hedged.destination.reply, hedged.destination.err
+			if err == nil {
+				go recordLookup("GET", routeDestination)
+				record.setRoute(routeDestination)
+				conn.WriteBulkString(reply)
+				break
+			}
+		}
+
+		// getSource reads the key from "source", unless a hedged read already did
+		getSource := func() (string, error) {
+			if hedged.source != nil {
+				return hedged.source.reply, hedged.source.err
+			}
+			return redis.String(s.doWithRetry(ctx, "source", command, args...))
+		}
+
+		if degraded || r.degradedFor(s, err) || (isUnavailable(err) && s.config.DestinationDown == breakerPolicySource) {
+			// Keys aren't migrated while "destination" is unavailable, they're only read
+			reply, err := getSource()
+			switch err {
+			case nil:
+				go recordLookup("GET", routeFallback)
+				record.setRoute(routeFallback)
+				conn.WriteBulkString(reply)
+			case redis.ErrNil:
+				go recordLookup("GET", routeNone)
+				record.setRoute(routeNone)
+				conn.WriteNull()
+			default:
+				logAndReplyError(conn, s, cmd, err)
+			}
 			break
 		}
 
 		if err != redis.ErrNil {
-			logAndReplyError(conn, cmd, err)
+			if hedged.source != nil && hedged.source.err == nil {
+				go recordLookup("GET", routeHedge)
+				record.setRoute(routeHedge)
+				conn.WriteBulkString(hedged.source.reply)
+				break
+			}
+			logAndReplyError(conn, s, cmd, err)
 			break
 		}
 
-		srcConn := r.sourcePool.Get()
-		defer srcConn.Close()
-
-		reply, err = redis.String(srcConn.Do(command, args...))
-		go recordRedisCmd("source", "GET")
+		reply, err = getSource()
 		if err != nil {
-			if err == redis.ErrNil {
+			if err == redis.ErrNil || (isUnavailable(err) && s.config.SourceDown == breakerPolicyNil) {
+				go recordLookup("GET", routeNone)
+				record.setRoute(routeNone)
 				conn.WriteNull()
 			} else {
-				logAndReplyError(conn, cmd, err)
+				logAndReplyError(conn, s, cmd, err)
 			}
 			break
 		}
+		go recordLookup("GET", routeSource)
+		record.setRoute(routeSource)
 
 		val := reply
 		key := cmd.Args[1]
 
-		_, err = redis.String(dstConn.Do("SET", key, val))
-		go recordRedisCmd("destination", "SET")
+		_, err = redis.String(s.doWithRetry(ctx, "destination", "SET", key, val))
+		go recordCopy("GET", err == nil, len(val))
+		record.migrated("copy", err == nil)
 		if err != nil {
+			go recordError("destination", "SET", errorClassMigration)
 			log.WithFields(log.Fields{
 				"context": "SET key to destination from source",
-				"key":     string(key),
+				"key":     s.config.Logging.key(command, key),
 			}).Error(err)
 		}
 
-		if r.deleteOnGet && err == nil {
-			if err := deleteKey(srcConn, key); err != nil {
+		if s.deleteOnGet && err == nil {
+			err := s.deleteKey(ctx, key)
+			if err != nil {
+				go recordError("source", "DEL", errorClassMigration)
 				log.WithFields(log.Fields{
 					"context": "Delete on GET",
-					"key":     string(key),
+					"key":     s.config.Logging.key(command, key),
 				}).Warn(err)
 			}
-			go recordRedisCmd("source", "DEL")
+			go recordDeletion("GET", routeSource, err == nil)
+			record.migrated("delete", err == nil)
 		}
 
 		conn.WriteBulkString(reply)
 
 	case "SET":
+		record.setRoute(routeDestination)
 		args := make([]interface{}, 0)
 		if len(cmd.Args) > 1 {
 			args = toInterfaceSlice(cmd.Args[1:])
 		}
 
-		dstConn := r.destinationPool.Get()
+		if r.degradedFor(s, nil) {
+			r.writeDegraded(ctx, conn, s, cmd, command)
+			break
+		}
+
+		dstConn := s.getConn(ctx, "destination")
 		defer dstConn.Close()
 
-		reply, err := redis.String(dstConn.Do(command, args...))
-		go recordRedisCmd("destination", "SET")
+		reply, err := redis.String(s.do(ctx, dstConn, "destination", command, args...))
 		if err != nil {
-			if _, ok := err.(redis.Error); !ok {
-				logAndReplyError(conn, cmd, err)
+			if r.degradedFor(s, err) && isUnavailable(err) {
+				// The write hasn't been sent, so it's served in degraded mode instead
+				r.writeDegraded(ctx, conn, s, cmd, command)
+			} else if _, ok := err.(redis.Error); !ok {
+				logAndReplyError(conn, s, cmd, err)
 			} else {
 				conn.WriteError(err.Error())
 			}
 			break
 		}
 
-		if key := cmd.Args[1]; r.deleteOnSet && !r.deletedKey[string(key)] {
-			srcConn := r.sourcePool.Get()
-			defer srcConn.Close()
-
-			if err := deleteKey(srcConn, key); err != nil {
+		if key := cmd.Args[1]; s.deleteOnSet && !r.deletedKey[string(key)] {
+			err := s.deleteKey(ctx, key)
+			if err != nil {
+				go recordError("source", "DEL", errorClassMigration)
 				log.WithFields(log.Fields{
 					"context": "Delete on SET",
-					"key":     string(key),
+					"key":     s.config.Logging.key(command, key),
 				}).Error(err)
 			} else {
 				r.Lock()
 				r.deletedKey[string(key)] = true
 				r.Unlock()
 			}
-			go recordRedisCmd("source", "DEL")
+			go recordDeletion("SET", routeDestination, err == nil)
+			record.migrated("delete", err == nil)
 		}
 
 		conn.WriteString(reply)
 
+	case "SLOWLOG":
+		r.handleSlowlog(conn, cmd)
+
+	case "MONITOR":
+		// The connection is taken over from the server, and only used to stream
+		// commands from then on. The client still counts against the limits of
+		// clients until the monitor is closed.
+		clientOf(conn).monitor()
+		conn.WriteString("OK")
+		r.monitors.add(conn.Detach(), func() { r.clientClosed(conn) })
+
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "SYNC", "PSYNC":
+		// Once subscribed, a connection to "destination" couldn't be returned
+		// to its pool, as its pushed messages are never all read
+		conn.WriteError(fmt.Sprintf(errStreamingMsg, strings.ToLower(command)))
+
 	case "PING":
 		conn.WriteString("PONG")
 
@@ -221,18 +397,19 @@ func (r *redisHandler) Handle(conn redcon.Conn, cmd redcon.Command) {
 			return
 		}
 
-		if r.password == "" {
+		if s.password == "" {
 			conn.WriteError("ERR Client sent AUTH, but no password is set")
 			return
 		}
 
 		var authenticated bool
 		pass := string(cmd.Args[1])
-		if pass == r.password {
+		if pass == s.password {
 			authenticated = true
 			conn.WriteString("OK")
 		} else {
 			conn.WriteError("ERR invalid password")
+			go recordError(targetRemiro, command, errorClassAuth)
 		}
 
 		r.Lock()
@@ -240,79 +417,147 @@ func (r *redisHandler) Handle(conn redcon.Conn, cmd redcon.Command) {
 		r.Unlock()
 
 	default:
+		record.setRoute(routeDestination)
 		args := make([]interface{}, 0)
 		if len(cmd.Args) > 1 {
 			args = toInterfaceSlice(cmd.Args[1:])
 		}
 
-		dstConn := r.destinationPool.Get()
-		defer dstConn.Close()
+		var reply []byte
+		var err error
+		degraded := r.degradedFor(s, nil)
+		if readOnlyCommands[command] {
+			if !degraded {
+				reply, err = redis.Bytes(s.doWithRetry(ctx, "destination_raw", command, args...))
+			}
+			if degraded || (err != nil && r.degradedFor(s, err)) {
+				record.setRoute(routeFallback)
+				reply, err = redis.Bytes(s.doWithRetry(ctx, "source_raw", command, args...))
+			}
+		} else {
+			if degraded {
+				r.writeDegraded(ctx, conn, s, cmd, command)
+				break
+			}
 
-		reply, err := dstConn.Do(command, args...)
-		go recordRedisCmd("destination", command)
-		if err != nil {
-			if _, ok := err.(redis.Error); !ok {
-				logAndReplyError(conn, cmd, err)
+			dstConn := s.getConn(ctx, "destination_raw")
+			defer dstConn.Close()
+
+			reply, err = redis.Bytes(s.do(ctx, dstConn, "destination", command, args...))
+			if err != nil && r.degradedFor(s, err) && isUnavailable(err) {
+				r.writeDegraded(ctx, conn, s, cmd, command)
+				break
 			}
 		}
+		if err != nil {
+			logAndReplyError(conn, s, cmd, err)
+			break
+		}
 
-		writeResponse(conn, reply)
+		conn.WriteRaw(reply)
 	}
 }
 
+// Accept accepts a connection unless remiro is shutting down, the client isn't
+// allowed to connect from its address, or it would exceed the connection limits
 func (r *redisHandler) Accept(conn redcon.Conn) bool {
+	if r.activity.isDraining() {
+		log.Tracef("Refusing connection from %s, remiro is shutting down", conn.RemoteAddr())
+		go recordClientRejected(rejectedShuttingDown)
+		return false
+	}
+
+	s := r.acquireSettings()
+	defer s.inUse.Done()
+
+	if !s.clientFilter.allowed(conn.RemoteAddr()) {
+		return rejectConn(conn, rejectedDenied)
+	}
+	c, reason := r.clients.add(conn, s.config.Clients.MaxClients, s.config.Clients.MaxPerIP)
+	if c == nil {
+		return rejectConn(conn, reason)
+	}
+	conn.SetContext(c)
+
 	log.Tracef("Accepting connection from %s", conn.RemoteAddr())
+	atomic.AddInt64(&r.connectedClients, 1)
+	go recordClientConn(clientAccepted)
 	return true
 }
 
 func (r *redisHandler) Closed(conn redcon.Conn, err error) {
+	if clientOf(conn).detached() {
+		// The connection has been taken over by MONITOR rather than closed,
+		// the client being closed along with its monitor
+		return
+	}
+	r.clientClosed(conn)
+}
+
+// clientClosed forgets a client whose connection has been closed
+func (r *redisHandler) clientClosed(conn redcon.Conn) {
 	log.Tracef("Connection from %s has been closed", conn.RemoteAddr())
+	atomic.AddInt64(&r.connectedClients, -1)
+	go recordClientConn(clientClosed)
+	if c := clientOf(conn); c != nil {
+		r.clients.remove(c)
+	}
 
 	r.Lock()
 	r.authenticatedAddr[conn.RemoteAddr()] = false
 	r.Unlock()
 }
 
+// HealthCheck replies 200 if both backends answer PING, 500 if either doesn't, and
+// 503 if remiro is shutting down. It's kept for compatibility, Readiness being
+// its configurable counterpart.
 func (r *redisHandler) HealthCheck(w http.ResponseWriter, req *http.Request) {
-	srcConn := r.sourcePool.Get()
-	_, srcErr := redis.String(srcConn.Do("PING"))
+	s := r.acquireSettings()
+	defer s.inUse.Done()
 
-	dstConn := r.destinationPool.Get()
-	_, dstErr := redis.String(dstConn.Do("PING"))
+	reports := checkBackends(s)
 
 	var status int
-	if srcErr != nil || dstErr != nil {
+	if r.activity.isDraining() {
+		status = http.StatusServiceUnavailable
+	} else if !reports["source"].ok() || !reports["destination"].ok() {
 		status = http.StatusInternalServerError
 	} else {
 		status = http.StatusOK
 	}
 
-	buildRedisReport := func(err error) map[string]string {
-		report := make(map[string]string)
-		if err != nil {
-			report["status"] = "Error"
-			report["error"] = err.Error()
-		} else {
-			report["status"] = "OK"
+	buildRedisReport := func(report backendReport) map[string]string {
+		body := map[string]string{"status": report.Status}
+		if report.Error != "" {
+			body["error"] = report.Error
 		}
 
-		return report
+		return body
 	}
 
-	body := map[string]map[string]string{
-		"sourceRedis":      buildRedisReport(srcErr),
-		"destinationRedis": buildRedisReport(dstErr),
-	}
+	writeJSON(w, status, map[string]map[string]string{
+		"sourceRedis":      buildRedisReport(reports["source"]),
+		"destinationRedis": buildRedisReport(reports["destination"]),
+	})
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	if err := json.NewEncoder(w).Encode(body); err != nil {
-		log.Error(err)
+// user returns the user conn is authenticated as, which is always the default user
+// as remiro only supports passwords, or an empty string if it's not authenticated
+func (r *redisHandler) user(conn redcon.Conn, s *settings) string {
+	if s.password != "" {
+		r.Lock()
+		authenticated := r.authenticatedAddr[conn.RemoteAddr()]
+		r.Unlock()
+		if !authenticated {
+			return ""
+		}
 	}
+
+	return "default"
 }
 
-func (r *redisHandler) authorizedConn(conn redcon.Conn, cmd string) bool {
-	if r.password == "" {
+func (r *redisHandler) authorizedConn(conn redcon.Conn, s *settings, cmd string) bool {
+	if s.password == "" {
 		return true
 	}
 	for _, allowedCmd := range noAuthCmd {
@@ -323,64 +568,160 @@ func (r *redisHandler) authorizedConn(conn redcon.Conn, cmd string) bool {
 	return r.authenticatedAddr[conn.RemoteAddr()]
 }
 
-type duration struct {
-	time.Duration
+// doRedis sends a command to a backing Redis using conn, and records its count and
+// latency for the target, either "source" or "destination". The command is traced
+// as a child of the span in ctx, and added to the access record in ctx, if any.
+func doRedis(ctx context.Context, conn redis.Conn, target, command string, args ...interface{}) (interface{}, error) {
+	span := startBackendSpan(ctx, target, command, args)
+	startTime := time.Now()
+	reply, err := doContext(ctx, conn, command, args...)
+	latency := sinceInMs(startTime)
+	go recordRedisCmd(target, command, latency)
+
+	failure := err
+	if err != nil {
+		if !givenUp(ctx, err) {
+			go recordError(target, command, classifyError(err))
+		}
+	} else if raw, ok := reply.([]byte); ok {
+		if replyErr := replyError(raw); replyErr != nil {
+			failure = replyErr
+			go recordError(target, command, classifyErrorReply(replyErr.Error()))
+		}
+	}
+	endSpan(span, failure)
+	accessRecordFrom(ctx).addBackend(target, command, latency, failure)
+
+	return reply, err
 }
 
-func (d *duration) UnmarshalText(text []byte) error {
-	var err error
-	d.Duration, err = time.ParseDuration(string(text))
-	return err
+// doContext sends a command using conn, giving up once ctx is done, in which case
+// the error of ctx is returned. Contexts which can't be done are done without.
+func doContext(ctx context.Context, conn redis.Conn, command string, args ...interface{}) (interface{}, error) {
+	if ctx.Done() == nil {
+		return conn.Do(command, args...)
+	}
+
+	reply, err := redis.DoContext(conn, ctx, command, args...)
+	if err != nil && contextErr(ctx) != nil {
+		// Reading the reply may have failed on the deadline of ctx first
+		err = contextErr(ctx)
+	}
+
+	return reply, err
 }
 
-// ClientConfig holds the configuration for Redis client
-type ClientConfig struct {
-	Addr         string
-	Password     string
-	MaxIdleConns int
-	IdleTimeout  duration
+// contextErr returns the error of ctx, which is context.DeadlineExceeded as soon
+// as the deadline of ctx has passed, even if ctx hasn't been marked as done yet
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+
+	return nil
 }
 
-// RedisConfig holds configuration for initializing redisHandler
-type RedisConfig struct {
-	Password    string
-	DeleteOnGet bool
-	DeleteOnSet bool
-	Source      ClientConfig
-	Destination ClientConfig
+// do sends a command to target like doRedis does, through the circuit breaker
+// of target. The command is refused with an unavailableError, without being
+// sent, if the breaker is open, or with a rateLimitedError if it's sent to
+// "source" beyond its rate limit.
+func (s *settings) do(ctx context.Context, conn redis.Conn, target, command string, args ...interface{}) (interface{}, error) {
+	if target == "source" && !s.rateLimiter.allowSource() {
+		err := rateLimitedError{target}
+		go recordRateLimited(command, rateLimitSource)
+		accessRecordFrom(ctx).addBackend(target, command, 0, err)
+		return nil, err
+	}
+
+	b := s.breakers()[target]
+	if !b.allow() {
+		err := unavailableError{target}
+		go recordError(target, command, errorClassUnavailable)
+		accessRecordFrom(ctx).addBackend(target, command, 0, err)
+		return nil, err
+	}
+
+	startTime := time.Now()
+	reply, err := doRedis(ctx, conn, target, command, args...)
+	if isUnavailable(err) || err == context.Canceled || poolExhausted(err) {
+		// The connection couldn't be dialed as the breaker opened meanwhile, or
+		// gotten from its pool, or the client went away, which says nothing
+		// about the backend
+		b.release()
+	} else {
+		b.record(breakerFailure(err), time.Since(startTime))
+	}
+
+	return reply, err
 }
 
 // NewRedisHandler returns new instance of redisHandler, a connection
 // handler that handler redis-like interface
 func NewRedisHandler(config RedisConfig) Handler {
-	return &redisHandler{
-		sourcePool:        newRedisPool(config.Source),
-		destinationPool:   newRedisPool(config.Destination),
-		deleteOnGet:       config.DeleteOnGet,
-		deleteOnSet:       config.DeleteOnSet,
+	r := &redisHandler{
+		settings:          newSettings(config, nil),
 		deletedKey:        make(map[string]bool),
 		authenticatedAddr: make(map[string]bool),
-		password:          config.Password,
 	}
+	r.openQueueFile(config.Degraded)
+	go r.closeIdleClientsPeriodically()
+
+	return r
 }
 
-func newRedisPool(config ClientConfig) *redis.Pool {
-	options := make([]redis.DialOption, 0)
+// newRedisPool returns a pool of connections to the Redis of config. Connections
+// aren't dialed while b, the circuit breaker of the Redis, refuses commands.
+func newRedisPool(config ClientConfig, b *breaker) *redis.Pool {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(config.ConnectTimeout.Duration),
+		redis.DialReadTimeout(config.ReadTimeout.Duration),
+		redis.DialWriteTimeout(config.WriteTimeout.Duration),
+	}
 	if config.Password != "" {
 		options = append(options, redis.DialPassword(config.Password))
 	}
 
 	return &redis.Pool{
-		MaxIdle:     config.MaxIdleConns,
-		IdleTimeout: config.IdleTimeout.Duration,
+		MaxIdle:         config.MaxIdleConns,
+		IdleTimeout:     config.IdleTimeout.Duration,
+		MaxActive:       config.MaxActive,
+		Wait:            config.Wait,
+		MaxConnLifetime: config.MaxConnLifetime.Duration,
+		TestOnBorrow:    testOnBorrow(config.TestOnBorrow.Duration),
 		Dial: func() (redis.Conn, error) {
+			if !b.ready() {
+				return nil, unavailableError{b.target}
+			}
 			return redis.Dial("tcp", config.Addr, options...)
 		},
 	}
 }
 
-func deleteKey(conn redis.Conn, key []byte) error {
-	_, err := redis.Int(conn.Do("DEL", key))
+// newRawRedisPool returns a pool of connections whose replies are
+// the verbatim RESP bytes sent by the Redis server, see rawConn.
+func newRawRedisPool(config ClientConfig, b *breaker) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:         config.MaxIdleConns,
+		IdleTimeout:     config.IdleTimeout.Duration,
+		MaxActive:       config.MaxActive,
+		Wait:            config.Wait,
+		MaxConnLifetime: config.MaxConnLifetime.Duration,
+		TestOnBorrow:    testOnBorrow(config.TestOnBorrow.Duration),
+		Dial: func() (redis.Conn, error) {
+			if !b.ready() {
+				return nil, unavailableError{b.target}
+			}
+			return dialRaw(config)
+		},
+	}
+}
+
+// deleteKey deletes key from "source", retrying according to the retry policy
+func (s *settings) deleteKey(ctx context.Context, key []byte) error {
+	_, err := redis.Int(s.doWithRetry(ctx, "source", "DEL", key))
 	if err != nil && err != redis.ErrNil {
 		return err
 	}
@@ -388,35 +729,6 @@ func deleteKey(conn redis.Conn, key []byte) error {
 	return nil
 }
 
-func writeResponse(conn redcon.Conn, reply interface{}) {
-	switch resp := reply.(type) {
-	case nil:
-		conn.WriteNull()
-	case error:
-		conn.WriteError(resp.Error())
-	case string:
-		conn.WriteString(resp)
-	case []byte:
-		if isRawReply(resp) {
-			conn.WriteRaw(resp)
-		} else {
-			conn.WriteBulk(resp)
-		}
-	case int:
-		conn.WriteInt(resp)
-	case int64:
-		conn.WriteInt64(resp)
-	case []interface{}:
-		conn.WriteArray(len(resp))
-		for _, res := range resp {
-			writeResponse(conn, res)
-		}
-	default:
-		msg := fmt.Sprintf("Unrecognized reply: %v", resp)
-		conn.WriteError(msg)
-	}
-}
-
 func toInterfaceSlice(args [][]byte) []interface{} {
 	iArgs := make([]interface{}, len(args))
 	for i, v := range args {
@@ -426,27 +738,29 @@ func toInterfaceSlice(args [][]byte) []interface{} {
 	return iArgs
 }
 
-func isRawReply(reply []byte) bool {
-	for _, replyType := range replyTypeBytes {
-		if reply[0] == replyType {
-			return true
-		}
-	}
-
-	return false
-}
-
-func logCmd(cmdArgs [][]byte) []string {
-	cmd := make([]string, len(cmdArgs))
-	for i, arg := range cmdArgs {
-		cmd[i] = string(arg)
+func logAndReplyError(conn redcon.Conn, s *settings, cmd redcon.Command, err error) {
+	switch {
+	case isUnavailable(err):
+		// Not logged, as it would be for every command while a circuit breaker is
+		// open, the transitions of breakers being logged instead
+		conn.WriteError("ERR " + err.Error())
+		return
+	case poolExhausted(err):
+		conn.WriteError("ERR " + err.Error())
+	case isRateLimited(err):
+		// Not logged, as it would be for every command while "source" is busy
+		conn.WriteError(s.config.RateLimit.message())
+		return
+	case err == context.Canceled:
+		// The client has disconnected, so the reply goes nowhere
+		conn.WriteError("ERR command canceled")
+		return
+	case err == context.DeadlineExceeded:
+		conn.WriteError("ERR command timed out")
+	default:
+		conn.WriteError("Unexpected server error")
 	}
-	return cmd
-}
-
-func logAndReplyError(conn redcon.Conn, cmd redcon.Command, err error) {
-	conn.WriteError("Unexpected server error")
 	log.WithFields(log.Fields{
-		"command": logCmd(cmd.Args),
+		"command": s.config.Logging.args(cmd.Args),
 	}).Error(err)
 }
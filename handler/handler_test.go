@@ -1,10 +1,12 @@
 package handler
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/rafaeljusto/redigomock"
@@ -18,7 +20,7 @@ func Test_redisHandler(t *testing.T) {
 			[Then] returns error stating the connection requires authentication`, func(t *testing.T) {
 
 		handler, _, _ := initHandlerMock()
-		handler.password = "justapass"
+		handler.settings.password = "justapass"
 
 		rawCmd := "*1\r\n$4\r\nPING\r\n"
 		rawErr := "-NOAUTH Authentication required.\r\n"
@@ -206,7 +208,7 @@ func Test_redisHandler_HandleGET(t *testing.T) {
 		     [And] SET the value with the key to "destination"`, func(t *testing.T) {
 
 		handler, srcMock, dstMock := initHandlerMock()
-		handler.deleteOnGet = false
+		handler.settings.deleteOnGet = false
 
 		dstGET := dstMock.Command("GET", []byte(key)).Expect(nil)
 		dstSET := dstMock.Command("SET", []byte(key), value).Expect("OK")
@@ -257,7 +259,7 @@ func Test_redisHandler_HandleGET(t *testing.T) {
 			 [And] DELETE the key from "source"`, func(t *testing.T) {
 
 		handler, srcMock, dstMock := initHandlerMock()
-		handler.deleteOnGet = true
+		handler.settings.deleteOnGet = true
 
 		dstGET := dstMock.Command("GET", []byte(key)).Expect(nil)
 		dstSET := dstMock.Command("SET", []byte(key), value).Expect("OK")
@@ -362,7 +364,7 @@ func Test_redisHandler_HandleSET(t *testing.T) {
 			[Then] SET the key with the value to "destination"`, func(t *testing.T) {
 
 		handler, _, dstMock := initHandlerMock()
-		handler.deleteOnSet = false
+		handler.settings.deleteOnSet = false
 
 		dstSET := dstMock.Command("SET", []byte(key), []byte(value)).Expect("OK")
 
@@ -406,7 +408,7 @@ func Test_redisHandler_HandleSET(t *testing.T) {
 			[Then] returns the error message`, func(t *testing.T) {
 
 		handler, _, dstMock := initHandlerMock()
-		handler.deleteOnSet = false
+		handler.settings.deleteOnSet = false
 
 		dstSET := dstMock.Command("SET", []byte(key), []byte(value)).ExpectError(fmt.Errorf(errorMsg))
 
@@ -450,7 +452,7 @@ func Test_redisHandler_HandleSET(t *testing.T) {
 			 [And] DELETE the key from "source"`, func(t *testing.T) {
 
 		handler, srcMock, dstMock := initHandlerMock()
-		handler.deleteOnSet = true
+		handler.settings.deleteOnSet = true
 
 		dstSET := dstMock.Command("SET", []byte(key), []byte(value)).Expect("OK")
 		srcDEL := srcMock.Command("DEL", []byte(key)).Expect(int64(1))
@@ -497,7 +499,7 @@ func Test_redisHandler_HandleSET(t *testing.T) {
 			 [And] Don't DELETE the key from "source"`, func(t *testing.T) {
 
 		handler, srcMock, dstMock := initHandlerMock()
-		handler.deleteOnSet = true
+		handler.settings.deleteOnSet = true
 		handler.deletedKey[key] = true
 
 		dstSET := dstMock.Command("SET", []byte(key), []byte(value)).Expect("OK")
@@ -595,10 +597,10 @@ func Test_redisHandler_HandleAUTH(t *testing.T) {
 			 [And] authenticate the connection`, func(t *testing.T) {
 
 		handler, _, _ := initHandlerMock()
-		handler.password = handlerPass
+		handler.settings.password = handlerPass
 
 		var (
-			rawAuth = fmt.Sprintf("*2\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n", len(handler.password), handler.password)
+			rawAuth = fmt.Sprintf("*2\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n", len(handler.settings.password), handler.settings.password)
 			rawOK   = "+OK\r\n"
 		)
 
@@ -641,7 +643,7 @@ func Test_redisHandler_HandleAUTH(t *testing.T) {
 			[Then] returns error stating invalid password`, func(t *testing.T) {
 
 		handler, _, _ := initHandlerMock()
-		handler.password = handlerPass
+		handler.settings.password = handlerPass
 		passArgs := "wrongpass"
 
 		var (
@@ -687,7 +689,7 @@ func Test_redisHandler_HandleAUTH(t *testing.T) {
 			[Then] returns error stating that password is not set`, func(t *testing.T) {
 
 		handler, _, _ := initHandlerMock()
-		handler.password = ""
+		handler.settings.password = ""
 
 		passArgs := "nonexistent"
 		rawAuth := fmt.Sprintf("*2\r\n$4\r\nAUTH\r\n$%d\r\n%s\r\n", len(passArgs), passArgs)
@@ -730,7 +732,7 @@ func Test_redisHandler_HandleAUTH(t *testing.T) {
 		   [Then] returns error stating that the number of args is wrong`, func(t *testing.T) {
 
 		handler, _, _ := initHandlerMock()
-		handler.password = handlerPass
+		handler.settings.password = handlerPass
 
 		rawAuth := fmt.Sprintf("*1\r\n$4\r\nAUTH\r\n")
 		rawErr := "-ERR wrong number of arguments for 'auth' command\r\n"
@@ -775,14 +777,15 @@ func Test_redisHandler_HandleDefault(t *testing.T) {
 		rawMsg   string
 		cmd      string
 		args     [][]byte
-		reply    interface{}
 		replyRaw string
 	}{
-		{"*2\r\n$4\r\nECHO\r\n$5\r\nHello\r\n", "ECHO", [][]byte{[]byte("Hello")}, "Hello", "+Hello\r\n"},
-		{"*3\r\n$4\r\nHGET\r\n$6\r\nmyhash\r\n$5\r\nfield\r\n", "HGET", [][]byte{[]byte("myhash"), []byte("field")}, nil, "$-1\r\n"},
-		{"*1\r\n$4\r\nHSET\r\n", "HSET", [][]byte{}, fmt.Errorf("Wrong number of args"), "-Wrong number of args\r\n"},
-		{"*2\r\n$3\r\nTTL\r\n$5\r\nmykey\r\n", "TTL", [][]byte{[]byte("mykey")}, 10, ":10\r\n"},
-		{"*1\r\n$7\r\nCOMMAND\r\n", "COMMAND", [][]byte{}, []interface{}{[]byte("GET"), []byte("SET")}, "*2\r\n$3\r\nGET\r\n$3\r\nSET\r\n"},
+		{"*2\r\n$4\r\nECHO\r\n$5\r\nHello\r\n", "ECHO", [][]byte{[]byte("Hello")}, "$5\r\nHello\r\n"},
+		{"*2\r\n$4\r\nECHO\r\n$2\r\n-5\r\n", "ECHO", [][]byte{[]byte("-5")}, "$2\r\n-5\r\n"},
+		{"*3\r\n$4\r\nHGET\r\n$6\r\nmyhash\r\n$5\r\nfield\r\n", "HGET", [][]byte{[]byte("myhash"), []byte("field")}, "$-1\r\n"},
+		{"*1\r\n$4\r\nHSET\r\n", "HSET", [][]byte{}, "-ERR wrong number of arguments for 'hset' command\r\n"},
+		{"*2\r\n$3\r\nTTL\r\n$5\r\nmykey\r\n", "TTL", [][]byte{[]byte("mykey")}, ":10\r\n"},
+		{"*1\r\n$7\r\nCOMMAND\r\n", "COMMAND", [][]byte{}, "*2\r\n$3\r\nGET\r\n$3\r\nSET\r\n"},
+		{"*2\r\n$6\r\nLRANGE\r\n$5\r\nmykey\r\n", "LRANGE", [][]byte{[]byte("mykey")}, "*2\r\n$11\r\n*important*\r\n$4\r\n:42:\r\n"},
 	}
 
 	t.Run(`[When] any request except GET, SET, and PING is received
@@ -791,7 +794,7 @@ func Test_redisHandler_HandleDefault(t *testing.T) {
 
 		for _, tt := range tc {
 			handler, _, dstMock := initHandlerMock()
-			dstCMD := dstMock.Command(tt.cmd, toInterfaceSlice(tt.args)...).Expect(tt.reply)
+			dstCMD := dstMock.Command(tt.cmd, toInterfaceSlice(tt.args)...).Expect([]byte(tt.replyRaw))
 
 			fatal := make(chan error)
 			signal := make(chan error)
@@ -829,6 +832,29 @@ func Test_redisHandler_HandleDefault(t *testing.T) {
 	})
 }
 
+func Test_redisHandler_CommandTimeout(t *testing.T) {
+	t.Run(`[Given] "destination" doesn't reply
+			 [And] CommandTimeout is set
+		    [When] a request is forwarded to "destination"
+		    [Then] reply an error once the command times out`, func(t *testing.T) {
+
+		backend, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer backend.Close()
+		go serveReplies(backend, make(chan []byte))
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.config.CommandTimeout = duration{50 * time.Millisecond}
+		handler.settings.destinationRawPool = newRawRedisPool(ClientConfig{Addr: backend.Addr().String()}, nil)
+
+		reply := serveRequest(t, handler, "*2\r\n$4\r\nINCR\r\n$5\r\nmykey\r\n")
+
+		assert.Equal(t, "-ERR command timed out\r\n", reply)
+	})
+}
+
 func initHandlerMock() (handler *redisHandler, srcMock, dstMock *redigomock.Conn) {
 	srcMock = redigomock.NewConn()
 	dstMock = redigomock.NewConn()
@@ -836,20 +862,44 @@ func initHandlerMock() (handler *redisHandler, srcMock, dstMock *redigomock.Conn
 	var config = RedisConfig{}
 	handler = NewRedisHandler(config).(*redisHandler)
 
-	handler.sourcePool = &redis.Pool{
+	handler.settings.sourcePool = &redis.Pool{
 		Dial: func() (redis.Conn, error) {
-			return srcMock, nil
+			return contextConn{srcMock}, nil
 		},
 	}
-	handler.destinationPool = &redis.Pool{
+	handler.settings.sourceRawPool = &redis.Pool{
 		Dial: func() (redis.Conn, error) {
-			return dstMock, nil
+			return contextConn{srcMock}, nil
+		},
+	}
+	handler.settings.destinationPool = &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return contextConn{dstMock}, nil
+		},
+	}
+	handler.settings.destinationRawPool = &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return contextConn{dstMock}, nil
 		},
 	}
 
 	return
 }
 
+// contextConn adds redis.ConnWithContext to a redigomock.Conn, so that it can be used
+// as the connections of remiro, the context being ignored as mocks reply right away
+type contextConn struct {
+	*redigomock.Conn
+}
+
+func (c contextConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return c.Do(cmd, args...)
+}
+
+func (c contextConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return c.Receive()
+}
+
 func doRequest(addr, msg string) (reply string, err error) {
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
@@ -0,0 +1,269 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+const defaultHealthTimeout = time.Second
+
+// HealthConfig holds the configuration of health checks
+type HealthConfig struct {
+	// Required lists the backends which must answer PING for remiro to be
+	// ready, among "source" and "destination". Both are required if it's
+	// not set, and none if it's set to an empty list.
+	Required []string
+
+	// Timeout is how long each backend is given to answer PING, it defaults to 1s
+	Timeout duration
+}
+
+func (c HealthConfig) validate(problems *ConfigError) {
+	for _, backend := range c.Required {
+		if backend != "source" && backend != "destination" {
+			problems.add("Health.Required %q is not one of \"source\" or \"destination\"", backend)
+		}
+	}
+	if c.Timeout.Duration < 0 {
+		problems.add("Health.Timeout must not be negative")
+	}
+}
+
+func (c HealthConfig) required() []string {
+	if c.Required == nil {
+		return []string{"source", "destination"}
+	}
+	return c.Required
+}
+
+func (c HealthConfig) timeout() time.Duration {
+	if c.Timeout.Duration == 0 {
+		return defaultHealthTimeout
+	}
+	return c.Timeout.Duration
+}
+
+// backendReport is the outcome of checking a backend
+type backendReport struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+
+	// Breaker is the state of the circuit breaker of the backend, if it's enabled
+	Breaker string `json:"breaker,omitempty"`
+}
+
+func (b backendReport) ok() bool {
+	return b.Status == "OK"
+}
+
+// checkBackend sends PING to a backend using a connection of pool, giving up after
+// timeout. The connection is given up as well, so that a hung backend doesn't
+// hold connections of its pool.
+func checkBackend(pool *redis.Pool, timeout time.Duration) backendReport {
+	startTime := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := pool.GetContext(ctx)
+	if err == nil {
+		_, err = redis.String(doContext(ctx, conn, "PING"))
+		conn.Close()
+	}
+	if err == context.DeadlineExceeded {
+		err = fmt.Errorf("no reply to PING after %s", timeout)
+	}
+
+	report := backendReport{Status: "OK", LatencyMs: sinceInMs(startTime)}
+	if err != nil {
+		report.Status = "Error"
+		report.Error = err.Error()
+	}
+
+	return report
+}
+
+// checkBackends checks the "source" and "destination" backends of s concurrently
+func checkBackends(s *settings) map[string]backendReport {
+	pools := map[string]*redis.Pool{
+		"source":      s.sourcePool,
+		"destination": s.destinationPool,
+	}
+	timeout := s.config.Health.timeout()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	reports := make(map[string]backendReport, len(pools))
+	for name, pool := range pools {
+		wg.Add(1)
+		go func(name string, pool *redis.Pool) {
+			defer wg.Done()
+
+			report := checkBackend(pool, timeout)
+			report.Breaker = s.breakers()[name].currentState()
+			mu.Lock()
+			reports[name] = report
+			mu.Unlock()
+		}(name, pool)
+	}
+	wg.Wait()
+
+	return reports
+}
+
+// Liveness replies 200 as long as remiro is running, whatever the state of the backends
+func (r *redisHandler) Liveness(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "OK"})
+}
+
+// Readiness replies 200 if remiro can serve commands, that is if it isn't shutting
+// down and every backend required by the configuration answers PING, and 503
+// otherwise. The reports of the backends are written as JSON.
+func (r *redisHandler) Readiness(w http.ResponseWriter, req *http.Request) {
+	s := r.acquireSettings()
+	defer s.inUse.Done()
+
+	reports := checkBackends(s)
+
+	status := http.StatusOK
+	if r.activity.isDraining() {
+		status = http.StatusServiceUnavailable
+	}
+	for _, backend := range s.config.Health.required() {
+		if !reports[backend].ok() {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	writeJSON(w, status, reports)
+}
+
+// handlerStatus is the detailed status of remiro
+type handlerStatus struct {
+	Status    string                   `json:"status"`
+	Config    configStatus             `json:"config"`
+	Backends  map[string]backendReport `json:"backends"`
+	Pools     map[string]poolStatus    `json:"pools"`
+	Clients   clientsStatus            `json:"clients"`
+	Migration migrationStatus          `json:"migration"`
+	Degraded  *degradedStatus          `json:"degraded,omitempty"`
+}
+
+type configStatus struct {
+	Version  int       `json:"version"`
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
+type poolStatus struct {
+	Active         int     `json:"active"`
+	Idle           int     `json:"idle"`
+	WaitCount      int64   `json:"wait_count"`
+	WaitDurationMs float64 `json:"wait_duration_ms"`
+}
+
+type clientsStatus struct {
+	Connected int64 `json:"connected"`
+	Monitors  int32 `json:"monitors"`
+}
+
+// degradedStatus is reported while remiro is in degraded mode
+type degradedStatus struct {
+	Since       time.Time `json:"since"`
+	Queued      int       `json:"queued"`
+	QueuedBytes int64     `json:"queued_bytes"`
+	QueueFile   string    `json:"queue_file,omitempty"`
+}
+
+// migrationStatus is taken from the metrics, so it's empty if metrics aren't recorded
+type migrationStatus struct {
+	Lookups    map[string]int64 `json:"lookups"`
+	Copied     map[string]int64 `json:"copied"`
+	Deleted    map[string]int64 `json:"deleted"`
+	SourceKeys *int64           `json:"source_keys,omitempty"`
+}
+
+// Status writes the detailed status of remiro as JSON: the state of each backend,
+// the pool statistics, the progress of the migration, whether remiro is in degraded
+// mode, and the version of the configuration, which is incremented on every reload.
+func (r *redisHandler) Status(w http.ResponseWriter, req *http.Request) {
+	s := r.acquireSettings()
+	defer s.inUse.Done()
+
+	status := handlerStatus{
+		Status:   "OK",
+		Config:   configStatus{Version: s.version, LoadedAt: s.loadedAt},
+		Backends: checkBackends(s),
+		Pools:    make(map[string]poolStatus),
+		Clients: clientsStatus{
+			Connected: atomic.LoadInt64(&r.connectedClients),
+			Monitors:  atomic.LoadInt32(&r.monitors.count),
+		},
+		Migration: migrationStatus{
+			Lookups: viewCounts(migrationLookupView, keyRoute),
+			Copied:  viewCounts(migrationCopyView, keyOutcome),
+			Deleted: viewCounts(migrationDeleteView, keyOutcome),
+		},
+	}
+	if degraded := r.degraded.status(); !degraded.Since.IsZero() {
+		status.Status = "Degraded"
+		status.Degraded = &degraded
+	}
+	if r.activity.isDraining() {
+		status.Status = "Draining"
+	}
+
+	for name, pool := range s.pools() {
+		stats := pool.Stats()
+		status.Pools[name] = poolStatus{
+			Active:         stats.ActiveCount,
+			Idle:           stats.IdleCount,
+			WaitCount:      stats.WaitCount,
+			WaitDurationMs: float64(stats.WaitDuration.Nanoseconds()) / 1e6,
+		}
+	}
+
+	if rows, err := view.RetrieveData(sourceKeysView.Name); err == nil && len(rows) > 0 {
+		keys := int64(rows[0].Data.(*view.LastValueData).Value)
+		status.Migration.SourceKeys = &keys
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// viewCounts returns the counts of a view with a Count aggregation, by the value of key.
+// It's empty if the view isn't registered.
+func viewCounts(v *view.View, key tag.Key) map[string]int64 {
+	counts := make(map[string]int64)
+	rows, err := view.RetrieveData(v.Name)
+	if err != nil {
+		return counts
+	}
+
+	for _, row := range rows {
+		for _, rowTag := range row.Tags {
+			if rowTag.Key == key {
+				counts[rowTag.Value] += row.Data.(*view.CountData).Value
+			}
+		}
+	}
+
+	return counts
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error(err)
+	}
+}
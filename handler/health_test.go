@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_redisHandler_Readiness(t *testing.T) {
+	var tc = []struct {
+		name     string
+		required []string
+		status   int
+	}{
+		{"both backends required by default", nil, http.StatusServiceUnavailable},
+		{"only destination required", []string{"destination"}, http.StatusOK},
+		{"source required", []string{"source"}, http.StatusServiceUnavailable},
+		{"no backend required", []string{}, http.StatusOK},
+	}
+
+	t.Run(`[Given] "source" doesn't answer PING
+		    [When] readiness is checked
+		    [Then] report remiro as ready only if "source" isn't required`, func(t *testing.T) {
+
+		for _, tt := range tc {
+			handler, srcMock, dstMock := initHandlerMock()
+			handler.settings.config.Health.Required = tt.required
+			srcMock.Command("PING").ExpectError(errors.New("connection refused"))
+			dstMock.Command("PING").Expect("PONG")
+
+			w := httptest.NewRecorder()
+			handler.Readiness(w, httptest.NewRequest("GET", "/readyz", nil))
+
+			assert.Equal(t, tt.status, w.Code, tt.name)
+
+			var reports map[string]backendReport
+			if err := json.Unmarshal(w.Body.Bytes(), &reports); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "connection refused", reports["source"].Error, "%s: error of source should be reported", tt.name)
+			assert.Equal(t, "OK", reports["destination"].Status, "%s: destination should be reported as OK", tt.name)
+		}
+	})
+
+	t.Run(`[Given] remiro is shutting down
+		    [When] readiness is checked
+		    [Then] report remiro as not ready`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		srcMock.Command("PING").Expect("PONG")
+		dstMock.Command("PING").Expect("PONG")
+		handler.activity.drain()
+
+		w := httptest.NewRecorder()
+		handler.Readiness(w, httptest.NewRequest("GET", "/readyz", nil))
+
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	})
+}
+
+func Test_checkBackend(t *testing.T) {
+	t.Run(`[When] a backend is checked
+		   [Then] return the connection used to the pool`, func(t *testing.T) {
+
+		mock := redigomock.NewConn()
+		mock.Command("PING").Expect("PONG")
+		pool := &redis.Pool{MaxIdle: 1, Dial: func() (redis.Conn, error) { return contextConn{mock}, nil }}
+
+		report := checkBackend(pool, time.Second)
+
+		assert.True(t, report.ok(), "backend should be reported as OK")
+		assert.Equal(t, 1, pool.Stats().IdleCount, "connection should be back in the pool")
+	})
+
+	t.Run(`[Given] a backend which doesn't answer
+		    [When] the backend is checked
+		    [Then] report an error once the check times out
+		     [And] give up the connection used`, func(t *testing.T) {
+
+		mock := redigomock.NewConn()
+		mock.Command("PING").Expect("PONG")
+		pool := &redis.Pool{}
+		slowDial(pool, mock, time.Hour)
+
+		report := checkBackend(pool, 10*time.Millisecond)
+
+		assert.False(t, report.ok(), "backend should be reported as failing")
+		assert.Contains(t, report.Error, "no reply to PING", "timeout should be reported")
+		assert.Equal(t, 0, pool.Stats().ActiveCount, "connection should not be held anymore")
+	})
+}
+
+func Test_redisHandler_Status(t *testing.T) {
+	t.Run(`[Given] the configuration has been reloaded
+		    [When] the status is requested
+		    [Then] returns the status of remiro with the configuration version`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings = newSettings(handler.settings.config, handler.settings)
+		srcMock.Command("PING").Expect("PONG")
+		dstMock.Command("PING").Expect("PONG")
+
+		w := httptest.NewRecorder()
+		handler.Status(w, httptest.NewRequest("GET", "/status", nil))
+
+		var status handlerStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "OK", status.Status, "remiro should be reported as OK")
+		assert.Equal(t, 2, status.Config.Version, "configuration version should be incremented by the reload")
+		assert.Len(t, status.Backends, 2, "every backend should be reported")
+		assert.Contains(t, status.Pools, "destination_raw", "every pool should be reported")
+	})
+}
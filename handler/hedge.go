@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// HedgeConfig holds the configuration of hedged reads: GET reads a key from
+// "source" as well if "destination" is slow to reply, replying the first value
+// read. A value read from "source" may be stale, if the key has been written to
+// "destination" since it was migrated and is still in "source".
+type HedgeConfig struct {
+	// After is how long GET waits for "destination" before reading the key
+	// from "source" as well. GET isn't hedged if it's not set.
+	After duration
+}
+
+func (c HedgeConfig) validate(problems *ConfigError) {
+	if c.After.Duration < 0 {
+		problems.add("Hedge.After must not be negative")
+	}
+}
+
+// givenUpKey is the context key of the flag set once the read of a hedged GET is given up
+type givenUpKey struct{}
+
+// withGiveUp returns a context for a read of a hedged GET, along with the function
+// giving the read up, which cancels the context
+func withGiveUp(ctx context.Context) (context.Context, context.CancelFunc) {
+	flag := new(int32)
+	readCtx, cancel := context.WithCancel(context.WithValue(ctx, givenUpKey{}, flag))
+	return readCtx, func() {
+		if ctx.Err() == nil {
+			// Otherwise the read is canceled along with the command
+			atomic.StoreInt32(flag, 1)
+		}
+		cancel()
+	}
+}
+
+// givenUp tells whether err is the cancellation of a read given up by a hedged
+// GET, as the other backend replied first, which is no failure of its backend
+func givenUp(ctx context.Context, err error) bool {
+	if err != context.Canceled {
+		return false
+	}
+	flag, ok := ctx.Value(givenUpKey{}).(*int32)
+	return ok && atomic.LoadInt32(flag) == 1
+}
+
+// getResult is the outcome of a GET sent to a backend
+type getResult struct {
+	reply string
+	err   error
+}
+
+// hedgedGet is the outcome of reading a key from "destination", hedged by
+// reading it from "source" as well if "destination" was slow to reply
+type hedgedGet struct {
+	destination getResult
+
+	// source is the outcome of reading the key from "source", if it was read
+	source *getResult
+
+	// sourceFirst tells that "source" replied with a value first, the read
+	// from "destination" having been given up
+	sourceFirst bool
+}
+
+// getDestination reads a key from "destination". If it hasn't replied within
+// Hedge.After, the key is read from "source" concurrently, and the first value
+// read is kept, the value of "destination" being preferred if both are read by
+// then. Once "destination" fails or doesn't have the key, "source" is waited for.
+func (s *settings) getDestination(ctx context.Context, args []interface{}) hedgedGet {
+	after := s.config.Hedge.After.Duration
+	if after <= 0 {
+		reply, err := redis.String(s.doWithRetry(ctx, "destination", "GET", args...))
+		return hedgedGet{destination: getResult{reply, err}}
+	}
+
+	// The losing read may still be sent once the command is served, the buffer
+	// the arguments are read into having been reused meanwhile
+	args = copyArgs(args)
+
+	get := func(ctx context.Context, pool string) <-chan getResult {
+		result := make(chan getResult, 1)
+		go func() {
+			reply, err := redis.String(s.doWithRetry(ctx, pool, "GET", args...))
+			result <- getResult{reply, err}
+		}()
+		return result
+	}
+
+	dstCtx, cancelDst := withGiveUp(ctx)
+	defer cancelDst()
+	dstResult := get(dstCtx, "destination")
+
+	timer := time.NewTimer(after)
+	defer timer.Stop()
+	select {
+	case dst := <-dstResult:
+		return hedgedGet{destination: dst}
+	case <-timer.C:
+	}
+
+	srcCtx, cancelSrc := withGiveUp(ctx)
+	defer cancelSrc()
+	srcResult := get(srcCtx, "source")
+
+	var dst getResult
+	var src getResult
+	select {
+	case dst = <-dstResult:
+		if dst.err == nil {
+			go recordHedge("destination")
+			return hedgedGet{destination: dst}
+		}
+		src = <-srcResult
+
+	case src = <-srcResult:
+		if src.err == nil {
+			select {
+			case dst = <-dstResult:
+				if dst.err == nil {
+					go recordHedge("destination")
+					return hedgedGet{destination: dst}
+				}
+			default:
+				// The read from "destination" is given up, its connection being
+				// returned to the pool once the cancellation is noticed
+				go recordHedge("source")
+				return hedgedGet{source: &src, sourceFirst: true}
+			}
+		} else {
+			dst = <-dstResult
+			if dst.err == nil {
+				go recordHedge("destination")
+				return hedgedGet{destination: dst}
+			}
+		}
+	}
+
+	go recordHedge("source")
+	return hedgedGet{destination: dst, source: &src}
+}
+
+// copyArgs returns a copy of args, copying the ones which are byte slices
+func copyArgs(args []interface{}) []interface{} {
+	copied := make([]interface{}, len(args))
+	for i, arg := range args {
+		if b, ok := arg.([]byte); ok {
+			arg = append([]byte(nil), b...)
+		}
+		copied[i] = arg
+	}
+	return copied
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/stats/view"
+)
+
+func Test_redisHandler_HandleGET_hedge(t *testing.T) {
+	t.Run(`[Given] hedging after 10ms and "destination" taking 1s to reply
+		    [When] a GET request is received
+		    [Then] reply the value read from "source" without migrating it`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings.config.Hedge = HedgeConfig{After: duration{10 * time.Millisecond}}
+		slowDial(handler.settings.destinationPool, dstMock, time.Second)
+
+		dstMock.Command("GET", []byte("mykey")).Expect([]byte("newvalue"))
+		srcCmd := srcMock.Command("GET", []byte("mykey")).Expect([]byte("myvalue"))
+		setCmd := dstMock.Command("SET", []byte("mykey"), "myvalue").Expect("OK")
+
+		start := time.Now()
+		reply := serveRequest(t, handler, "*2\r\n$3\r\nGET\r\n$5\r\nmykey\r\n")
+
+		assert.Equal(t, "$7\r\nmyvalue\r\n", reply)
+		assert.True(t, time.Since(start) < time.Second, "destination should not be waited for")
+		assert.True(t, srcCmd.Called, "source should be read")
+		assert.False(t, setCmd.Called, "key read by a hedged read should not be migrated")
+	})
+
+	t.Run(`[Given] hedging after 1s and "destination" replying right away
+		    [When] a GET request is received
+		    [Then] reply the value of "destination" without reading "source"`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings.config.Hedge = HedgeConfig{After: duration{time.Second}}
+
+		dstMock.Command("GET", []byte("mykey")).Expect([]byte("newvalue"))
+		srcCmd := srcMock.Command("GET", []byte("mykey")).Expect([]byte("myvalue"))
+
+		reply := serveRequest(t, handler, "*2\r\n$3\r\nGET\r\n$5\r\nmykey\r\n")
+
+		assert.Equal(t, "$8\r\nnewvalue\r\n", reply)
+		assert.False(t, srcCmd.Called, "source should not be read")
+	})
+
+	t.Run(`[Given] hedging after 10ms, "destination" taking 50ms to reply it doesn't have the key and "source" 100ms
+		    [When] a GET request is received
+		    [Then] reply the value read from "source" by the hedged read, reading it once
+		     [And] migrate the key`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings.config.Hedge = HedgeConfig{After: duration{10 * time.Millisecond}}
+		slowDial(handler.settings.destinationPool, dstMock, 50*time.Millisecond)
+		slowDial(handler.settings.sourcePool, srcMock, 100*time.Millisecond)
+
+		dstMock.Command("GET", []byte("mykey")).Expect(nil)
+		srcCmd := srcMock.Command("GET", []byte("mykey")).Expect([]byte("myvalue"))
+		setCmd := dstMock.Command("SET", []byte("mykey"), "myvalue").Expect("OK")
+
+		reply := serveRequest(t, handler, "*2\r\n$3\r\nGET\r\n$5\r\nmykey\r\n")
+
+		assert.Equal(t, "$7\r\nmyvalue\r\n", reply)
+		assert.Equal(t, 1, srcMock.Stats(srcCmd), "source should be read once")
+		assert.True(t, setCmd.Called, "key should be copied to destination")
+	})
+}
+
+func Test_redisHandler_HandleGET_hedgeGivenUp(t *testing.T) {
+	if err := view.Register(errorCountView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(errorCountView)
+
+	t.Run(`[Given] hedging after 10ms and "destination" taking 1s to reply
+		    [When] a GET request is received, "source" replying first
+		    [Then] don't count the read given up from "destination" as an error`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings.config.Hedge = HedgeConfig{After: duration{10 * time.Millisecond}}
+		slowDial(handler.settings.destinationPool, dstMock, time.Second)
+
+		dstMock.Command("GET", []byte("mykey")).Expect([]byte("newvalue"))
+		srcMock.Command("GET", []byte("mykey")).Expect([]byte("myvalue"))
+
+		reply := serveRequest(t, handler, "*2\r\n$3\r\nGET\r\n$5\r\nmykey\r\n")
+		assert.Equal(t, "$7\r\nmyvalue\r\n", reply)
+
+		// The read is given up once its connection is back to the pool
+		assert.Eventually(t, func() bool { return handler.settings.destinationPool.ActiveCount() == 0 },
+			time.Second, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		assert.Zero(t, countByTag(t, errorCountView.Name, keyClass)[errorClassCanceled],
+			"read given up should not be counted as an error")
+	})
+}
+
+func Test_givenUp(t *testing.T) {
+	t.Run(`[When] the read of a hedged GET is canceled
+		   [Then] tell whether it's been given up, rather than canceled along with the command`, func(t *testing.T) {
+
+		ctx, giveUp := withGiveUp(context.Background())
+		assert.False(t, givenUp(ctx, context.Canceled), "read should not be given up yet")
+		giveUp()
+		assert.True(t, givenUp(ctx, ctx.Err()))
+
+		parent, cancel := context.WithCancel(context.Background())
+		ctx, giveUp = withGiveUp(parent)
+		cancel()
+		giveUp()
+		assert.False(t, givenUp(ctx, ctx.Err()), "read canceled along with the command should not be given up")
+	})
+}
+
+func TestHedgeConfig_validate(t *testing.T) {
+	t.Run(`[When] a hedging configuration is validated
+		   [Then] returns error if the threshold is negative`, func(t *testing.T) {
+
+		problems := &ConfigError{}
+		HedgeConfig{After: duration{-time.Millisecond}}.validate(problems)
+
+		assert.Len(t, problems.Problems, 1)
+	})
+}
+
+// slowDial makes the connections of pool dial mock, which replies after delay
+// unless the context of the command is done first
+func slowDial(pool *redis.Pool, mock *redigomock.Conn, delay time.Duration) {
+	pool.Dial = func() (redis.Conn, error) {
+		return slowConn{contextConn{mock}, delay}, nil
+	}
+}
+
+type slowConn struct {
+	contextConn
+	delay time.Duration
+}
+
+func (c slowConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(c.delay):
+	}
+	return c.contextConn.DoContext(ctx, cmd, args...)
+}
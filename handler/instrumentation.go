@@ -2,8 +2,14 @@ package handler
 
 import (
 	"context"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
@@ -13,15 +19,120 @@ var (
 	// reqLatencyMs records the time it took for request to be served
 	reqLatencyMs = stats.Float64("request/latency", "Request serving latency", "ms")
 
+	// backendLatencyMs records the round-trip time of requests towards backing redis server
+	backendLatencyMs = stats.Float64("backend/latency", "Backing Redis request latency", "ms")
+
 	// redisCmdCount records the count of any request towards backing redis server
 	redisCmdCount = stats.Int64("cmd/count", "Redis request count", "requests")
 
+	// configReloadCount records the count of configuration reload attempts
+	configReloadCount = stats.Int64("config/reload/count", "Configuration reload count", "reloads")
+
+	// migrationLookupCount records the count of key lookups, by where the key was found
+	migrationLookupCount = stats.Int64("migration/lookup/count", "Key lookup count", "lookups")
+
+	// migrationCopyCount records the count of keys copied from "source" to "destination"
+	migrationCopyCount = stats.Int64("migration/copy/count", "Key copy count", "keys")
+
+	// migrationDeleteCount records the count of keys deleted from "source"
+	migrationDeleteCount = stats.Int64("migration/delete/count", "Source key deletion count", "keys")
+
+	// migrationBytes records the size of values copied from "source" to "destination"
+	migrationBytes = stats.Int64("migration/bytes", "Bytes migrated", stats.UnitBytes)
+
+	// sourceKeys records the number of keys in "source", as reported by DBSIZE
+	sourceKeys = stats.Int64("migration/source/keys", "Keys remaining in source", "keys")
+
+	// poolActiveConns records the number of connections of a pool, idle or in use
+	poolActiveConns = stats.Int64("pool/active", "Pool connections", "connections")
+
+	// poolIdleConns records the number of idle connections of a pool
+	poolIdleConns = stats.Int64("pool/idle", "Pool idle connections", "connections")
+
+	// poolWaitCount records the total number of times a pool connection has been waited for
+	poolWaitCount = stats.Int64("pool/wait/count", "Pool connection waits", "waits")
+
+	// poolWaitDurationMs records the total time spent waiting for a pool connection
+	poolWaitDurationMs = stats.Float64("pool/wait/duration", "Pool connection wait duration", "ms")
+
+	// clientConnCount records the count of client connections accepted or closed
+	clientConnCount = stats.Int64("client/connection/count", "Client connection count", "connections")
+
+	// clientConnected records the number of connected clients
+	clientConnected = stats.Int64("client/connected", "Connected clients", "clients")
+
+	// clientCmdCount records the count of commands received from clients
+	clientCmdCount = stats.Int64("client/command/count", "Client command count", "commands")
+
+	// errorCount records the count of errors, by cause
+	errorCount = stats.Int64("error/count", "Error count", "errors")
+
+	// breakerState records the state of the circuit breaker of a backend, see breakerStateValues
+	breakerState = stats.Int64("breaker/state", "Circuit breaker state", "state")
+
+	// breakerTransitionCount records the count of circuit breaker state changes
+	breakerTransitionCount = stats.Int64("breaker/transition/count", "Circuit breaker transition count", "transitions")
+
+	// retryCount records the count of commands retried
+	retryCount = stats.Int64("retry/count", "Retry count", "retries")
+
+	// hedgeCount records the count of hedged GET, by the backend whose reply was used
+	hedgeCount = stats.Int64("hedge/count", "Hedged read count", "reads")
+
+	// clientRejectedCount records the count of client connections refused
+	clientRejectedCount = stats.Int64("client/rejected/count", "Rejected client connection count", "connections")
+
+	// rateLimitedCount records the count of commands rejected by a rate limit
+	rateLimitedCount = stats.Int64("ratelimit/rejected/count", "Rate limited command count", "commands")
+
+	// degradedActive records whether remiro is in degraded mode, 1 if it is and 0 otherwise
+	degradedActive = stats.Int64("degraded/active", "Degraded mode", "state")
+
+	// degradedQueued records the number of writes queued in degraded mode
+	degradedQueueLength = stats.Int64("degraded/queued", "Queued writes", "writes")
+
+	// degradedQueueBytes records the size of the writes queued in degraded mode
+	degradedQueueBytes = stats.Int64("degraded/queued/bytes", "Queued writes size", "bytes")
+
+	// degradedWriteCount records the count of writes received in degraded mode, by what became of them
+	degradedWriteCount = stats.Int64("degraded/write/count", "Degraded mode write count", "writes")
+
 	// keyTarget tag the backing Redis target in a request
 	keyTarget, _ = tag.NewKey("target")
 
 	// keyCommand tag the command sent to a backing Redis
 	keyCommand, _ = tag.NewKey("command")
 
+	// keyOutcome tag the outcome of an operation, either "success" or "failure"
+	keyOutcome, _ = tag.NewKey("outcome")
+
+	// keyRoute tag where a command has been served from, see the route* constants
+	keyRoute, _ = tag.NewKey("route")
+
+	// keyPool tag the connection pool, see settings.pools()
+	keyPool, _ = tag.NewKey("pool")
+
+	// keyEvent tag a client connection event, either "accepted" or "closed"
+	keyEvent, _ = tag.NewKey("event")
+
+	// keyClient tag the IP address of a client
+	keyClient, _ = tag.NewKey("client")
+
+	// keyAction tag what became of a write in degraded mode, see the degraded* constants
+	keyAction, _ = tag.NewKey("action")
+
+	// keyState tag the state of a circuit breaker, see the breaker* constants
+	keyState, _ = tag.NewKey("state")
+
+	// keyClass tag the cause of an error, see the errorClass* constants
+	keyClass, _ = tag.NewKey("class")
+
+	// keyReason tag why a client connection has been refused, see the rejected* constants
+	keyReason, _ = tag.NewKey("reason")
+
+	// keyLimit tag the rate limit a command has been rejected by, see rateLimitClient
+	keyLimit, _ = tag.NewKey("limit")
+
 	// cmdCountView provides view for Redis command count
 	cmdCountView = &view.View{
 		Name:        "command/count",
@@ -31,25 +142,600 @@ var (
 		TagKeys:     []tag.Key{keyTarget, keyCommand},
 	}
 
-	// reqLatencyView provides view for request latency
+	// reqLatencyView provides view for request latency, by command and whether
+	// the reply is an error ("failure") or not ("success")
 	reqLatencyView = &view.View{
 		Name:        "request/latency",
 		Measure:     reqLatencyMs,
 		Description: "The latency distribution of requests",
+		Aggregation: view.Distribution(defaultLatencyBuckets...),
+		TagKeys:     []tag.Key{keyCommand, keyOutcome},
+	}
+
+	// backendLatencyView provides view for the latency of requests to Redis instances
+	backendLatencyView = &view.View{
+		Name:        "backend/latency",
+		Measure:     backendLatencyMs,
+		Description: "The latency distribution of outbound requests to Redis instances",
+		Aggregation: view.Distribution(defaultLatencyBuckets...),
+		TagKeys:     []tag.Key{keyTarget, keyCommand},
+	}
 
-		// Latency in buckets:
-		// [>=0ms, >=10ms, >=25ms, >=50ms, >=75ms, >=100ms, >=150ms >=200ms]
-		Aggregation: view.Distribution(0, 10, 25, 50, 75, 100, 150, 200),
+	// configReloadView provides view for configuration reload count
+	configReloadView = &view.View{
+		Name:        "config/reload/count",
+		Measure:     configReloadCount,
+		Description: "The count of configuration reloads",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyOutcome},
+	}
+
+	// migrationLookupView provides view for key lookups. The ratio of lookups
+	// served by "destination" tells how far the migration has progressed.
+	migrationLookupView = &view.View{
+		Name:        "migration/lookup/count",
+		Measure:     migrationLookupCount,
+		Description: "The count of key lookups, by where the key was found",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyCommand, keyRoute},
+	}
+
+	// migrationCopyView provides view for keys copied to "destination"
+	migrationCopyView = &view.View{
+		Name:        "migration/copy/count",
+		Measure:     migrationCopyCount,
+		Description: "The count of keys copied from source to destination",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyCommand, keyRoute, keyOutcome},
 	}
 
-	views = []*view.View{cmdCountView, reqLatencyView}
+	// migrationDeleteView provides view for keys deleted from "source"
+	migrationDeleteView = &view.View{
+		Name:        "migration/delete/count",
+		Measure:     migrationDeleteCount,
+		Description: "The count of keys deleted from source",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyCommand, keyRoute, keyOutcome},
+	}
+
+	// migrationBytesView provides view for the total size of migrated values
+	migrationBytesView = &view.View{
+		Name:        "migration/bytes",
+		Measure:     migrationBytes,
+		Description: "The total size of values copied from source to destination",
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{keyCommand, keyRoute},
+	}
+
+	// sourceKeysView provides view for the number of keys remaining in "source"
+	sourceKeysView = &view.View{
+		Name:        "migration/source/keys",
+		Measure:     sourceKeys,
+		Description: "The estimated number of keys remaining in source",
+		Aggregation: view.LastValue(),
+	}
+
+	// poolActiveView provides view for the number of connections of each pool
+	poolActiveView = &view.View{
+		Name:        "pool/active",
+		Measure:     poolActiveConns,
+		Description: "The number of connections of a pool, idle or in use",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{keyPool},
+	}
+
+	// poolIdleView provides view for the number of idle connections of each pool
+	poolIdleView = &view.View{
+		Name:        "pool/idle",
+		Measure:     poolIdleConns,
+		Description: "The number of idle connections of a pool",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{keyPool},
+	}
+
+	// poolWaitCountView provides view for the number of waits for pool connections
+	poolWaitCountView = &view.View{
+		Name:        "pool/wait/count",
+		Measure:     poolWaitCount,
+		Description: "The total number of times a connection of a pool has been waited for",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{keyPool},
+	}
+
+	// poolWaitDurationView provides view for the time spent waiting for pool connections
+	poolWaitDurationView = &view.View{
+		Name:        "pool/wait/duration",
+		Measure:     poolWaitDurationMs,
+		Description: "The total time spent waiting for a connection of a pool",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{keyPool},
+	}
+
+	// clientConnCountView provides view for client connections accepted and closed,
+	// connections closed for being idle being counted as "timed_out" as well
+	clientConnCountView = &view.View{
+		Name:        "client/connection/count",
+		Measure:     clientConnCount,
+		Description: "The count of client connections accepted or closed",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyEvent},
+	}
+
+	// clientConnectedView provides view for the number of connected clients
+	clientConnectedView = &view.View{
+		Name:        "client/connected",
+		Measure:     clientConnected,
+		Description: "The number of connected clients",
+		Aggregation: view.LastValue(),
+	}
+
+	// clientCmdCountView provides view for commands received, by client IP address.
+	// It's only recorded if Clients.CountCommands is set, see recordClientCommand.
+	clientCmdCountView = &view.View{
+		Name:        "client/command/count",
+		Measure:     clientCmdCount,
+		Description: "The count of commands received from each client",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyClient},
+	}
+
+	// errorCountView provides view for errors, by target, command and cause
+	errorCountView = &view.View{
+		Name:        "error/count",
+		Measure:     errorCount,
+		Description: "The count of errors, by cause",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyTarget, keyCommand, keyClass},
+	}
+
+	// breakerStateView provides view for the state of the circuit breaker of each backend:
+	// 0 if it's closed, 1 if it's half-open and 2 if it's open
+	breakerStateView = &view.View{
+		Name:        "breaker/state",
+		Measure:     breakerState,
+		Description: "The state of the circuit breaker of each backend",
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{keyTarget},
+	}
+
+	// breakerTransitionView provides view for circuit breaker state changes, by the new state
+	breakerTransitionView = &view.View{
+		Name:        "breaker/transition/count",
+		Measure:     breakerTransitionCount,
+		Description: "The count of circuit breaker state changes",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyTarget, keyState},
+	}
+
+	// retryCountView provides view for retries, by target, command and whether
+	// the retry succeeded ("success") or not ("failure")
+	retryCountView = &view.View{
+		Name:        "retry/count",
+		Measure:     retryCount,
+		Description: "The count of commands retried",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyTarget, keyCommand, keyOutcome},
+	}
+
+	// hedgeCountView provides view for hedged reads, by the target whose reply was used
+	hedgeCountView = &view.View{
+		Name:        "hedge/count",
+		Measure:     hedgeCount,
+		Description: "The count of GET hedged by reading source as well",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyTarget},
+	}
+
+	// clientRejectedCountView provides view for client connections refused, by reason
+	clientRejectedCountView = &view.View{
+		Name:        "client/rejected/count",
+		Measure:     clientRejectedCount,
+		Description: "The count of client connections refused",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyReason},
+	}
+
+	// rateLimitedCountView provides view for commands rejected by a rate limit,
+	// by command and limit: "client", "user" or "source"
+	rateLimitedCountView = &view.View{
+		Name:        "ratelimit/rejected/count",
+		Measure:     rateLimitedCount,
+		Description: "The count of commands rejected by a rate limit",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyCommand, keyLimit},
+	}
+
+	// degradedActiveView provides view for whether remiro is in degraded mode
+	degradedActiveView = &view.View{
+		Name:        "degraded/active",
+		Measure:     degradedActive,
+		Description: "Whether remiro is in degraded mode: 1 if it is, 0 otherwise",
+		Aggregation: view.LastValue(),
+	}
+
+	// degradedQueuedView provides view for the number of writes queued in degraded mode
+	degradedQueuedView = &view.View{
+		Name:        "degraded/queued",
+		Measure:     degradedQueueLength,
+		Description: "The number of writes queued to be replayed to destination",
+		Aggregation: view.LastValue(),
+	}
+
+	// degradedQueueBytesView provides view for the size of the writes queued in degraded mode
+	degradedQueueBytesView = &view.View{
+		Name:        "degraded/queued/bytes",
+		Measure:     degradedQueueBytes,
+		Description: "The size of the writes queued to be replayed to destination, encoded in RESP",
+		Aggregation: view.LastValue(),
+	}
+
+	// degradedWriteCountView provides view for writes in degraded mode, by command and action
+	degradedWriteCountView = &view.View{
+		Name:        "degraded/write/count",
+		Measure:     degradedWriteCount,
+		Description: "The count of writes received in degraded mode, and of queued writes replayed",
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{keyCommand, keyAction},
+	}
+
+	views = []*view.View{
+		cmdCountView, reqLatencyView, backendLatencyView, configReloadView,
+		migrationLookupView, migrationCopyView, migrationDeleteView, migrationBytesView, sourceKeysView,
+		poolActiveView, poolIdleView, poolWaitCountView, poolWaitDurationView,
+		clientConnCountView, clientConnectedView, clientCmdCountView, clientRejectedCountView,
+		errorCountView, breakerStateView, breakerTransitionView, retryCountView, hedgeCountView, rateLimitedCountView,
+		degradedActiveView, degradedQueuedView, degradedQueueBytesView, degradedWriteCountView,
+	}
 )
 
+// Routes a command can be served from
+const (
+	routeDestination = "destination"
+	routeSource      = "source"
+	routeNone        = "none"
+
+	// routeFallback is "source" being read from while "destination" is unavailable
+	routeFallback = "fallback"
+
+	// routeQueue is a write queued to be replayed to "destination" once it's back
+	routeQueue = "queue"
+
+	// routeHedge is "source" being read from while "destination" is slow to reply
+	routeHedge = "hedge"
+)
+
+// Causes of errors
+const (
+	errorClassNetwork        = "network"
+	errorClassTimeout        = "timeout"
+	errorClassRedis          = "redis_error"
+	errorClassAuth           = "auth"
+	errorClassUnknownCommand = "unknown_command"
+	errorClassMigration      = "migration"
+	errorClassUnavailable    = "unavailable"
+	errorClassCanceled       = "canceled"
+	errorClassPoolExhausted  = "pool_exhausted"
+	errorClassRateLimited    = "rate_limited"
+	errorClassUnknown        = "unknown"
+)
+
+// targetRemiro is the target of errors which happen in remiro itself
+// rather than in a backing Redis, such as a client failing to authenticate
+const targetRemiro = "remiro"
+
+// Client connection events
+const (
+	clientAccepted = "accepted"
+	clientClosed   = "closed"
+
+	// clientTimedOut is a connection closed for being idle, see ClientsConfig.Timeout
+	clientTimedOut = "timed_out"
+)
+
+// What becomes of writes in degraded mode
+const (
+	degradedRejected = "rejected"
+	degradedSource   = "source"
+	degradedQueued   = "queued"
+	degradedReplayed = "replayed"
+	degradedDropped  = "dropped"
+)
+
+// defaultStatsInterval is used when RedisConfig.StatsInterval is not set
+const defaultStatsInterval = 15 * time.Second
+
+// defaultLatencyBuckets are the latency distribution bucket boundaries, in
+// milliseconds, used when RedisConfig.LatencyBuckets is not set
+var defaultLatencyBuckets = []float64{
+	0, 0.5, 1, 2, 5, 10, 25, 50, 75, 100, 150, 200, 300, 500, 1000, 2500, 5000,
+}
+
+// instrumentedHandler is implemented by handlers whose instrumentation
+// depends on their configuration.
+type instrumentedHandler interface {
+	// collectStats periodically records the metrics which are sampled
+	// rather than recorded as events happen
+	collectStats()
+
+	// latencyBuckets returns the latency distribution bucket boundaries
+	latencyBuckets() []float64
+}
+
+// configureViews applies the configuration of handler to the views, if any
+func configureViews(handler Handler) {
+	instrumented, ok := handler.(instrumentedHandler)
+	if !ok {
+		return
+	}
+
+	if buckets := instrumented.latencyBuckets(); len(buckets) > 0 {
+		reqLatencyView.Aggregation = view.Distribution(buckets...)
+		backendLatencyView.Aggregation = view.Distribution(buckets...)
+	}
+}
+
+// latencyBuckets returns the latency buckets of the configuration the handler has
+// been created with. Buckets can't be changed afterwards, as views are registered once.
+func (r *redisHandler) latencyBuckets() []float64 {
+	s := r.acquireSettings()
+	defer s.inUse.Done()
+
+	return s.config.LatencyBuckets
+}
+
+// collectStats samples the handler metrics every RedisConfig.StatsInterval
+// until the handler is shut down.
+func (r *redisHandler) collectStats() {
+	for {
+		s := r.acquireSettings()
+		interval := s.config.StatsInterval.Duration
+		recordSourceKeys(s)
+		recordPoolStats(s.pools())
+		recordBreakerStates(s.breakers())
+		s.inUse.Done()
+
+		recordDegradedStatus(r.degraded.status())
+
+		stats.Record(context.Background(), clientConnected.M(atomic.LoadInt64(&r.connectedClients)))
+
+		if interval <= 0 {
+			interval = defaultStatsInterval
+		}
+		select {
+		case <-r.activity.done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// recordSourceKeys samples the number of keys in "source" with DBSIZE, which is
+// subject to its breaker and rate limit like any other command sent to it
+func recordSourceKeys(s *settings) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.backgroundTimeout())
+	defer cancel()
+
+	conn := s.getConn(ctx, "source")
+	defer conn.Close()
+
+	n, err := redis.Int64(s.do(ctx, conn, "source", "DBSIZE"))
+	if err != nil {
+		log.WithField("context", "Sampling source keys").Warn(err)
+		return
+	}
+
+	stats.Record(context.Background(), sourceKeys.M(n))
+}
+
+func recordPoolStats(pools map[string]*redis.Pool) {
+	for name, pool := range pools {
+		poolStats := pool.Stats()
+		ctx, _ := tag.New(context.Background(), tag.Insert(keyPool, name))
+		stats.Record(ctx,
+			poolActiveConns.M(int64(poolStats.ActiveCount)),
+			poolIdleConns.M(int64(poolStats.IdleCount)),
+			poolWaitCount.M(poolStats.WaitCount),
+			poolWaitDurationMs.M(float64(poolStats.WaitDuration.Nanoseconds())/1e6))
+	}
+}
+
+// recordBreakerStates records the state of every breaker which isn't disabled
+func recordBreakerStates(breakers map[string]*breaker) {
+	for target, b := range breakers {
+		if state := b.currentState(); state != "" {
+			ctx, _ := tag.New(context.Background(), tag.Insert(keyTarget, target))
+			stats.Record(ctx, breakerState.M(breakerStateValues[state]))
+		}
+	}
+}
+
+func recordBreakerTransition(target, state string) {
+	ctx, _ := tag.New(context.Background(), tag.Insert(keyTarget, target))
+	stats.Record(ctx, breakerState.M(breakerStateValues[state]))
+
+	transitionCtx, _ := tag.New(ctx, tag.Insert(keyState, state))
+	stats.Record(transitionCtx, breakerTransitionCount.M(1))
+}
+
+// recordDegraded records remiro entering or leaving degraded mode
+func recordDegraded(active bool) {
+	var value int64
+	if active {
+		value = 1
+	}
+	stats.Record(context.Background(), degradedActive.M(value))
+}
+
+func recordDegradedStatus(status degradedStatus) {
+	recordDegraded(!status.Since.IsZero())
+	stats.Record(context.Background(),
+		degradedQueueLength.M(int64(status.Queued)), degradedQueueBytes.M(status.QueuedBytes))
+}
+
+// recordDegradedWrite records what became of a write received in degraded mode, see the degraded* constants
+func recordDegradedWrite(command, action string) {
+	ctx, _ := tag.New(context.Background(), tag.Insert(keyCommand, commandTag(command)), tag.Insert(keyAction, action))
+	stats.Record(ctx, degradedWriteCount.M(1))
+}
+
+// degradedActionOf returns what became of a queued write replayed with err
+func degradedActionOf(err error) string {
+	if err != nil {
+		return degradedDropped
+	}
+	return degradedReplayed
+}
+
+// recordRetry records a command sent to target again after failing, along with the outcome of the retry
+func recordRetry(target, command string, success bool) {
+	ctx, _ := tag.New(context.Background(),
+		tag.Insert(keyTarget, target), tag.Insert(keyCommand, commandTag(command)), tag.Insert(keyOutcome, outcomeOf(success)))
+	stats.Record(ctx, retryCount.M(1))
+}
+
+// recordHedge records a hedged GET, target being the backend whose reply was used
+func recordHedge(target string) {
+	ctx, _ := tag.New(context.Background(), tag.Insert(keyTarget, target))
+	stats.Record(ctx, hedgeCount.M(1))
+}
+
+// recordRateLimited records a command rejected by limit, see rateLimitClient
+func recordRateLimited(command, limit string) {
+	ctx, _ := tag.New(context.Background(), tag.Insert(keyCommand, commandTag(command)), tag.Insert(keyLimit, limit))
+	stats.Record(ctx, rateLimitedCount.M(1))
+}
+
 func sinceInMs(startTime time.Time) float64 {
 	return float64(time.Since(startTime).Nanoseconds()) / 1e6
 }
 
-func recordRedisCmd(target, command string) {
-	ctx, _ := tag.New(context.Background(), tag.Insert(keyTarget, target), tag.Insert(keyCommand, command))
-	stats.Record(ctx, redisCmdCount.M(1))
+func recordRedisCmd(target, command string, latencyMs float64) {
+	ctx, _ := tag.New(context.Background(), tag.Insert(keyTarget, target), tag.Insert(keyCommand, commandTag(command)))
+	stats.Record(ctx, redisCmdCount.M(1), backendLatencyMs.M(latencyMs))
+}
+
+func recordRequest(command string, success bool, latencyMs float64) {
+	ctx, _ := tag.New(context.Background(),
+		tag.Insert(keyCommand, commandTag(command)), tag.Insert(keyOutcome, outcomeOf(success)))
+	stats.Record(ctx, reqLatencyMs.M(latencyMs))
+}
+
+// commandTag returns command as a tag value. As commands are sent by clients,
+// anything which doesn't look like a command name is tagged as "UNKNOWN" to
+// keep the number of tag values bounded.
+func commandTag(command string) string {
+	if len(command) == 0 || len(command) > 32 {
+		return "UNKNOWN"
+	}
+	for _, c := range command {
+		if (c < 'A' || c > 'Z') && c != '_' && c != '-' && c != '|' {
+			return "UNKNOWN"
+		}
+	}
+
+	return command
+}
+
+func recordConfigReload(success bool) {
+	ctx, _ := tag.New(context.Background(), tag.Insert(keyOutcome, outcomeOf(success)))
+	stats.Record(ctx, configReloadCount.M(1))
+}
+
+func recordLookup(command, route string) {
+	ctx, _ := tag.New(context.Background(), tag.Insert(keyCommand, command), tag.Insert(keyRoute, route))
+	stats.Record(ctx, migrationLookupCount.M(1))
+}
+
+// recordCopy records a copy of a key from "source" to "destination", along
+// with the size of its value if the copy succeeded.
+func recordCopy(command string, success bool, size int) {
+	ctx, _ := tag.New(context.Background(), tag.Insert(keyCommand, command), tag.Insert(keyRoute, routeSource))
+	copyCtx, _ := tag.New(ctx, tag.Insert(keyOutcome, outcomeOf(success)))
+	stats.Record(copyCtx, migrationCopyCount.M(1))
+	if success {
+		stats.Record(ctx, migrationBytes.M(int64(size)))
+	}
+}
+
+func recordDeletion(command, route string, success bool) {
+	ctx, _ := tag.New(context.Background(),
+		tag.Insert(keyCommand, command), tag.Insert(keyRoute, route), tag.Insert(keyOutcome, outcomeOf(success)))
+	stats.Record(ctx, migrationDeleteCount.M(1))
+}
+
+func outcomeOf(success bool) string {
+	if success {
+		return "success"
+	}
+	return "failure"
+}
+
+func recordClientConn(event string) {
+	ctx, _ := tag.New(context.Background(), tag.Insert(keyEvent, event))
+	stats.Record(ctx, clientConnCount.M(1))
+}
+
+// recordClientRejected records a client connection refused for reason, see the rejected* constants
+func recordClientRejected(reason string) {
+	ctx, _ := tag.New(context.Background(), tag.Insert(keyReason, reason))
+	stats.Record(ctx, clientRejectedCount.M(1))
+}
+
+// recordClientCommand records a command received from the client at addr.
+// Clients are told apart by IP address only, as ports change on every connection.
+func recordClientCommand(addr string) {
+	ctx, _ := tag.New(context.Background(), tag.Insert(keyClient, clientIP(addr)))
+	stats.Record(ctx, clientCmdCount.M(1))
+}
+
+func recordError(target, command, class string) {
+	ctx, _ := tag.New(context.Background(),
+		tag.Insert(keyTarget, target), tag.Insert(keyCommand, commandTag(command)), tag.Insert(keyClass, class))
+	stats.Record(ctx, errorCount.M(1))
+}
+
+// classifyError returns the cause of err, an error returned by a redis.Conn
+func classifyError(err error) string {
+	if isUnavailable(err) {
+		return errorClassUnavailable
+	}
+	if err == context.DeadlineExceeded {
+		return errorClassTimeout
+	}
+	if err == context.Canceled {
+		return errorClassCanceled
+	}
+	if redisErr, ok := err.(redis.Error); ok {
+		return classifyErrorReply(string(redisErr))
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return errorClassTimeout
+	}
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errorClassNetwork
+	}
+	if poolExhausted(err) {
+		return errorClassPoolExhausted
+	}
+	if isRateLimited(err) {
+		return errorClassRateLimited
+	}
+	if err == errProtocol {
+		return errorClassNetwork
+	}
+
+	return errorClassUnknown
+}
+
+// classifyErrorReply returns the cause of an error reply sent by Redis
+func classifyErrorReply(msg string) string {
+	switch {
+	case strings.HasPrefix(msg, "NOAUTH"), strings.HasPrefix(msg, "WRONGPASS"),
+		strings.HasPrefix(msg, "ERR invalid password"), strings.HasPrefix(msg, "NOPERM"):
+		return errorClassAuth
+	case strings.HasPrefix(msg, "ERR unknown command"):
+		return errorClassUnknownCommand
+	default:
+		return errorClassRedis
+	}
 }
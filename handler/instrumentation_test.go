@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func Test_recordCopy(t *testing.T) {
+	if err := view.Register(migrationCopyView, migrationBytesView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(migrationCopyView, migrationBytesView)
+
+	t.Run(`[When] copies of keys are recorded
+		   [Then] count copies by outcome
+		    [And] sum the size of successfully copied values`, func(t *testing.T) {
+
+		recordCopy("GET", true, 5)
+		recordCopy("GET", true, 7)
+		recordCopy("GET", false, 11)
+
+		copies := countByTag(t, migrationCopyView.Name, keyOutcome)
+		assert.Equal(t, map[string]int64{"success": 2, "failure": 1}, copies, "copies should be counted by outcome")
+
+		rows, err := view.RetrieveData(migrationBytesView.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, rows, 1) {
+			assert.Equal(t, float64(12), rows[0].Data.(*view.SumData).Value, "bytes migrated should be the sum of copied values")
+		}
+	})
+}
+
+func Test_recordSourceKeys(t *testing.T) {
+	if err := view.Register(sourceKeysView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(sourceKeysView)
+
+	t.Run(`[When] the number of keys in "source" is sampled
+		   [Then] record the size of the "source" database`, func(t *testing.T) {
+
+		handler, srcMock, _ := initHandlerMock()
+		srcMock.Command("DBSIZE").Expect(int64(42))
+
+		recordSourceKeys(handler.settings)
+
+		rows, err := view.RetrieveData(sourceKeysView.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, rows, 1) {
+			assert.Equal(t, float64(42), rows[0].Data.(*view.LastValueData).Value, "keys remaining should be the database size")
+		}
+	})
+	t.Run(`[Given] the circuit breaker of "source" is open
+		    [When] the number of keys in "source" is sampled
+		    [Then] don't send DBSIZE to "source"`, func(t *testing.T) {
+
+		handler, srcMock, _ := initHandlerMock()
+		handler.settings.sourceBreaker = openBreaker("source")
+		dbsizeCmd := srcMock.Command("DBSIZE").Expect(int64(42))
+
+		recordSourceKeys(handler.settings)
+
+		assert.False(t, dbsizeCmd.Called, "DBSIZE should not be sent through an open breaker")
+	})
+}
+
+// countByTag returns the counts of a view with a Count aggregation, by the value of key
+func countByTag(t *testing.T, viewName string, key tag.Key) map[string]int64 {
+	rows, err := view.RetrieveData(viewName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int64)
+	for _, row := range rows {
+		for _, rowTag := range row.Tags {
+			if rowTag.Key == key {
+				counts[rowTag.Value] += row.Data.(*view.CountData).Value
+			}
+		}
+	}
+
+	return counts
+}
+
+func Test_commandTag(t *testing.T) {
+	var tc = []struct {
+		command, tag string
+	}{
+		{"GET", "GET"},
+		{"CLIENT", "CLIENT"},
+		{"", "UNKNOWN"},
+		{"GET\r\nFOO", "UNKNOWN"},
+		{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", "UNKNOWN"},
+	}
+
+	for _, tt := range tc {
+		assert.Equal(t, tt.tag, commandTag(tt.command))
+	}
+}
+
+func Test_configureViews(t *testing.T) {
+	defer func() {
+		reqLatencyView.Aggregation = view.Distribution(defaultLatencyBuckets...)
+		backendLatencyView.Aggregation = view.Distribution(defaultLatencyBuckets...)
+	}()
+
+	t.Run(`[Given] latency buckets are set in the configuration
+		    [When] the views are configured
+		    [Then] latency distributions use the configured buckets`, func(t *testing.T) {
+
+		buckets := []float64{0, 1, 10, 100, 1000}
+		configureViews(NewRedisHandler(RedisConfig{LatencyBuckets: buckets}))
+
+		assert.Equal(t, buckets, reqLatencyView.Aggregation.Buckets, "request latency should use the configured buckets")
+		assert.Equal(t, buckets, backendLatencyView.Aggregation.Buckets, "backend latency should use the configured buckets")
+	})
+}
+
+func Test_recordPoolStats(t *testing.T) {
+	if err := view.Register(poolActiveView, poolIdleView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(poolActiveView, poolIdleView)
+
+	t.Run(`[Given] a pool with a connection in use and an idle connection
+		    [When] the pool statistics are recorded
+		    [Then] record the active and idle connection counts of the pool`, func(t *testing.T) {
+
+		pool := &redis.Pool{
+			MaxIdle: 10,
+			Dial:    func() (redis.Conn, error) { return redigomock.NewConn(), nil },
+		}
+		inUse, idle := pool.Get(), pool.Get()
+		idle.Close()
+		defer inUse.Close()
+
+		recordPoolStats(map[string]*redis.Pool{"source": pool})
+
+		for viewName, expected := range map[string]float64{poolActiveView.Name: 2, poolIdleView.Name: 1} {
+			rows, err := view.RetrieveData(viewName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if assert.Len(t, rows, 1) {
+				assert.Equal(t, []tag.Tag{{Key: keyPool, Value: "source"}}, rows[0].Tags, "%s should be tagged by pool", viewName)
+				assert.Equal(t, expected, rows[0].Data.(*view.LastValueData).Value, "%s should be recorded", viewName)
+			}
+		}
+	})
+}
+
+func Test_recordClientCommand(t *testing.T) {
+	if err := view.Register(clientCmdCountView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(clientCmdCountView)
+
+	t.Run(`[When] commands received from clients are recorded
+		   [Then] count commands by client IP address`, func(t *testing.T) {
+
+		recordClientCommand("10.0.0.1:50000")
+		recordClientCommand("10.0.0.1:50001")
+		recordClientCommand("[::1]:50000")
+
+		commands := countByTag(t, clientCmdCountView.Name, keyClient)
+		assert.Equal(t, map[string]int64{"10.0.0.1": 2, "::1": 1}, commands, "commands should be counted by client")
+	})
+}
+
+func Test_redisHandler_Handle_countCommands(t *testing.T) {
+	if err := view.Register(clientCmdCountView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(clientCmdCountView)
+
+	t.Run(`[Given] commands are counted by client only once CountCommands is set
+		    [When] a command is received before it's set, and one after
+		    [Then] count only the second one`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+
+		serveRequest(t, handler, "*1\r\n$4\r\nPING\r\n")
+		handler.settings.config.Clients.CountCommands = true
+		serveRequest(t, handler, "*1\r\n$4\r\nPING\r\n")
+
+		counted := func() (count int64) {
+			for _, n := range countByTag(t, clientCmdCountView.Name, keyClient) {
+				count += n
+			}
+			return count
+		}
+		assert.Eventually(t, func() bool { return counted() > 0 }, time.Second, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, int64(1), counted(), "commands should not be counted by client unless CountCommands is set")
+	})
+}
+
+func Test_classifyError(t *testing.T) {
+	var tc = []struct {
+		err   error
+		class string
+	}{
+		{redis.Error("ERR wrong number of arguments for 'get' command"), errorClassRedis},
+		{redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"), errorClassRedis},
+		{redis.Error("NOAUTH Authentication required."), errorClassAuth},
+		{redis.Error("WRONGPASS invalid username-password pair"), errorClassAuth},
+		{redis.Error("ERR unknown command 'FOO'"), errorClassUnknownCommand},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, errorClassNetwork},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, errorClassTimeout},
+		{io.EOF, errorClassNetwork},
+		{errors.New("something else"), errorClassUnknown},
+	}
+
+	for _, tt := range tc {
+		assert.Equal(t, tt.class, classifyError(tt.err), "classifying %v", tt.err)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// monitorBuffer is the number of lines buffered for a monitor, lines
+// sent to a monitor which can't keep up beyond it are dropped
+const monitorBuffer = 1024
+
+// monitor is a client connection which has sent MONITOR, and is sent
+// every command handled by remiro from then on
+type monitor struct {
+	conn  redcon.DetachedConn
+	lines chan string
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// stop makes the monitor close its connection once its pending lines are sent
+func (m *monitor) stop() {
+	m.stopOnce.Do(func() { close(m.done) })
+}
+
+// write sends lines to the monitor until it's stopped. It's the only one writing
+// to the connection, which isn't safe for concurrent use.
+func (m *monitor) write() {
+	defer m.conn.NetConn().Close()
+
+	// Sends the reply to MONITOR, written before the connection was detached
+	if err := m.conn.Flush(); err != nil {
+		m.stop()
+		return
+	}
+
+	for {
+		select {
+		case line := <-m.lines:
+			m.conn.WriteString(line)
+			if err := m.conn.Flush(); err != nil {
+				m.stop()
+				return
+			}
+
+		case <-m.done:
+			for {
+				select {
+				case line := <-m.lines:
+					m.conn.WriteString(line)
+				default:
+					m.conn.Flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// read waits for the monitor to quit or to disconnect. Like Redis, commands
+// other than QUIT are ignored once a connection monitors remiro.
+func (m *monitor) read() {
+	defer m.stop()
+
+	for {
+		cmd, err := m.conn.ReadCommand()
+		if err != nil {
+			return
+		}
+		if strings.EqualFold(string(cmd.Args[0]), "QUIT") {
+			select {
+			case m.lines <- "OK":
+			default:
+			}
+			return
+		}
+	}
+}
+
+// monitors holds the connections monitoring remiro
+type monitors struct {
+	mu       sync.Mutex
+	monitors map[*monitor]bool
+	count    int32
+}
+
+// active reports whether there is any monitor, to avoid formatting
+// commands for nobody
+func (ms *monitors) active() bool {
+	return atomic.LoadInt32(&ms.count) > 0
+}
+
+// add makes conn a monitor, calling closed once it quits or disconnects
+func (ms *monitors) add(conn redcon.DetachedConn, closed func()) {
+	m := &monitor{
+		conn:  conn,
+		lines: make(chan string, monitorBuffer),
+		done:  make(chan struct{}),
+	}
+
+	ms.mu.Lock()
+	if ms.monitors == nil {
+		ms.monitors = make(map[*monitor]bool)
+	}
+	ms.monitors[m] = true
+	atomic.StoreInt32(&ms.count, int32(len(ms.monitors)))
+	ms.mu.Unlock()
+
+	go m.write()
+	go func() {
+		m.read()
+		ms.remove(m)
+		closed()
+	}()
+}
+
+func (ms *monitors) remove(m *monitor) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.monitors, m)
+	atomic.StoreInt32(&ms.count, int32(len(ms.monitors)))
+}
+
+// broadcast sends line to every monitor
+func (ms *monitors) broadcast(line string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for m := range ms.monitors {
+		select {
+		case m.lines <- line:
+		default:
+		}
+	}
+}
+
+// closeAll disconnects every monitor
+func (ms *monitors) closeAll() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for m := range ms.monitors {
+		m.stop()
+	}
+}
+
+// monitorLine formats a command the way Redis MONITOR does, followed by where remiro
+// has routed it and the commands it has sent to "source" and "destination", e.g.
+//
+//	1570000000.123456 [0 10.0.0.1:50000] "GET" "mykey" [route=source backends=destination:GET,source:GET,destination:SET]
+//
+// Routing is written unquoted, so that tools parsing the output of Redis MONITOR
+// don't take it for arguments of the command.
+func monitorLine(startTime time.Time, client string, args []string, record *accessRecord) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d.%06d [0 %s]", startTime.Unix(), startTime.Nanosecond()/1000, client)
+	for _, arg := range args {
+		b.WriteByte(' ')
+		b.WriteString(quoteArg(arg))
+	}
+
+	var routing []string
+	if record.route != "" {
+		routing = append(routing, "route="+record.route)
+	}
+	if calls := record.calls(); len(calls) > 0 {
+		backends := make([]string, len(calls))
+		for i, call := range calls {
+			backends[i] = call.Target + ":" + call.Command
+		}
+		routing = append(routing, "backends="+strings.Join(backends, ","))
+	}
+	if len(routing) > 0 {
+		b.WriteString(" [" + strings.Join(routing, " ") + "]")
+	}
+
+	return b.String()
+}
+
+// quoteArg quotes arg the way Redis does in MONITOR output, see sdscatrepr
+func quoteArg(arg string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		switch c := arg[i]; c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			if c < 0x20 || c > 0x7e {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_redisHandler_HandleMONITOR(t *testing.T) {
+	var (
+		key, value = "mykey", "hello"
+		rawGET     = fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+	)
+
+	t.Run(`[Given] a client is monitoring remiro
+		    [When] a command is received from another client
+		    [Then] stream the command to the monitoring client along with its routing`, func(t *testing.T) {
+
+		handler, _, dstMock := initHandlerMock()
+		handler.settings.config.Logging = LoggingConfig{Keys: logHash}
+		dstMock.Command("GET", []byte(key)).Expect(value)
+
+		s := NewServer(":0", handler)
+		signal := make(chan error)
+		go s.ListenServeAndSignal(signal)
+		if err := <-signal; err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		defer handler.monitors.closeAll()
+
+		monitorConn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer monitorConn.Close()
+		monitorConn.SetDeadline(time.Now().Add(5 * time.Second))
+		monitor := bufio.NewReader(monitorConn)
+
+		io.WriteString(monitorConn, "*1\r\n$7\r\nMONITOR\r\n")
+		line, err := monitor.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "+OK\r\n", line, "MONITOR should reply OK")
+
+		if _, err := doRequest(s.Addr().String(), rawGET); err != nil {
+			t.Fatal(err)
+		}
+
+		line, err = monitor.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := regexp.QuoteMeta(fmt.Sprintf(`"GET" "hash:%s" [route=destination backends=destination:GET]`, keyHash([]byte(key))))
+		assert.Regexp(t, `^\+\d+\.\d{6} \[0 \S+\] `+expected+"\r\n$", line, "command should be streamed with its routing")
+
+		io.WriteString(monitorConn, "*1\r\n$4\r\nQUIT\r\n")
+		line, _ = monitor.ReadString('\n')
+		assert.Equal(t, "+OK\r\n", line, "QUIT should reply OK")
+		_, err = monitor.ReadString('\n')
+		assert.Equal(t, io.EOF, err, "connection should be closed after QUIT")
+	})
+}
+
+func Test_redisHandler_HandleMONITOR_clients(t *testing.T) {
+	t.Run(`[Given] at most 1 client, and a client monitoring remiro
+		    [When] another client connects
+		    [Then] refuse it, the monitoring client counting against the limit
+		     [And] accept it once the monitoring client has quit`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.config.Clients = ClientsConfig{MaxClients: 1}
+
+		s := NewServer(":0", handler)
+		signal := make(chan error)
+		go s.ListenServeAndSignal(signal)
+		if err := <-signal; err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		defer handler.monitors.closeAll()
+
+		monitorConn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer monitorConn.Close()
+		monitorConn.SetDeadline(time.Now().Add(5 * time.Second))
+		monitor := bufio.NewReader(monitorConn)
+
+		io.WriteString(monitorConn, "*1\r\n$7\r\nMONITOR\r\n")
+		if _, err := monitor.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+
+		reply, _ := doRequest(s.Addr().String(), "*1\r\n$4\r\nPING\r\n")
+		assert.Equal(t, "-"+errMaxClientsMsg+"\r\n", reply, "client should be refused while monitoring")
+
+		io.WriteString(monitorConn, "*1\r\n$4\r\nQUIT\r\n")
+		monitor.ReadString('\n')
+		monitor.ReadString('\n')
+
+		assert.Eventually(t, func() bool {
+			reply, _ := doRequest(s.Addr().String(), "*1\r\n$4\r\nPING\r\n")
+			return reply == "+PONG\r\n"
+		}, time.Second, 10*time.Millisecond, "client should be accepted once the monitor has quit")
+	})
+}
+
+func Test_quoteArg(t *testing.T) {
+	var tc = []struct {
+		arg, quoted string
+	}{
+		{"mykey", `"mykey"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{"a\\b", `"a\\b"`},
+		{"line\r\n", `"line\r\n"`},
+		{"\x00\xff", `"\x00\xff"`},
+	}
+
+	for _, tt := range tc {
+		assert.Equal(t, tt.quoted, quoteArg(tt.arg))
+	}
+}
@@ -0,0 +1,116 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// poolExhaustedError is returned for commands which can't be sent because every
+// connection of their pool is in use, and none became available within wait
+type poolExhaustedError struct {
+	pool string
+	wait time.Duration
+}
+
+func (e poolExhaustedError) Error() string {
+	if e.wait > 0 {
+		return fmt.Sprintf("no connection of the %s pool available after %s", e.pool, e.wait)
+	}
+	return fmt.Sprintf("no connection of the %s pool available, all of its connections are in use", e.pool)
+}
+
+// getConn returns a connection of the pool named name, see pools. If the pool is
+// exhausted and waits for a connection to be available, it waits until ctx is done
+// or WaitTimeout of the pool has passed. Failing to get a connection, a connection
+// whose commands all fail with the cause is returned, so that it's replied with
+// the error of the first command like any other error.
+func (s *settings) getConn(ctx context.Context, name string) redis.Conn {
+	pool, config := s.pools()[name], s.config.Destination
+	if poolTarget(name) == "source" {
+		config = s.config.Source
+	}
+
+	waitCtx := ctx
+	if timeout := config.WaitTimeout.Duration; timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	conn, err := pool.GetContext(waitCtx)
+	if err == nil {
+		return conn
+	}
+
+	if contextErr(ctx) != nil {
+		err = contextErr(ctx)
+	} else if contextErr(waitCtx) != nil {
+		err = poolExhaustedError{pool: name, wait: config.WaitTimeout.Duration}
+	} else if err == redis.ErrPoolExhausted {
+		err = poolExhaustedError{pool: name}
+	}
+
+	return failedConn{err}
+}
+
+// poolTarget returns the backend the pool named name connects to, either "source" or "destination"
+func poolTarget(name string) string {
+	if strings.HasPrefix(name, "source") {
+		return "source"
+	}
+	return "destination"
+}
+
+// poolExhausted reports whether err is the failure to get a connection of a pool
+// because all of its MaxActive connections are in use
+func poolExhausted(err error) bool {
+	_, exhausted := err.(poolExhaustedError)
+	return exhausted || err == redis.ErrPoolExhausted
+}
+
+// testOnBorrow returns a TestOnBorrow function for a pool, which sends PING to
+// connections that have been idle for longer than after before they're used
+func testOnBorrow(after time.Duration) func(redis.Conn, time.Time) error {
+	if after == 0 {
+		return nil
+	}
+
+	return func(conn redis.Conn, idleSince time.Time) error {
+		if time.Since(idleSince) < after {
+			return nil
+		}
+
+		reply, err := conn.Do("PING")
+		if raw, ok := reply.([]byte); ok && err == nil {
+			// Replies of raw connections are the verbatim RESP bytes
+			err = replyError(raw)
+		}
+		return err
+	}
+}
+
+// failedConn is a connection which couldn't be gotten from a pool, every
+// command sent with it failing with err
+type failedConn struct {
+	err error
+}
+
+func (c failedConn) Close() error { return nil }
+func (c failedConn) Err() error   { return c.err }
+func (c failedConn) Flush() error { return c.err }
+
+func (c failedConn) Do(string, ...interface{}) (interface{}, error) { return nil, c.err }
+func (c failedConn) Send(string, ...interface{}) error              { return c.err }
+func (c failedConn) Receive() (interface{}, error)                  { return nil, c.err }
+
+func (c failedConn) DoContext(context.Context, string, ...interface{}) (interface{}, error) {
+	return nil, c.err
+}
+
+func (c failedConn) ReceiveContext(context.Context) (interface{}, error) {
+	return nil, c.err
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_settings_getConn(t *testing.T) {
+	t.Run(`[Given] every connection of a pool which waits for connections is in use
+		    [When] a connection is requested
+		    [Then] give up once WaitTimeout has passed`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		s := handler.settings
+		s.config.Destination.Wait = true
+		s.config.Destination.WaitTimeout = duration{20 * time.Millisecond}
+		s.destinationPool.MaxActive = 1
+		s.destinationPool.Wait = true
+
+		held := s.getConn(context.Background(), "destination")
+		defer held.Close()
+
+		conn := s.getConn(context.Background(), "destination")
+		_, err := conn.Do("GET", "mykey")
+
+		assert.Equal(t, poolExhaustedError{pool: "destination", wait: 20 * time.Millisecond}, err)
+		assert.True(t, poolExhausted(err), "pool should be reported as exhausted")
+	})
+
+	t.Run(`[Given] every connection of a pool which doesn't wait for connections is in use
+		    [When] a command is received
+		    [Then] reply that the pool is exhausted`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.destinationRawPool.MaxActive = 1
+
+		held := handler.settings.getConn(context.Background(), "destination_raw")
+		defer held.Close()
+
+		reply := serveRequest(t, handler, "*2\r\n$4\r\nINCR\r\n$5\r\nmykey\r\n")
+
+		assert.Equal(t, "-ERR no connection of the destination_raw pool available, all of its connections are in use\r\n", reply)
+	})
+}
+
+func Test_testOnBorrow(t *testing.T) {
+	t.Run(`[When] a connection which has been idle for long is borrowed
+		   [Then] check it with PING`, func(t *testing.T) {
+
+		mock := redigomock.NewConn()
+		ping := mock.Command("PING").ExpectError(errors.New("connection reset"))
+		test := testOnBorrow(time.Second)
+
+		assert.NoError(t, test(mock, time.Now()), "recently used connection should not be checked")
+		assert.False(t, ping.Called)
+
+		assert.Error(t, test(mock, time.Now().Add(-time.Minute)), "failing connection should be reported")
+		assert.True(t, ping.Called)
+	})
+
+	t.Run(`[When] a raw connection replies to PING with an error
+		   [Then] report the error`, func(t *testing.T) {
+
+		mock := redigomock.NewConn()
+		mock.Command("PING").Expect([]byte("-LOADING Redis is loading the dataset in memory\r\n"))
+
+		err := testOnBorrow(time.Second)(mock, time.Now().Add(-time.Minute))
+
+		assert.Equal(t, redis.Error("LOADING Redis is loading the dataset in memory"), err)
+	})
+
+	t.Run(`[When] TestOnBorrow isn't set
+		   [Then] don't check connections`, func(t *testing.T) {
+
+		assert.Nil(t, testOnBorrow(0))
+	})
+}
@@ -0,0 +1,240 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Policies of syncing the queue file to disk, named after appendfsync of Redis
+const (
+	// fsyncAlways syncs the file after every write is appended, before it's replied to
+	fsyncAlways = "always"
+
+	// fsyncEverySec syncs the file every second, up to a second of writes
+	// being lost if the host crashes
+	fsyncEverySec = "everysec"
+
+	// fsyncNo leaves syncing the file to the operating system
+	fsyncNo = "no"
+)
+
+var fsyncPolicies = []string{fsyncAlways, fsyncEverySec, fsyncNo}
+
+// queueFileSyncInterval is how often the queue file is synced with the "everysec" policy
+const queueFileSyncInterval = time.Second
+
+// replayedMarker is the command appended to the queue file once its oldest write
+// has been replayed, so that writes replayed before a restart aren't replayed
+// again. It's never queued as a write, as only write commands are.
+const replayedMarker = "REMIRO.REPLAYED"
+
+// queueFile is the append-only file backing the queue of writes of degraded mode,
+// so that queued writes survive a restart. Writes are appended in RESP, like the
+// append-only file of Redis, followed by a replayedMarker every time a write has
+// been replayed, and the file is emptied once they've all been replayed.
+type queueFile struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	fsync string
+	size  int64
+	dirty bool
+	done  chan struct{}
+}
+
+// openQueueFile opens the queue file at path, creating it if needed, and returns
+// the writes it holds. A write which was only partly appended, e.g. because
+// remiro crashed meanwhile, is discarded.
+func openQueueFile(path, fsync string) (*queueFile, []queuedWrite, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	writes, valid, err := readQueueFile(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if info, err := file.Stat(); err == nil && info.Size() > valid {
+		log.WithFields(log.Fields{"context": "Opening queue file", "path": path}).
+			Warnf("Discarding %d bytes of a write which was only partly queued", info.Size()-valid)
+		if err := file.Truncate(valid); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+
+	f := &queueFile{path: path, file: file, fsync: fsync, size: valid, done: make(chan struct{})}
+	go f.syncPeriodically()
+
+	return f, writes, nil
+}
+
+// readQueueFile reads the writes of a queue file which haven't been replayed yet,
+// returning them along with the number of bytes of the file holding complete
+// writes and markers, the rest of the file being an incomplete write
+func readQueueFile(r io.Reader) ([]queuedWrite, int64, error) {
+	br := bufio.NewReader(r)
+	var writes []queuedWrite
+	var valid int64
+	for {
+		w, n, err := readQueuedWrite(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errProtocol {
+			return writes, valid, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if w.command == replayedMarker {
+			if len(writes) > 0 {
+				writes[0] = queuedWrite{}
+				writes = writes[1:]
+			}
+		} else {
+			writes = append(writes, w)
+		}
+		valid += n
+	}
+}
+
+// readQueuedWrite reads a write encoded in RESP, returning it along with its size in bytes
+func readQueuedWrite(br *bufio.Reader) (queuedWrite, int64, error) {
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		if len(line) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return queuedWrite{}, 0, err
+	}
+	size := int64(len(line))
+	if len(line) < 4 || line[0] != '*' || line[len(line)-2] != '\r' {
+		return queuedWrite{}, 0, errProtocol
+	}
+	n, err := parseReplyLen(line)
+	if err != nil || n < 1 {
+		return queuedWrite{}, 0, errProtocol
+	}
+
+	args := make([][]byte, n)
+	for i := range args {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return queuedWrite{}, 0, io.ErrUnexpectedEOF
+		}
+		if len(line) < 4 || line[0] != '$' || line[len(line)-2] != '\r' {
+			return queuedWrite{}, 0, errProtocol
+		}
+		length, err := parseReplyLen(line)
+		if err != nil || length < 0 {
+			return queuedWrite{}, 0, errProtocol
+		}
+
+		arg := make([]byte, length+2)
+		if _, err := io.ReadFull(br, arg); err != nil {
+			return queuedWrite{}, 0, io.ErrUnexpectedEOF
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return queuedWrite{}, 0, errProtocol
+		}
+		args[i] = arg[:length]
+		size += int64(len(line) + len(arg))
+	}
+
+	return newQueuedWrite(string(args[0]), args[1:]), size, nil
+}
+
+// append appends the encoded write to the file, syncing it right away with the "always" policy
+func (f *queueFile) append(encoded []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.file.Write(encoded); err != nil {
+		// A write partly appended would hide the writes appended after it
+		f.file.Truncate(f.size)
+		return err
+	}
+	f.size += int64(len(encoded))
+	if f.fsync == fsyncAlways {
+		return f.file.Sync()
+	}
+	f.dirty = true
+	return nil
+}
+
+// markReplayed appends a replayedMarker, once the oldest write of the file has been replayed
+func (f *queueFile) markReplayed() error {
+	return f.append(queuedWrite{command: replayedMarker}.encode())
+}
+
+// truncate empties the file, once every write it holds has been replayed
+func (f *queueFile) truncate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.file.Truncate(0); err != nil {
+		return err
+	}
+	f.size = 0
+	return f.file.Sync()
+}
+
+func (f *queueFile) setFsync(fsync string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fsync = fsync
+}
+
+// syncPeriodically syncs the file every second with the "everysec" policy, until it's closed
+func (f *queueFile) syncPeriodically() {
+	ticker := time.NewTicker(queueFileSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+
+		f.mu.Lock()
+		if f.dirty && f.fsync == fsyncEverySec {
+			if err := f.file.Sync(); err != nil {
+				log.WithFields(log.Fields{"context": "Syncing queue file", "path": f.path}).Error(err)
+			}
+			f.dirty = false
+		}
+		f.mu.Unlock()
+	}
+}
+
+// close syncs and closes the file
+func (f *queueFile) close() error {
+	close(f.done)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// encode returns w encoded in RESP, as it's appended to the queue file
+func (w queuedWrite) encode() []byte {
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	writeCommand(bw, w.command, w.args)
+	bw.Flush()
+	return buf.Bytes()
+}
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_degradedMode_useFile(t *testing.T) {
+	writes := []queuedWrite{
+		newQueuedWrite("SET", [][]byte{[]byte("mykey"), []byte("my\r\nvalue")}),
+		newQueuedWrite("INCR", [][]byte{[]byte("counter")}),
+		newQueuedWrite("DEL", [][]byte{[]byte("")}),
+	}
+
+	t.Run(`[Given] writes queued in a queue file
+		    [When] the queue file is opened again
+		    [Then] load the writes in order`, func(t *testing.T) {
+
+		path := tempQueueFile(t)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		var d degradedMode
+		_, err := d.useFile(path, fsyncAlways)
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, w := range writes {
+			assert.NoError(t, d.enqueue(w, DegradedConfig{}))
+		}
+		assert.NoError(t, d.close())
+
+		var reopened degradedMode
+		loaded, err := reopened.useFile(path, fsyncEverySec)
+		defer reopened.close()
+
+		assert.NoError(t, err)
+		assert.Equal(t, len(writes), loaded)
+		assert.Equal(t, writes, reopened.queue)
+		assert.Equal(t, d.bytes, reopened.bytes, "size of the queue should be restored")
+	})
+
+	t.Run(`[Given] a queue file whose last write was only partly appended
+		    [When] the queue file is opened
+		    [Then] load the complete writes and discard the rest`, func(t *testing.T) {
+
+		path := tempQueueFile(t)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		complete := writes[0].encode()
+		partial := writes[1].encode()
+		content := append(append([]byte(nil), complete...), partial[:len(partial)-3]...)
+		if err := ioutil.WriteFile(path, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		var d degradedMode
+		loaded, err := d.useFile(path, fsyncNo)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		assert.Equal(t, 1, loaded)
+		assert.NoError(t, d.enqueue(writes[2], DegradedConfig{}))
+		assert.NoError(t, d.close())
+
+		var reopened degradedMode
+		reopened.useFile(path, fsyncNo)
+		defer reopened.close()
+		assert.Equal(t, []queuedWrite{writes[0], writes[2]}, reopened.queue,
+			"writes queued after the partial one should be kept")
+	})
+
+	t.Run(`[Given] writes queued in a queue file
+		    [When] every write has been replayed
+		    [Then] empty the queue file`, func(t *testing.T) {
+
+		path := tempQueueFile(t)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		var d degradedMode
+		d.useFile(path, fsyncEverySec)
+		defer d.close()
+		for _, w := range writes {
+			d.enqueue(w, DegradedConfig{})
+		}
+
+		for range writes {
+			d.pop()
+		}
+
+		info, err := os.Stat(path)
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(0), info.Size())
+		}
+		assert.Equal(t, int64(0), d.bytes)
+	})
+
+	t.Run(`[Given] writes queued in a queue file, the first of which has been replayed
+		    [When] the queue file is opened again
+		    [Then] load the writes which haven't been replayed`, func(t *testing.T) {
+
+		path := tempQueueFile(t)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		var d degradedMode
+		d.useFile(path, fsyncAlways)
+		for _, w := range writes {
+			d.enqueue(w, DegradedConfig{})
+		}
+		d.pop()
+		assert.NoError(t, d.close())
+
+		var reopened degradedMode
+		loaded, err := reopened.useFile(path, fsyncAlways)
+		defer reopened.close()
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, loaded)
+		assert.Equal(t, writes[1:], reopened.queue)
+		assert.Equal(t, d.bytes, reopened.bytes, "size of the queue should be restored")
+	})
+
+	t.Run(`[Given] writes are queued
+		    [When] the queue file is changed
+		    [Then] keep the current queue file`, func(t *testing.T) {
+
+		path := tempQueueFile(t)
+		defer os.RemoveAll(filepath.Dir(path))
+
+		var d degradedMode
+		d.useFile(path, fsyncEverySec)
+		defer d.close()
+		d.enqueue(writes[0], DegradedConfig{})
+
+		_, err := d.useFile(path+".new", fsyncEverySec)
+
+		assert.Equal(t, errQueueInUse, err)
+		assert.Equal(t, path, d.status().QueueFile)
+	})
+}
+
+func Test_degradedMode_enqueue(t *testing.T) {
+	t.Run(`[Given] a queue limited in size
+		    [When] writes are queued
+		    [Then] reject writes which would exceed the limit`, func(t *testing.T) {
+
+		w := newQueuedWrite("SET", [][]byte{[]byte("mykey"), []byte("myvalue")})
+		size := int64(len(w.encode()))
+		config := DegradedConfig{QueueMaxBytes: 2*size + 1}
+
+		var d degradedMode
+		assert.NoError(t, d.enqueue(w, config))
+		assert.NoError(t, d.enqueue(w, config))
+		assert.Equal(t, errQueueFull, d.enqueue(w, config))
+		assert.Equal(t, 2*size, d.status().QueuedBytes)
+	})
+}
+
+func Test_NewRedisHandler_queueFile(t *testing.T) {
+	t.Run(`[Given] a queue file holding writes from a previous run
+		    [When] the handler is created
+		    [Then] start in degraded mode with the writes queued`, func(t *testing.T) {
+
+		path := tempQueueFile(t)
+		defer os.RemoveAll(filepath.Dir(path))
+		w := newQueuedWrite("SET", [][]byte{[]byte("mykey"), []byte("myvalue")})
+		if err := ioutil.WriteFile(path, w.encode(), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		config := RedisConfig{Degraded: DegradedConfig{
+			Enabled:       true,
+			Writes:        degradedWritesQueue,
+			QueueFile:     path,
+			CheckInterval: duration{time.Hour},
+		}}
+		handler := NewRedisHandler(config).(*redisHandler)
+		defer handler.Shutdown(context.Background())
+
+		status := handler.degraded.status()
+		assert.False(t, status.Since.IsZero(), "handler should be in degraded mode")
+		assert.Equal(t, 1, status.Queued)
+		assert.Equal(t, path, status.QueueFile)
+	})
+}
+
+func Test_redisHandler_replay_queueFile(t *testing.T) {
+	t.Run(`[Given] writes queued in a queue file
+		    [When] "destination" goes down again in the middle of replaying them, and remiro restarts
+		    [Then] only replay the writes which haven't been replayed yet`, func(t *testing.T) {
+
+		path := tempQueueFile(t)
+		defer os.RemoveAll(filepath.Dir(path))
+		config := RedisConfig{Degraded: DegradedConfig{
+			Enabled:       true,
+			Writes:        degradedWritesQueue,
+			QueueFile:     path,
+			Fsync:         fsyncAlways,
+			CheckInterval: duration{time.Hour},
+		}}
+
+		handler, _, dstMock := initHandlerMock()
+		handler.settings.config = config
+		handler.openQueueFile(config.Degraded)
+		handler.degraded.enter()
+		for _, key := range []string{"first", "second", "third"} {
+			handler.degraded.enqueue(newQueuedWrite("INCR", [][]byte{[]byte(key)}), config.Degraded)
+		}
+
+		dstMock.Command("PING").Expect("PONG")
+		dstMock.Command("INCR", []byte("first")).Expect(int64(1))
+		dstMock.Command("INCR", []byte("second")).ExpectError(&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")})
+
+		_, recovered := handler.replay(handler.settings)
+		assert.False(t, recovered, "replay should stop once destination is down")
+		handler.degraded.close()
+
+		restarted := NewRedisHandler(config).(*redisHandler)
+		defer restarted.Shutdown(context.Background())
+
+		assert.Equal(t, 2, restarted.degraded.status().Queued)
+		w, _ := restarted.degraded.next()
+		assert.Equal(t, newQueuedWrite("INCR", [][]byte{[]byte("second")}), w,
+			"replay should resume with the write which failed")
+	})
+}
+
+func tempQueueFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "remiro-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "queue.aof")
+}
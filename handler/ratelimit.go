@@ -0,0 +1,252 @@
+package handler
+
+import (
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRateLimitMsg is replied to the commands rejected by a rate limit
+const defaultRateLimitMsg = "ERR rate limit exceeded"
+
+// rateLimitSweepInterval is how often the buckets of clients and users which
+// have been idle long enough to be full again are forgotten
+const rateLimitSweepInterval = time.Minute
+
+// Limits a command can be rejected by
+const (
+	// rateLimitClient is the limit of the commands sent by each client IP address
+	rateLimitClient = "client"
+
+	// rateLimitUser is the limit of the commands sent by each authenticated user
+	rateLimitUser = "user"
+
+	// rateLimitSource is the limit of the commands sent to "source" by remiro
+	rateLimitSource = "source"
+)
+
+// RateLimitConfig holds the configuration of rate limits, which are token buckets
+// refilled at a rate per second, up to a burst. Commands exceeding a limit are
+// rejected with Message.
+type RateLimitConfig struct {
+	// ClientRate is the number of commands per second each client IP address
+	// may send. Unlimited if it's not set.
+	ClientRate  float64
+	ClientBurst int
+
+	// UserRate is the number of commands per second each authenticated user,
+	// whatever the connection, may send. Unlimited if it's not set.
+	UserRate  float64
+	UserBurst int
+
+	// SourceRate is the number of commands per second sent to "source", to read
+	// and delete keys being migrated or writes served by it in degraded mode,
+	// admin API and sampled metrics included. Unlimited if it's not set.
+	SourceRate  float64
+	SourceBurst int
+
+	// Message is the error replied to rejected commands, it defaults to
+	// "ERR rate limit exceeded"
+	Message string
+}
+
+func (c RateLimitConfig) validate(problems *ConfigError) {
+	for _, limit := range []struct {
+		name  string
+		rate  float64
+		burst int
+	}{
+		{"Client", c.ClientRate, c.ClientBurst},
+		{"User", c.UserRate, c.UserBurst},
+		{"Source", c.SourceRate, c.SourceBurst},
+	} {
+		if limit.rate < 0 {
+			problems.add("RateLimit.%sRate must not be negative", limit.name)
+		}
+		if limit.burst < 0 {
+			problems.add("RateLimit.%sBurst must not be negative", limit.name)
+		}
+	}
+	if strings.ContainsAny(c.Message, "\r\n") {
+		problems.add("RateLimit.Message must be a single line")
+	}
+}
+
+func (c RateLimitConfig) enabled() bool {
+	return c.ClientRate > 0 || c.UserRate > 0 || c.SourceRate > 0
+}
+
+func (c RateLimitConfig) message() string {
+	if c.Message == "" {
+		return defaultRateLimitMsg
+	}
+	return c.Message
+}
+
+// burst returns the size of a bucket refilled at rate, which defaults to the
+// number of commands of a second, but no less than one
+func burst(rate float64, burst int) float64 {
+	if burst == 0 {
+		return math.Max(1, math.Ceil(rate))
+	}
+	return float64(burst)
+}
+
+// rateLimitedError is returned for commands which aren't sent to "source"
+// because its rate limit is exceeded
+type rateLimitedError struct {
+	target string
+}
+
+func (e rateLimitedError) Error() string {
+	return "rate limit of " + e.target + " exceeded"
+}
+
+func isRateLimited(err error) bool {
+	_, ok := err.(rateLimitedError)
+	return ok
+}
+
+// tokenBucket holds tokens, one of which is taken by every command. It's refilled
+// continuously, tokens being computed when one is taken.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes a token if there's one left, refilling the bucket at rate up to burst first
+func (b *tokenBucket) take(rate, burst float64, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full tells whether the bucket would be full by now, so that it can be forgotten
+func (b *tokenBucket) full(rate, burst float64, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+// rateLimiter enforces the rate limits of RateLimitConfig. A nil rateLimiter
+// is a disabled one, which lets every command through.
+type rateLimiter struct {
+	config RateLimitConfig
+
+	mu      sync.Mutex
+	clients map[string]*tokenBucket
+	users   map[string]*tokenBucket
+	source  tokenBucket
+	sweptAt time.Time
+}
+
+// newRateLimiter returns a rate limiter for config, nil if no limit is set
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	if !config.enabled() {
+		return nil
+	}
+
+	return &rateLimiter{
+		config:  config,
+		clients: make(map[string]*tokenBucket),
+		users:   make(map[string]*tokenBucket),
+		sweptAt: time.Now(),
+	}
+}
+
+// allowCommand takes a token for a command sent from the client address addr,
+// authenticated as user if it's not empty. It returns the limit exceeded,
+// if any, in which case no token is taken.
+func (l *rateLimiter) allowCommand(addr, user string) (string, bool) {
+	if l == nil {
+		return "", true
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	var client *tokenBucket
+	if rate := l.config.ClientRate; rate > 0 {
+		client = l.bucket(l.clients, clientIP(addr))
+		if !client.take(rate, burst(rate, l.config.ClientBurst), now) {
+			return rateLimitClient, false
+		}
+	}
+
+	if rate := l.config.UserRate; rate > 0 && user != "" {
+		if !l.bucket(l.users, user).take(rate, burst(rate, l.config.UserBurst), now) {
+			if client != nil {
+				// The command isn't sent, so it doesn't count against the client
+				client.tokens++
+			}
+			return rateLimitUser, false
+		}
+	}
+
+	return "", true
+}
+
+// allowSource takes a token for a command sent to "source"
+func (l *rateLimiter) allowSource() bool {
+	if l == nil || l.config.SourceRate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate := l.config.SourceRate
+	return l.source.take(rate, burst(rate, l.config.SourceBurst), time.Now())
+}
+
+func (l *rateLimiter) bucket(buckets map[string]*tokenBucket, key string) *tokenBucket {
+	b, ok := buckets[key]
+	if !ok {
+		b = &tokenBucket{}
+		buckets[key] = b
+	}
+	return b
+}
+
+// sweep forgets the buckets which are full again, as they would be created
+// anew the same, so that the buckets of clients gone don't pile up
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.sweptAt) < rateLimitSweepInterval {
+		return
+	}
+	l.sweptAt = now
+
+	for _, limit := range []struct {
+		buckets     map[string]*tokenBucket
+		rate, burst float64
+	}{
+		{l.clients, l.config.ClientRate, burst(l.config.ClientRate, l.config.ClientBurst)},
+		{l.users, l.config.UserRate, burst(l.config.UserRate, l.config.UserBurst)},
+	} {
+		for key, b := range limit.buckets {
+			if b.full(limit.rate, limit.burst, now) {
+				delete(limit.buckets, key)
+			}
+		}
+	}
+}
+
+// clientIP returns the IP address of a client address, which includes its port
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
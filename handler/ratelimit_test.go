@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_tokenBucket_take(t *testing.T) {
+	t.Run(`[Given] a bucket refilled at 10 tokens per second, up to 2
+		    [When] tokens are taken
+		    [Then] take up to 2 at once, and one more every 100ms`, func(t *testing.T) {
+
+		var b tokenBucket
+		now := time.Now()
+
+		assert.True(t, b.take(10, 2, now))
+		assert.True(t, b.take(10, 2, now))
+		assert.False(t, b.take(10, 2, now), "bucket should be empty")
+		assert.False(t, b.take(10, 2, now.Add(50*time.Millisecond)), "bucket should not be refilled yet")
+		assert.True(t, b.take(10, 2, now.Add(100*time.Millisecond)))
+		assert.True(t, b.full(10, 2, now.Add(time.Second)), "bucket should be full again")
+	})
+}
+
+func Test_rateLimiter_allowCommand(t *testing.T) {
+	t.Run(`[Given] a limit of 1 command per second per client
+		    [When] two clients send commands
+		    [Then] limit them by IP address, whatever the port`, func(t *testing.T) {
+
+		l := newRateLimiter(RateLimitConfig{ClientRate: 1})
+
+		_, ok := l.allowCommand("10.0.0.1:50000", "default")
+		assert.True(t, ok)
+		limit, ok := l.allowCommand("10.0.0.1:50001", "default")
+		assert.False(t, ok)
+		assert.Equal(t, rateLimitClient, limit)
+		_, ok = l.allowCommand("10.0.0.2:50000", "default")
+		assert.True(t, ok)
+	})
+
+	t.Run(`[Given] a limit of 1 command per second per user, and 2 per client
+		    [When] a user sends commands from a client
+		    [Then] limit the user, without counting rejected commands against the client
+		     [And] don't limit clients which aren't authenticated`, func(t *testing.T) {
+
+		l := newRateLimiter(RateLimitConfig{UserRate: 1, ClientRate: 2})
+
+		_, ok := l.allowCommand("10.0.0.1:50000", "default")
+		assert.True(t, ok)
+		limit, ok := l.allowCommand("10.0.0.1:50000", "default")
+		assert.False(t, ok)
+		assert.Equal(t, rateLimitUser, limit)
+		_, ok = l.allowCommand("10.0.0.1:50000", "")
+		assert.True(t, ok, "client should have a token left")
+	})
+
+	t.Run(`[Given] no rate limit
+		    [When] commands are sent
+		    [Then] let them through`, func(t *testing.T) {
+
+		l := newRateLimiter(RateLimitConfig{})
+
+		assert.Nil(t, l)
+		_, ok := l.allowCommand("10.0.0.1:50000", "default")
+		assert.True(t, ok)
+		assert.True(t, l.allowSource())
+	})
+}
+
+func Test_rateLimiter_sweep(t *testing.T) {
+	t.Run(`[Given] buckets of clients, one of which is full again
+		    [When] buckets are swept
+		    [Then] forget the full one`, func(t *testing.T) {
+
+		l := newRateLimiter(RateLimitConfig{ClientRate: 1, ClientBurst: 10})
+		now := time.Now()
+		l.clients["10.0.0.1"] = &tokenBucket{tokens: 9, last: now.Add(-time.Minute)}
+		l.clients["10.0.0.2"] = &tokenBucket{tokens: 0, last: now}
+
+		l.sweptAt = now.Add(-rateLimitSweepInterval)
+		l.sweep(now)
+
+		assert.NotContains(t, l.clients, "10.0.0.1")
+		assert.Contains(t, l.clients, "10.0.0.2")
+	})
+}
+
+func TestRateLimitConfig_validate(t *testing.T) {
+	t.Run(`[When] a rate limit configuration is validated
+		   [Then] returns error if rates or bursts are negative, or the message spans lines`, func(t *testing.T) {
+
+		problems := &ConfigError{}
+		RateLimitConfig{ClientRate: -1, UserBurst: -1, SourceRate: -1, Message: "ERR slow down\r\n"}.validate(problems)
+
+		assert.Len(t, problems.Problems, 4, "every problem should be reported")
+	})
+}
+
+func Test_redisHandler_Handle_rateLimit(t *testing.T) {
+	t.Run(`[Given] a limit of 1 command per second per client, with a custom message
+		    [When] two commands are received from a client
+		    [Then] reject the second one with the message`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.config.RateLimit = RateLimitConfig{ClientRate: 1, Message: "ERR slow down"}
+		handler.settings.rateLimiter = newRateLimiter(handler.settings.config.RateLimit)
+
+		reply := serveRequest(t, handler, "*1\r\n$4\r\nPING\r\n")
+		assert.Equal(t, "+PONG\r\n", reply)
+
+		reply = serveRequest(t, handler, "*1\r\n$4\r\nPING\r\n")
+		assert.Equal(t, "-ERR slow down\r\n", reply)
+	})
+
+	t.Run(`[Given] a limit of 1 command per second sent to "source"
+		    [When] GET requests are received for keys missing in "destination"
+		    [Then] read the first key from "source"
+		     [And] reject the second one without reading "source"`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings.config.RateLimit = RateLimitConfig{SourceRate: 1}
+		handler.settings.rateLimiter = newRateLimiter(handler.settings.config.RateLimit)
+
+		dstMock.Command("GET", []byte("mykey")).Expect(nil)
+		dstMock.Command("GET", []byte("otherkey")).Expect(nil)
+		srcMock.Command("GET", []byte("mykey")).Expect([]byte("myvalue"))
+		srcCmd := srcMock.Command("GET", []byte("otherkey")).Expect([]byte("othervalue"))
+		dstMock.Command("SET", []byte("mykey"), "myvalue").Expect("OK")
+
+		reply := serveRequest(t, handler, "*2\r\n$3\r\nGET\r\n$5\r\nmykey\r\n")
+		assert.Equal(t, "$7\r\nmyvalue\r\n", reply)
+
+		reply = serveRequest(t, handler, "*2\r\n$3\r\nGET\r\n$8\r\notherkey\r\n")
+		assert.Equal(t, "-"+defaultRateLimitMsg+"\r\n", reply)
+		assert.False(t, srcCmd.Called, "source should not be read beyond its rate limit")
+	})
+}
@@ -0,0 +1,193 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Ways of logging the arguments of a command
+const (
+	logPlain    = "plain"
+	logTruncate = "truncate"
+	logHash     = "hash"
+	logRedact   = "redact"
+)
+
+const (
+	redacted = "(redacted)"
+
+	defaultLogMaxLength = 64
+)
+
+// LoggingConfig holds the policy for logging the arguments of commands. The first
+// argument of a command, which is the key for most commands, is logged according to
+// Keys, and the other arguments according to Values. Either is one of:
+//   - "plain" to log it as is, the default
+//   - "truncate" to log at most MaxLength bytes of it
+//   - "hash" to log a hash of it, the same as the key hash of trace spans
+//   - "redact" to not log it at all
+//
+// Credentials, such as the password of AUTH, are never logged whatever the policy.
+type LoggingConfig struct {
+	Keys      string
+	Values    string
+	MaxLength int
+
+	// Commands overrides the policy for specific commands, by command name
+	Commands map[string]LogPolicy
+}
+
+// LogPolicy overrides the logging policy of a command. Empty fields are
+// left to the policy of LoggingConfig.
+type LogPolicy struct {
+	Keys   string
+	Values string
+}
+
+func (c LoggingConfig) validate(problems *ConfigError) {
+	validateLogMode("Logging.Keys", c.Keys, problems)
+	validateLogMode("Logging.Values", c.Values, problems)
+	for command, policy := range c.Commands {
+		validateLogMode("Logging.Commands."+command+".Keys", policy.Keys, problems)
+		validateLogMode("Logging.Commands."+command+".Values", policy.Values, problems)
+	}
+
+	if c.MaxLength < 0 {
+		problems.add("Logging.MaxLength must not be negative")
+	}
+}
+
+func validateLogMode(name, mode string, problems *ConfigError) {
+	switch mode {
+	case "", logPlain, logTruncate, logHash, logRedact:
+	default:
+		problems.add("%s %q is not one of %q, %q, %q or %q", name, mode, logPlain, logTruncate, logHash, logRedact)
+	}
+}
+
+// policy returns the policy for command, with its overrides applied
+func (c LoggingConfig) policy(command string) LogPolicy {
+	policy := LogPolicy{Keys: c.Keys, Values: c.Values}
+	for name, override := range c.Commands {
+		if !strings.EqualFold(name, command) {
+			continue
+		}
+		if override.Keys != "" {
+			policy.Keys = override.Keys
+		}
+		if override.Values != "" {
+			policy.Values = override.Values
+		}
+	}
+
+	return policy
+}
+
+// args returns the arguments of a command as they should be logged
+func (c LoggingConfig) args(cmdArgs [][]byte) []string {
+	if len(cmdArgs) == 0 {
+		return nil
+	}
+
+	command := strings.ToUpper(string(cmdArgs[0]))
+	policy := c.policy(command)
+	secret := secretArgs(command, cmdArgs)
+
+	logged := make([]string, len(cmdArgs))
+	logged[0] = string(cmdArgs[0])
+	for i := 1; i < len(cmdArgs); i++ {
+		mode := policy.Values
+		if i == 1 {
+			mode = policy.Keys
+		}
+		if secret[i] {
+			mode = logRedact
+		}
+		logged[i] = c.format(cmdArgs[i], mode)
+	}
+
+	return logged
+}
+
+// key returns key, the first argument of command, as it should be logged
+func (c LoggingConfig) key(command string, key []byte) string {
+	mode := c.policy(command).Keys
+	if secretArgs(command, [][]byte{[]byte(command), key})[1] {
+		// The first argument of AUTH is no key but a credential
+		mode = logRedact
+	}
+	return c.format(key, mode)
+}
+
+func (c LoggingConfig) format(arg []byte, mode string) string {
+	switch mode {
+	case logRedact:
+		return redacted
+	case logHash:
+		return "hash:" + keyHash(arg)
+	case logTruncate:
+		maxLength := c.MaxLength
+		if maxLength == 0 {
+			maxLength = defaultLogMaxLength
+		}
+		if len(arg) > maxLength {
+			return fmt.Sprintf("%s...(%d bytes)", arg[:maxLength], len(arg))
+		}
+	}
+
+	return string(arg)
+}
+
+// secretArgs returns the positions of the arguments of a command holding credentials
+func secretArgs(command string, cmdArgs [][]byte) map[int]bool {
+	secret := make(map[int]bool)
+	argIs := func(i int, name string) bool {
+		return i < len(cmdArgs) && strings.EqualFold(string(cmdArgs[i]), name)
+	}
+
+	switch command {
+	case "AUTH":
+		// AUTH [username] password
+		for i := 1; i < len(cmdArgs); i++ {
+			secret[i] = true
+		}
+
+	case "HELLO":
+		// HELLO [protover [AUTH username password] [SETNAME clientname]]
+		for i := 2; i < len(cmdArgs); i++ {
+			if argIs(i, "AUTH") {
+				secret[i+1], secret[i+2] = true, true
+			}
+		}
+
+	case "ACL":
+		// ACL SETUSER username [rule ...], where rules may hold passwords or their hashes
+		if argIs(1, "SETUSER") {
+			for i := 3; i < len(cmdArgs); i++ {
+				secret[i] = true
+			}
+		}
+
+	case "MIGRATE":
+		// MIGRATE ... [AUTH password | AUTH2 username password] [KEYS key ...]
+		for i := 6; i < len(cmdArgs); i++ {
+			if argIs(i, "AUTH") {
+				secret[i+1] = true
+			} else if argIs(i, "AUTH2") {
+				secret[i+1], secret[i+2] = true, true
+			}
+		}
+
+	case "CONFIG":
+		// CONFIG SET parameter value [parameter value ...]
+		if argIs(1, "SET") {
+			for i := 2; i+1 < len(cmdArgs); i += 2 {
+				if argIs(i, "requirepass") || argIs(i, "masterauth") || argIs(i, "masteruser") {
+					secret[i+1] = true
+				}
+			}
+		}
+	}
+
+	return secret
+}
@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggingConfig_args(t *testing.T) {
+	longValue := strings.Repeat("v", 100)
+
+	var tc = []struct {
+		name   string
+		config LoggingConfig
+		args   []string
+		logged []string
+	}{
+		{
+			"plain by default",
+			LoggingConfig{},
+			[]string{"SET", "mykey", "hello"},
+			[]string{"SET", "mykey", "hello"},
+		},
+		{
+			"AUTH password",
+			LoggingConfig{},
+			[]string{"auth", "foobared"},
+			[]string{"auth", redacted},
+		},
+		{
+			"AUTH username and password",
+			LoggingConfig{},
+			[]string{"AUTH", "default", "foobared"},
+			[]string{"AUTH", redacted, redacted},
+		},
+		{
+			"HELLO AUTH",
+			LoggingConfig{},
+			[]string{"HELLO", "3", "AUTH", "default", "foobared", "SETNAME", "app"},
+			[]string{"HELLO", "3", "AUTH", redacted, redacted, "SETNAME", "app"},
+		},
+		{
+			"ACL SETUSER rules",
+			LoggingConfig{},
+			[]string{"ACL", "SETUSER", "app", "on", ">foobared", "~*"},
+			[]string{"ACL", "SETUSER", "app", redacted, redacted, redacted},
+		},
+		{
+			"MIGRATE AUTH2",
+			LoggingConfig{},
+			[]string{"MIGRATE", "host", "6379", "", "0", "5000", "AUTH2", "default", "foobared", "KEYS", "mykey"},
+			[]string{"MIGRATE", "host", "6379", "", "0", "5000", "AUTH2", redacted, redacted, "KEYS", "mykey"},
+		},
+		{
+			"CONFIG SET requirepass",
+			LoggingConfig{},
+			[]string{"CONFIG", "SET", "maxmemory", "1gb", "requirepass", "foobared"},
+			[]string{"CONFIG", "SET", "maxmemory", "1gb", "requirepass", redacted},
+		},
+		{
+			"credentials whatever the policy",
+			LoggingConfig{Keys: logPlain, Values: logPlain, Commands: map[string]LogPolicy{"AUTH": {Keys: logPlain}}},
+			[]string{"AUTH", "foobared"},
+			[]string{"AUTH", redacted},
+		},
+		{
+			"hashed keys and redacted values",
+			LoggingConfig{Keys: logHash, Values: logRedact},
+			[]string{"SET", "mykey", "hello"},
+			[]string{"SET", "hash:" + keyHash([]byte("mykey")), redacted},
+		},
+		{
+			"truncated values",
+			LoggingConfig{Values: logTruncate, MaxLength: 4},
+			[]string{"SET", "mykey", "hello"},
+			[]string{"SET", "mykey", "hell...(5 bytes)"},
+		},
+		{
+			"truncated values with default length",
+			LoggingConfig{Values: logTruncate},
+			[]string{"SET", "mykey", longValue},
+			[]string{"SET", "mykey", longValue[:defaultLogMaxLength] + "...(100 bytes)"},
+		},
+		{
+			"policy overridden for a command",
+			LoggingConfig{Values: logRedact, Commands: map[string]LogPolicy{"get": {Keys: logHash}, "LPUSH": {Values: logPlain}}},
+			[]string{"LPUSH", "mylist", "a", "b"},
+			[]string{"LPUSH", "mylist", "a", "b"},
+		},
+	}
+
+	for _, tt := range tc {
+		args := make([][]byte, len(tt.args))
+		for i, arg := range tt.args {
+			args[i] = []byte(arg)
+		}
+
+		assert.Equal(t, tt.logged, tt.config.args(args), tt.name)
+	}
+}
+
+func TestLoggingConfig_key(t *testing.T) {
+	t.Run(`[When] the first argument of a command is logged as its key
+		   [Then] log it according to the policy of keys, unless it's a credential`, func(t *testing.T) {
+
+		config := LoggingConfig{Keys: logTruncate, MaxLength: 2}
+
+		assert.Equal(t, "my...(5 bytes)", config.key("GET", []byte("mykey")))
+		assert.Equal(t, redacted, config.key("AUTH", []byte("hunter2")), "password of AUTH should not be logged")
+		assert.Equal(t, "3", config.key("HELLO", []byte("3")))
+	})
+}
+
+func TestLoggingConfig_validate(t *testing.T) {
+	t.Run(`[Given] a logging policy with unknown modes
+		    [When] the configuration is validated
+		    [Then] returns error listing every unknown mode`, func(t *testing.T) {
+
+		config := LoggingConfig{
+			Keys:      "hide",
+			Values:    logTruncate,
+			MaxLength: -1,
+			Commands:  map[string]LogPolicy{"GET": {Values: "mask"}},
+		}
+
+		problems := &ConfigError{}
+		config.validate(problems)
+
+		assert.ElementsMatch(t, []string{
+			`Logging.Keys "hide" is not one of "plain", "truncate", "hash" or "redact"`,
+			`Logging.Commands.GET.Values "mask" is not one of "plain", "truncate", "hash" or "redact"`,
+			`Logging.MaxLength must not be negative`,
+		}, problems.Problems)
+	})
+}
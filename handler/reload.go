@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// settings holds the part of redisHandler derived from RedisConfig, which
+// is replaced as a whole when the configuration is reloaded.
+type settings struct {
+	config             RedisConfig
+	sourcePool         *redis.Pool
+	sourceRawPool      *redis.Pool
+	destinationPool    *redis.Pool
+	destinationRawPool *redis.Pool
+	sourceBreaker      *breaker
+	destinationBreaker *breaker
+	rateLimiter        *rateLimiter
+	clientFilter       clientFilter
+	deleteOnGet        bool
+	deleteOnSet        bool
+	password           string
+	accessLog          *accessLog
+
+	// version is incremented every time the configuration is reloaded
+	version  int
+	loadedAt time.Time
+
+	// inUse counts the commands being handled with these settings, so
+	// that replaced pools are only closed once nobody uses them anymore.
+	inUse sync.WaitGroup
+}
+
+// newSettings creates settings for config. Pools and circuit breakers of previous
+// whose client configuration didn't change are reused instead of being created anew.
+func newSettings(config RedisConfig, previous *settings) *settings {
+	s := &settings{
+		config:      config,
+		deleteOnGet: config.DeleteOnGet,
+		deleteOnSet: config.DeleteOnSet,
+		password:    config.Password,
+		version:     1,
+		loadedAt:    time.Now(),
+
+		clientFilter: newClientFilter(config.Clients),
+	}
+	if previous != nil {
+		s.version = previous.version + 1
+	}
+
+	if previous != nil && previous.config.Source == config.Source {
+		s.sourcePool = previous.sourcePool
+		s.sourceRawPool = previous.sourceRawPool
+		s.sourceBreaker = previous.sourceBreaker
+	} else {
+		s.sourceBreaker = newBreaker("source", config.Source.Breaker)
+		s.sourcePool = newRedisPool(config.Source, s.sourceBreaker)
+		s.sourceRawPool = newRawRedisPool(config.Source, s.sourceBreaker)
+	}
+
+	if previous != nil && previous.config.Destination == config.Destination {
+		s.destinationPool = previous.destinationPool
+		s.destinationRawPool = previous.destinationRawPool
+		s.destinationBreaker = previous.destinationBreaker
+	} else {
+		s.destinationBreaker = newBreaker("destination", config.Destination.Breaker)
+		s.destinationPool = newRedisPool(config.Destination, s.destinationBreaker)
+		s.destinationRawPool = newRawRedisPool(config.Destination, s.destinationBreaker)
+	}
+
+	// Rate limits are kept unless they changed, so that a reload doesn't refill buckets
+	if previous != nil && previous.config.RateLimit == config.RateLimit {
+		s.rateLimiter = previous.rateLimiter
+	} else {
+		s.rateLimiter = newRateLimiter(config.RateLimit)
+	}
+
+	if previous != nil && previous.config.AccessLog == config.AccessLog {
+		s.accessLog = previous.accessLog
+	} else {
+		s.accessLog = newAccessLog(config.AccessLog)
+	}
+
+	return s
+}
+
+// pools returns every pool held by s, keyed by a name suitable for logging and metrics
+func (s *settings) pools() map[string]*redis.Pool {
+	return map[string]*redis.Pool{
+		"source":          s.sourcePool,
+		"source_raw":      s.sourceRawPool,
+		"destination":     s.destinationPool,
+		"destination_raw": s.destinationRawPool,
+	}
+}
+
+// breakers returns the circuit breaker of each backend, nil if it's disabled
+func (s *settings) breakers() map[string]*breaker {
+	return map[string]*breaker{
+		"source":      s.sourceBreaker,
+		"destination": s.destinationBreaker,
+	}
+}
+
+// acquireSettings returns the current settings, which must be released
+// by calling inUse.Done() once the caller is done using them.
+func (r *redisHandler) acquireSettings() *settings {
+	r.settingsMu.RLock()
+	defer r.settingsMu.RUnlock()
+
+	r.settings.inUse.Add(1)
+	return r.settings
+}
+
+// Reload validates config and, if valid, replaces the handler settings with it
+// without interrupting client connections. Pools whose client configuration
+// changed, and the access log if its configuration changed, are closed after
+// the commands still using them have completed.
+// If config is invalid, the current settings are kept and an error is returned.
+func (r *redisHandler) Reload(config RedisConfig) error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	return r.reload(config)
+}
+
+// reload reloads the handler with config, see Reload. Reloads are serialized by
+// reloadMu, which must be held, so that a change derived from the current settings
+// can't undo a reload made meanwhile.
+func (r *redisHandler) reload(config RedisConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	r.settingsMu.Lock()
+	previous := r.settings
+	r.settings = newSettings(config, previous)
+	current := r.settings
+	r.settingsMu.Unlock()
+
+	if config.Degraded != previous.config.Degraded {
+		r.openQueueFile(config.Degraded)
+	}
+
+	// The file of the access log is reopened by its next record, so that
+	// a reload follows the access log being rotated
+	if current.accessLog != nil && current.accessLog == previous.accessLog {
+		if err := current.accessLog.Close(); err != nil {
+			log.WithField("context", "Reopening access log").Warn(err)
+		}
+	}
+
+	go func() {
+		previous.inUse.Wait()
+		for name, pool := range previous.pools() {
+			if current.pools()[name] == pool {
+				continue
+			}
+			if err := pool.Close(); err != nil {
+				log.WithField("context", "Closing replaced "+name+" pool").Warn(err)
+			}
+		}
+
+		if previous.accessLog != nil && previous.accessLog != current.accessLog {
+			if err := previous.accessLog.Close(); err != nil {
+				log.WithField("context", "Closing replaced access log").Warn(err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// ReloadConfig loads the configuration file at configPath and reloads handler
+// with it. The outcome is logged and recorded as a metric.
+func ReloadConfig(handler Handler, configPath string) error {
+	config, err := LoadConfig(configPath)
+	if err == nil {
+		err = handler.Reload(config)
+	}
+
+	recordConfigReload(err == nil)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"context": "Reloading configuration",
+			"path":    configPath,
+		}).Error(err)
+		return err
+	}
+
+	log.WithField("path", configPath).Info("Configuration has been reloaded")
+	return nil
+}
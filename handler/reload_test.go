@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_redisHandler_Reload(t *testing.T) {
+	config := RedisConfig{
+		DeleteOnGet: true,
+		Source:      ClientConfig{Addr: "redis-source:6379"},
+		Destination: ClientConfig{Addr: "redis-destination:6379"},
+	}
+
+	t.Run(`[Given] an invalid configuration
+		    [When] the handler is reloaded
+		    [Then] returns error
+		     [And] keep the current settings`, func(t *testing.T) {
+
+		handler := NewRedisHandler(config).(*redisHandler)
+		previous := handler.settings
+
+		err := handler.Reload(RedisConfig{DeleteOnSet: true})
+
+		assert.Error(t, err, "reload should return error")
+		assert.True(t, previous == handler.settings, "settings should not be replaced")
+	})
+
+	t.Run(`[Given] a valid configuration changing only "destination" client configuration
+		    [When] the handler is reloaded
+		    [Then] replace the settings
+		     [And] keep the "source" pool
+		     [And] close the previous "destination" pools once they are no longer in use`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.config = config
+		previous := handler.acquireSettings()
+
+		newConfig := config
+		newConfig.DeleteOnGet = false
+		newConfig.Destination.Addr = "redis-new-destination:6379"
+		err := handler.Reload(newConfig)
+
+		assert.NoError(t, err, "reload should not return error")
+		assert.False(t, handler.settings.deleteOnGet, "deleteOnGet should be updated")
+		assert.True(t, previous.sourcePool == handler.settings.sourcePool, "source pool should be reused")
+		assert.False(t, previous.destinationPool == handler.settings.destinationPool, "destination pool should be replaced")
+
+		time.Sleep(10 * time.Millisecond)
+		assert.NoError(t, previous.destinationPool.Get().Err(), "previous destination pool should be open while in use")
+
+		previous.inUse.Done()
+		time.Sleep(10 * time.Millisecond)
+		assert.Error(t, previous.destinationPool.Get().Err(), "previous destination pool should be closed")
+		assert.Error(t, previous.destinationRawPool.Get().Err(), "previous raw destination pool should be closed")
+	})
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"github.com/gomodule/redigo/redis"
+	"github.com/tidwall/redcon"
+)
+
+// replyRecorder is a redcon.Conn which keeps track of the reply written to the client
+type replyRecorder struct {
+	redcon.Conn
+
+	// replyType is the RESP type byte of the first reply written, or 0
+	// if no reply has been written yet
+	replyType byte
+
+	// errorMsg is the message of the first reply written, if it's an error
+	errorMsg string
+}
+
+func (r *replyRecorder) record(replyType byte) {
+	if r.replyType == 0 {
+		r.replyType = replyType
+	}
+}
+
+// failed reports whether the reply written is an error
+func (r *replyRecorder) failed() bool {
+	return r.replyType == '-'
+}
+
+// err returns the error replied, if any
+func (r *replyRecorder) err() error {
+	if !r.failed() {
+		return nil
+	}
+	return redis.Error(r.errorMsg)
+}
+
+func (r *replyRecorder) WriteError(msg string) {
+	if r.replyType == 0 {
+		r.errorMsg = msg
+	}
+	r.record('-')
+	r.Conn.WriteError(msg)
+}
+
+func (r *replyRecorder) WriteString(str string) {
+	r.record('+')
+	r.Conn.WriteString(str)
+}
+
+func (r *replyRecorder) WriteBulk(bulk []byte) {
+	r.record('$')
+	r.Conn.WriteBulk(bulk)
+}
+
+func (r *replyRecorder) WriteBulkString(bulk string) {
+	r.record('$')
+	r.Conn.WriteBulkString(bulk)
+}
+
+func (r *replyRecorder) WriteInt(num int) {
+	r.record(':')
+	r.Conn.WriteInt(num)
+}
+
+func (r *replyRecorder) WriteInt64(num int64) {
+	r.record(':')
+	r.Conn.WriteInt64(num)
+}
+
+func (r *replyRecorder) WriteArray(count int) {
+	r.record('*')
+	r.Conn.WriteArray(count)
+}
+
+func (r *replyRecorder) WriteNull() {
+	r.record('$')
+	r.Conn.WriteNull()
+}
+
+func (r *replyRecorder) WriteRaw(data []byte) {
+	if r.replyType == 0 {
+		if err := replyError(data); err != nil {
+			r.errorMsg = err.Error()
+		}
+	}
+	if len(data) > 0 {
+		r.record(data[0])
+	}
+	r.Conn.WriteRaw(data)
+}
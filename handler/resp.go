@@ -0,0 +1,376 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var errProtocol = errors.New("malformed RESP reply")
+
+// copyReply reads exactly one RESP reply from src and writes it to dst byte-for-byte.
+// The reply is never decoded into values, its type prefixes and lengths are only
+// inspected as far as needed to know where the reply ends. Both RESP2 and RESP3
+// reply types are supported.
+func copyReply(dst io.Writer, src *bufio.Reader) error {
+	line, err := copyLine(dst, src)
+	if err != nil {
+		return err
+	}
+	if len(line) < 3 {
+		return errProtocol
+	}
+
+	switch line[0] {
+	case '+', '-', ':', '_', ',', '#', '(':
+		return nil
+
+	case '$', '=', '!':
+		n, err := parseReplyLen(line)
+		if err != nil || n < 0 {
+			return err
+		}
+		_, err = io.CopyN(dst, src, int64(n)+2)
+		return err
+
+	case '*', '~', '>', '%', '|':
+		n, err := parseReplyLen(line)
+		if err != nil || n < 0 {
+			return err
+		}
+		if line[0] == '%' || line[0] == '|' {
+			n *= 2
+		}
+		// An attribute is followed by the reply it describes.
+		if line[0] == '|' {
+			n++
+		}
+		for i := 0; i < n; i++ {
+			if err := copyReply(dst, src); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return errProtocol
+	}
+}
+
+// copyLine copies a single CRLF terminated line from src to dst and returns it.
+// The returned slice is only valid until the next read from src.
+func copyLine(dst io.Writer, src *bufio.Reader) ([]byte, error) {
+	line, err := src.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Simple strings and errors may exceed the reader buffer, in which case
+		// only the head of the line is kept for inspecting the reply type.
+		head := append([]byte(nil), line...)
+		if _, err := dst.Write(line); err != nil {
+			return nil, err
+		}
+		for err == bufio.ErrBufferFull {
+			line, err = src.ReadSlice('\n')
+			if _, werr := dst.Write(line); werr != nil {
+				return nil, werr
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append(head[:1], "\r\n"...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+
+	_, err = dst.Write(line)
+	return line, err
+}
+
+func parseReplyLen(line []byte) (int, error) {
+	n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+	if err != nil || n < -1 {
+		return 0, errProtocol
+	}
+
+	return n, nil
+}
+
+// rawConn is an implementation of redis.Conn which, instead of parsing replies into
+// Go values, returns every reply as the exact RESP bytes sent by the Redis server.
+// Error replies are returned as bytes as well, not as redis.Error, so that they can
+// be forwarded to clients unchanged.
+type rawConn struct {
+	conn         net.Conn
+	br           *bufio.Reader
+	bw           *bufio.Writer
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+
+	mu      sync.Mutex
+	pending int
+	err     error
+}
+
+// dialRaw connects to the Redis server of config and returns a rawConn,
+// authenticating the connection first if a password is given.
+func dialRaw(config ClientConfig) (redis.Conn, error) {
+	netConn, err := net.DialTimeout("tcp", config.Addr, config.ConnectTimeout.Duration)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &rawConn{
+		conn:         netConn,
+		br:           bufio.NewReader(netConn),
+		bw:           bufio.NewWriter(netConn),
+		readTimeout:  config.ReadTimeout.Duration,
+		writeTimeout: config.WriteTimeout.Duration,
+	}
+
+	if config.Password != "" {
+		reply, err := redis.Bytes(c.Do("AUTH", config.Password))
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if err := replyError(reply); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// replyError returns the error carried by a raw error reply, or nil if the reply is
+// not an error reply.
+func replyError(reply []byte) error {
+	if len(reply) == 0 || reply[0] != '-' {
+		return nil
+	}
+
+	return redis.Error(bytes.TrimRight(reply[1:], "\r\n"))
+}
+
+func (c *rawConn) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = errors.New("redigo: closed")
+	}
+	c.mu.Unlock()
+
+	return c.conn.Close()
+}
+
+func (c *rawConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+func (c *rawConn) fatal(err error) error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+
+	return err
+}
+
+func (c *rawConn) Send(cmd string, args ...interface{}) error {
+	c.mu.Lock()
+	c.pending++
+	c.mu.Unlock()
+
+	if c.writeTimeout != 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	if err := writeCommand(c.bw, cmd, args); err != nil {
+		return c.fatal(err)
+	}
+
+	return nil
+}
+
+func (c *rawConn) Flush() error {
+	if c.writeTimeout != 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	if err := c.bw.Flush(); err != nil {
+		return c.fatal(err)
+	}
+
+	return nil
+}
+
+func (c *rawConn) Receive() (interface{}, error) {
+	return c.ReceiveWithTimeout(c.readTimeout)
+}
+
+func (c *rawConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	reply, err := c.readReply(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.pending > 0 {
+		c.pending--
+	}
+	c.mu.Unlock()
+
+	return reply, nil
+}
+
+func (c *rawConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoWithTimeout(c.readTimeout, cmd, args...)
+}
+
+func (c *rawConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	if cmd != "" {
+		if err := c.Send(cmd, args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = 0
+	c.mu.Unlock()
+
+	// Replies of previously sent commands are discarded, only the reply of
+	// the last command is returned.
+	var reply interface{}
+	for i := 0; i < pending; i++ {
+		var err error
+		if reply, err = c.readReply(timeout); err != nil {
+			return nil, err
+		}
+	}
+	if cmd == "" {
+		return nil, nil
+	}
+
+	return reply, nil
+}
+
+// DoContext sends a command like Do, giving up once ctx is done, see withContext
+func (c *rawConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return c.withContext(ctx, func(timeout time.Duration) (interface{}, error) {
+		return c.DoWithTimeout(timeout, cmd, args...)
+	})
+}
+
+// ReceiveContext receives a reply like Receive, giving up once ctx is done, see withContext
+func (c *rawConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return c.withContext(ctx, c.ReceiveWithTimeout)
+}
+
+// withContext calls read, waiting for the reply until the deadline of ctx if it's
+// sooner than the read timeout. The connection is closed if ctx is done before
+// the reply is read, as the reply would otherwise be read as the one of the next
+// command.
+func (c *rawConn) withContext(ctx context.Context, read func(timeout time.Duration) (interface{}, error)) (interface{}, error) {
+	timeout := c.readTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, c.fatal(context.DeadlineExceeded)
+		}
+		if timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, err := read(timeout)
+		done <- result{reply, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, c.fatal(ctx.Err())
+	case r := <-done:
+		if r.err != nil && contextErr(ctx) != nil {
+			// The read deadline, set to the one of ctx, may expire first
+			return nil, contextErr(ctx)
+		}
+		return r.reply, r.err
+	}
+}
+
+func (c *rawConn) readReply(timeout time.Duration) ([]byte, error) {
+	var deadline time.Time
+	if timeout != 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	c.conn.SetReadDeadline(deadline)
+
+	var buf bytes.Buffer
+	if err := copyReply(&buf, c.br); err != nil {
+		return nil, c.fatal(err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeCommand(w *bufio.Writer, cmd string, args []interface{}) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args)+1)
+	writeBulk(w, []byte(cmd))
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case []byte:
+			writeBulk(w, arg)
+		case string:
+			writeBulk(w, []byte(arg))
+		case int:
+			writeBulk(w, strconv.AppendInt(nil, int64(arg), 10))
+		case int64:
+			writeBulk(w, strconv.AppendInt(nil, arg, 10))
+		case float64:
+			writeBulk(w, strconv.AppendFloat(nil, arg, 'g', -1, 64))
+		case nil:
+			writeBulk(w, nil)
+		default:
+			writeBulk(w, []byte(fmt.Sprint(arg)))
+		}
+	}
+
+	// bufio.Writer keeps the first write error, so checking it once is enough.
+	_, err := w.Write(nil)
+	return err
+}
+
+func writeBulk(w *bufio.Writer, b []byte) {
+	fmt.Fprintf(w, "$%d\r\n", len(b))
+	w.Write(b)
+	w.WriteString("\r\n")
+}
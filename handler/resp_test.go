@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_copyReply(t *testing.T) {
+	var tc = []string{
+		"+OK\r\n",
+		"+\r\n",
+		"-ERR unknown command 'FOO'\r\n",
+		":-42\r\n",
+		"$-1\r\n",
+		"$0\r\n\r\n",
+		"$2\r\n-5\r\n",
+		"$11\r\n*important*\r\n",
+		"$6\r\nfoo\r\nx\r\n",
+		"*-1\r\n",
+		"*0\r\n",
+		"*3\r\n$3\r\nfoo\r\n:1\r\n*1\r\n$-1\r\n",
+		"_\r\n",
+		",3.14\r\n",
+		"#t\r\n",
+		"(3492890328409238509324850943850943825024385\r\n",
+		"=15\r\ntxt:Some string\r\n",
+		"%1\r\n+key\r\n:1\r\n",
+		"~2\r\n+a\r\n+b\r\n",
+		">2\r\n+message\r\n$2\r\nhi\r\n",
+		"|1\r\n+ttl\r\n:3600\r\n$3\r\nfoo\r\n",
+		"+" + strings.Repeat("x", 10000) + "\r\n",
+	}
+
+	t.Run(`[Given] a stream holding a RESP reply followed by another reply
+		    [When] the first reply is copied
+		    [Then] exactly the bytes of the first reply are written`, func(t *testing.T) {
+
+		for _, reply := range tc {
+			src := bufio.NewReader(strings.NewReader(reply + "+NEXT\r\n"))
+
+			var dst bytes.Buffer
+			err := copyReply(&dst, src)
+
+			assert.NoError(t, err, "copying %q should not fail", reply)
+			assert.Equal(t, reply, dst.String(), "copied reply should be equal to the original")
+
+			rest, _ := ioutil.ReadAll(src)
+			assert.Equal(t, "+NEXT\r\n", string(rest), "following reply should be left unread")
+		}
+	})
+
+	t.Run(`[Given] a stream holding a malformed RESP reply
+		    [When] the reply is copied
+		    [Then] returns error`, func(t *testing.T) {
+
+		for _, reply := range []string{"?\r\n", "$abc\r\n", "*-2\r\n", "+OK\n", "$5\r\nab"} {
+			err := copyReply(ioutil.Discard, bufio.NewReader(strings.NewReader(reply)))
+			assert.Error(t, err, "copying %q should fail", reply)
+		}
+	})
+}
+
+// respReply is an arbitrary RESP encoded reply, generated for property based testing.
+type respReply []byte
+
+func (respReply) Generate(rand *rand.Rand, size int) reflect.Value {
+	var buf bytes.Buffer
+	generateReply(&buf, rand, 3)
+	return reflect.ValueOf(respReply(buf.Bytes()))
+}
+
+func generateReply(buf *bytes.Buffer, rand *rand.Rand, depth int) {
+	// Payloads deliberately include RESP type prefixes and line breaks
+	const alphabet = "+-:$*_,#(=!%~>|\r\nabc0123456789 "
+	randomText := func(n int, crlf bool) []byte {
+		text := make([]byte, n)
+		for i := range text {
+			text[i] = alphabet[rand.Intn(len(alphabet))]
+			for !crlf && (text[i] == '\r' || text[i] == '\n') {
+				text[i] = alphabet[rand.Intn(len(alphabet))]
+			}
+		}
+		return text
+	}
+
+	kind := rand.Intn(6)
+	if depth == 0 {
+		kind = rand.Intn(4)
+	}
+
+	switch kind {
+	case 0:
+		fmt.Fprintf(buf, "+%s\r\n", randomText(rand.Intn(20), false))
+	case 1:
+		fmt.Fprintf(buf, "-%s\r\n", randomText(rand.Intn(20), false))
+	case 2:
+		fmt.Fprintf(buf, ":%d\r\n", rand.Int63()-rand.Int63())
+	case 3:
+		text := randomText(rand.Intn(64), true)
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(text), text)
+	case 4:
+		buf.WriteString("$-1\r\n")
+	default:
+		n := rand.Intn(5)
+		fmt.Fprintf(buf, "*%d\r\n", n)
+		for i := 0; i < n; i++ {
+			generateReply(buf, rand, depth-1)
+		}
+	}
+}
+
+func Test_redisHandler_ForwardRaw(t *testing.T) {
+	t.Run(`[Given] "destination" replies with an arbitrary RESP reply
+		    [When] a request is forwarded to "destination"
+		    [Then] the reply received by the client is byte-for-byte equal to the reply of "destination"`, func(t *testing.T) {
+
+		replies := make(chan []byte)
+		backend, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer backend.Close()
+		go serveReplies(backend, replies)
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.destinationRawPool = newRawRedisPool(ClientConfig{Addr: backend.Addr().String()}, nil)
+
+		fatal := make(chan error)
+		signal := make(chan error)
+		s := NewServer("127.0.0.1:0", handler)
+		go func() {
+			defer s.Close()
+
+			if err := s.ListenServeAndSignal(signal); err != nil {
+				fatal <- err
+			}
+		}()
+
+		done := make(chan bool)
+		go func() {
+			defer func() {
+				done <- true
+			}()
+
+			err := <-signal
+			if err != nil {
+				fatal <- err
+			}
+
+			client, err := net.Dial("tcp", s.Addr().String())
+			if err != nil {
+				fatal <- err
+			}
+			defer client.Close()
+			clientReader := bufio.NewReader(client)
+
+			forwardsVerbatim := func(reply respReply) bool {
+				go func() { replies <- reply }()
+
+				if _, err := client.Write([]byte("*2\r\n$4\r\nLPOP\r\n$5\r\nmykey\r\n")); err != nil {
+					return false
+				}
+
+				var received bytes.Buffer
+				if err := copyReply(&received, clientReader); err != nil {
+					return false
+				}
+
+				return bytes.Equal(reply, received.Bytes())
+			}
+
+			assert.NoError(t, quick.Check(forwardsVerbatim, &quick.Config{MaxCount: 500}))
+		}()
+
+		waitForComplete(t, done, fatal)
+	})
+}
+
+func Test_redisHandler_HandleSUBSCRIBE(t *testing.T) {
+	t.Run(`[Given] "destination" is reached through its raw pool
+		    [When] a client subscribes to a channel, then closes its connection
+		    [Then] reply an error without subscribing to "destination", rather than hanging`, func(t *testing.T) {
+
+		replies := make(chan []byte, 1)
+		replies <- []byte("*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+		backend, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer backend.Close()
+		go serveReplies(backend, replies)
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.destinationRawPool = newRawRedisPool(ClientConfig{Addr: backend.Addr().String()}, nil)
+
+		reply := make(chan string)
+		go func() { reply <- serveRequest(t, handler, "*2\r\n$9\r\nSUBSCRIBE\r\n$4\r\nnews\r\n") }()
+
+		select {
+		case r := <-reply:
+			assert.Equal(t, "-ERR 'subscribe' is not supported by remiro\r\n", r)
+		case <-time.After(3 * time.Second):
+			t.Fatal("SUBSCRIBE should not hang")
+		}
+		assert.Zero(t, handler.settings.destinationRawPool.ActiveCount(), "no connection to destination should be left")
+	})
+}
+
+func Test_rawConn_DoContext(t *testing.T) {
+	t.Run(`[Given] a Redis server which doesn't reply
+		    [When] a command is sent with a context which times out
+		    [Then] give up on the reply and close the connection`, func(t *testing.T) {
+
+		backend, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer backend.Close()
+		go serveReplies(backend, make(chan []byte))
+
+		conn, err := dialRaw(ClientConfig{Addr: backend.Addr().String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err = redis.DoContext(conn, ctx, "GET", "mykey")
+
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.Error(t, conn.Err(), "connection should not be usable anymore")
+	})
+}
+
+// serveReplies accepts connections on listener, answering every command
+// received with the next reply taken from replies.
+func serveReplies(listener net.Listener, replies chan []byte) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			reader := bufio.NewReader(conn)
+			for {
+				if err := copyReply(ioutil.Discard, reader); err != nil {
+					return
+				}
+				if _, err := conn.Write(<-replies); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
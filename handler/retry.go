@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultRetryBackoff    = 10 * time.Millisecond
+	defaultRetryMaxBackoff = time.Second
+)
+
+// defaultRetryOn are the causes of errors retried when RetryConfig.RetryOn is not set
+var defaultRetryOn = []string{errorClassNetwork, errorClassTimeout}
+
+// retryableClasses are the causes of errors which may be retried, see the errorClass* constants
+var retryableClasses = []string{errorClassNetwork, errorClassTimeout, errorClassPoolExhausted}
+
+// readOnlyCommands are the commands which are retried when proxied to "destination",
+// as sending them twice is harmless, and which are served by "source" in degraded
+// mode. Writes are never retried, as a write which failed may still have been
+// applied, e.g. INCR would then be applied twice, except writes queued in
+// degraded mode, which are replayed at least once, see replay.
+var readOnlyCommands = map[string]bool{
+	"BITCOUNT": true, "BITPOS": true, "DBSIZE": true, "ECHO": true, "EXISTS": true,
+	"GET": true, "GETBIT": true, "GETRANGE": true, "HEXISTS": true, "HGET": true,
+	"HGETALL": true, "HKEYS": true, "HLEN": true, "HMGET": true, "HSCAN": true,
+	"HSTRLEN": true, "HVALS": true, "LINDEX": true, "LLEN": true, "LRANGE": true,
+	"MGET": true, "PFCOUNT": true, "PTTL": true, "SCAN": true, "SCARD": true,
+	"SDIFF": true, "SINTER": true, "SISMEMBER": true, "SMEMBERS": true, "SRANDMEMBER": true,
+	"SSCAN": true, "STRLEN": true, "SUNION": true, "TTL": true, "TYPE": true,
+	"ZCARD": true, "ZCOUNT": true, "ZLEXCOUNT": true, "ZRANGE": true, "ZRANGEBYLEX": true,
+	"ZRANGEBYSCORE": true, "ZRANK": true, "ZREVRANGE": true, "ZREVRANGEBYSCORE": true, "ZREVRANK": true,
+	"ZSCAN": true, "ZSCORE": true,
+}
+
+// RetryConfig holds the retry policy of idempotent commands: reads, and the
+// commands migrating keys from "source" to "destination". Writes of clients
+// are never retried.
+type RetryConfig struct {
+	// Attempts is the maximum number of times a command is sent, the first
+	// time included. Commands aren't retried if it's not set.
+	Attempts int
+
+	// Backoff is the time waited before the first retry, doubled for every
+	// retry after it up to MaxBackoff. The time actually waited is picked at
+	// random between half and all of it, so that retries of many commands
+	// are spread out. Backoff defaults to 10ms and MaxBackoff to 1s.
+	Backoff    duration
+	MaxBackoff duration
+
+	// RetryOn lists the causes of errors which are retried, among "network",
+	// "timeout" and "pool_exhausted". It defaults to "network" and "timeout".
+	RetryOn []string
+}
+
+func (c RetryConfig) validate(problems *ConfigError) {
+	if c.Attempts < 0 {
+		problems.add("Retry.Attempts must not be negative")
+	}
+	if c.Backoff.Duration < 0 {
+		problems.add("Retry.Backoff must not be negative")
+	}
+	if c.MaxBackoff.Duration < 0 {
+		problems.add("Retry.MaxBackoff must not be negative")
+	}
+	for _, class := range c.RetryOn {
+		if !containsString(retryableClasses, class) {
+			problems.add("Retry.RetryOn %q is not one of %q", class, retryableClasses)
+		}
+	}
+}
+
+func (c RetryConfig) retryable(err error) bool {
+	retryOn := c.RetryOn
+	if retryOn == nil {
+		retryOn = defaultRetryOn
+	}
+	return containsString(retryOn, classifyError(err))
+}
+
+// backoff returns the time to wait before retrying a command for the retry-th time
+func (c RetryConfig) backoff(retry int) time.Duration {
+	backoff, maxBackoff := c.Backoff.Duration, c.MaxBackoff.Duration
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+
+	for i := 1; i < retry && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// doWithRetry sends an idempotent command using a connection of the pool named pool,
+// see pools, and retries it according to the retry policy. Every attempt uses a
+// connection of its own, as a connection which failed can't be used anymore.
+func (s *settings) doWithRetry(ctx context.Context, pool, command string, args ...interface{}) (interface{}, error) {
+	target, policy := poolTarget(pool), s.config.Retry
+
+	for attempt := 1; ; attempt++ {
+		conn := s.getConn(ctx, pool)
+		reply, err := s.do(ctx, conn, target, command, args...)
+		conn.Close()
+
+		if attempt > 1 && !givenUp(ctx, err) {
+			go recordRetry(target, command, err == nil)
+		}
+		if err == nil || attempt >= policy.Attempts || contextErr(ctx) != nil || !policy.retryable(err) {
+			return reply, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, contextErr(ctx)
+		case <-time.After(policy.backoff(attempt)):
+		}
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryConfig_backoff(t *testing.T) {
+	config := RetryConfig{Backoff: duration{10 * time.Millisecond}, MaxBackoff: duration{50 * time.Millisecond}}
+
+	var tc = []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{1, 5 * time.Millisecond, 10 * time.Millisecond},
+		{2, 10 * time.Millisecond, 20 * time.Millisecond},
+		{3, 20 * time.Millisecond, 40 * time.Millisecond},
+		{4, 25 * time.Millisecond, 50 * time.Millisecond},
+		{10, 25 * time.Millisecond, 50 * time.Millisecond},
+	}
+
+	t.Run(`[When] the backoff of a retry is computed
+		   [Then] double it for every retry up to MaxBackoff, with jitter`, func(t *testing.T) {
+
+		for _, tt := range tc {
+			for i := 0; i < 20; i++ {
+				backoff := config.backoff(tt.retry)
+
+				assert.True(t, backoff >= tt.min && backoff <= tt.max,
+					"backoff of retry %d should be within [%s, %s], got %s", tt.retry, tt.min, tt.max, backoff)
+			}
+		}
+	})
+}
+
+func TestRetryConfig_retryable(t *testing.T) {
+	netErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	t.Run(`[Given] the default retry policy
+		   [When] errors are checked for being retryable
+		   [Then] only network errors and timeouts are retried`, func(t *testing.T) {
+
+		config := RetryConfig{}
+
+		assert.True(t, config.retryable(netErr))
+		assert.True(t, config.retryable(context.DeadlineExceeded))
+		assert.False(t, config.retryable(redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")))
+		assert.False(t, config.retryable(context.Canceled))
+		assert.False(t, config.retryable(unavailableError{"destination"}))
+		assert.False(t, config.retryable(poolExhaustedError{pool: "destination"}))
+	})
+
+	t.Run(`[Given] a retry policy retrying exhausted pools only
+		   [When] errors are checked for being retryable
+		   [Then] only exhausted pools are retried`, func(t *testing.T) {
+
+		config := RetryConfig{RetryOn: []string{errorClassPoolExhausted}}
+
+		assert.True(t, config.retryable(poolExhaustedError{pool: "destination"}))
+		assert.False(t, config.retryable(netErr))
+	})
+}
+
+func TestRetryConfig_validate(t *testing.T) {
+	t.Run(`[When] a retry policy is validated
+		   [Then] returns error if attempts or backoffs are negative, or causes are unknown`, func(t *testing.T) {
+
+		problems := &ConfigError{}
+		RetryConfig{Attempts: -1, Backoff: duration{-time.Second}, RetryOn: []string{"network", "auth"}}.validate(problems)
+
+		assert.Len(t, problems.Problems, 3, "every problem should be reported")
+
+		problems = &ConfigError{}
+		RetryConfig{Attempts: 3, RetryOn: []string{"network", "pool_exhausted"}}.validate(problems)
+
+		assert.Empty(t, problems.Problems)
+	})
+}
+
+func Test_settings_doWithRetry(t *testing.T) {
+	t.Run(`[Given] "source" failing with a network error once
+		    [When] a read is sent with a retry policy of 3 attempts
+		    [Then] retry it and return the reply`, func(t *testing.T) {
+
+		handler, srcMock, _ := initHandlerMock()
+		s := handler.settings
+		s.config.Retry = RetryConfig{Attempts: 3, Backoff: duration{time.Millisecond}}
+		dials := flakyDial(s.sourcePool, 1, srcMock)
+		srcMock.Command("GET", "mykey").Expect([]byte("myvalue"))
+
+		reply, err := redis.String(s.doWithRetry(context.Background(), "source", "GET", "mykey"))
+
+		assert.NoError(t, err)
+		assert.Equal(t, "myvalue", reply)
+		assert.Equal(t, 2, *dials, "command should be sent twice")
+	})
+
+	t.Run(`[Given] "source" failing with network errors
+		    [When] a read is sent with a retry policy of 3 attempts
+		    [Then] give up after the third attempt`, func(t *testing.T) {
+
+		handler, srcMock, _ := initHandlerMock()
+		s := handler.settings
+		s.config.Retry = RetryConfig{Attempts: 3, Backoff: duration{time.Millisecond}}
+		dials := flakyDial(s.sourcePool, 10, srcMock)
+
+		_, err := s.doWithRetry(context.Background(), "source", "GET", "mykey")
+
+		assert.Equal(t, errorClassNetwork, classifyError(err))
+		assert.Equal(t, 3, *dials, "command should be sent three times")
+	})
+
+	t.Run(`[Given] no retry policy
+		    [When] a read fails with a network error
+		    [Then] don't retry it`, func(t *testing.T) {
+
+		handler, srcMock, _ := initHandlerMock()
+		s := handler.settings
+		dials := flakyDial(s.sourcePool, 1, srcMock)
+
+		_, err := s.doWithRetry(context.Background(), "source", "GET", "mykey")
+
+		assert.Error(t, err)
+		assert.Equal(t, 1, *dials, "command should be sent once")
+	})
+
+	t.Run(`[Given] a retry policy of 3 attempts
+		    [When] a read fails with an error reply
+		    [Then] don't retry it`, func(t *testing.T) {
+
+		handler, srcMock, _ := initHandlerMock()
+		s := handler.settings
+		s.config.Retry = RetryConfig{Attempts: 3, Backoff: duration{time.Millisecond}}
+		cmd := srcMock.Command("GET", "mykey").ExpectError(redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value"))
+
+		_, err := s.doWithRetry(context.Background(), "source", "GET", "mykey")
+
+		assert.Error(t, err)
+		assert.Equal(t, 1, srcMock.Stats(cmd), "command should be sent once")
+	})
+}
+
+func Test_redisHandler_HandleGET_retry(t *testing.T) {
+	t.Run(`[Given] "source" failing with a network error once while a key is migrated
+		    [When] a GET request is received with a retry policy of 2 attempts
+		    [Then] retry reading the key from "source" and copy it to "destination"`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+		handler.settings.config.Retry = RetryConfig{Attempts: 2, Backoff: duration{time.Millisecond}}
+		flakyDial(handler.settings.sourcePool, 1, srcMock)
+
+		dstMock.Command("GET", []byte("mykey")).Expect(nil)
+		srcMock.Command("GET", []byte("mykey")).Expect([]byte("myvalue"))
+		setCmd := dstMock.Command("SET", []byte("mykey"), "myvalue").Expect("OK")
+
+		reply := serveRequest(t, handler, "*2\r\n$3\r\nGET\r\n$5\r\nmykey\r\n")
+
+		assert.Equal(t, "$7\r\nmyvalue\r\n", reply)
+		assert.True(t, setCmd.Called, "key should be copied to destination")
+	})
+}
+
+func Test_redisHandler_HandleDefault_retry(t *testing.T) {
+	t.Run(`[Given] "destination" failing with a network error once
+		    [When] a read request is received with a retry policy of 2 attempts
+		    [Then] retry it`, func(t *testing.T) {
+
+		handler, _, dstMock := initHandlerMock()
+		handler.settings.config.Retry = RetryConfig{Attempts: 2, Backoff: duration{time.Millisecond}}
+		dials := flakyDial(handler.settings.destinationRawPool, 1, dstMock)
+		dstMock.Command("TTL", []byte("mykey")).Expect([]byte(":10\r\n"))
+
+		reply := serveRequest(t, handler, "*2\r\n$3\r\nTTL\r\n$5\r\nmykey\r\n")
+
+		assert.Equal(t, ":10\r\n", reply)
+		assert.Equal(t, 2, *dials, "command should be sent twice")
+	})
+
+	t.Run(`[Given] "destination" failing with a network error once
+		    [When] an INCR request is received with a retry policy of 2 attempts
+		    [Then] don't retry it, as it isn't idempotent`, func(t *testing.T) {
+
+		handler, _, dstMock := initHandlerMock()
+		handler.settings.config.Retry = RetryConfig{Attempts: 2, Backoff: duration{time.Millisecond}}
+		dials := flakyDial(handler.settings.destinationRawPool, 1, dstMock)
+		incrCmd := dstMock.Command("INCR", []byte("mykey")).Expect([]byte(":1\r\n"))
+
+		reply := serveRequest(t, handler, "*2\r\n$4\r\nINCR\r\n$5\r\nmykey\r\n")
+
+		assert.Equal(t, "-Unexpected server error\r\n", reply)
+		assert.Equal(t, 1, *dials, "command should be sent once")
+		assert.False(t, incrCmd.Called, "INCR should not be sent again")
+	})
+}
+
+// flakyDial makes the connections of pool fail to be dialed failures times with a
+// network error before dialing mock, returning the number of times it was dialed
+func flakyDial(pool *redis.Pool, failures int, mock *redigomock.Conn) *int {
+	dials := 0
+	pool.Dial = func() (redis.Conn, error) {
+		dials++
+		if dials <= failures {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}
+		return contextConn{mock}, nil
+	}
+	return &dials
+}
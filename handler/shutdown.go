@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errShutdownMsg is replied to commands received after the handler has shut down
+var errShutdownMsg = "ERR remiro is shutting down"
+
+// activity keeps track of the commands being handled, so that a shutdown
+// can wait for them to complete.
+type activity struct {
+	mu       sync.Mutex
+	inFlight int
+	draining bool
+	stopped  bool
+	idle     chan struct{}
+	stopCh   chan struct{}
+}
+
+// begin registers a command as in-flight. It returns false if the command
+// must not be handled because the handler has already stopped.
+func (a *activity) begin() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.stopped {
+		return false
+	}
+	a.inFlight++
+	return true
+}
+
+// end marks an in-flight command as completed.
+func (a *activity) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.inFlight--
+	if a.draining && a.inFlight == 0 && a.idle != nil {
+		close(a.idle)
+		a.idle = nil
+	}
+}
+
+// isDraining reports whether a shutdown has been requested.
+func (a *activity) isDraining() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.draining
+}
+
+// drain flags the activity as draining and returns a channel which is closed
+// once no more commands are in-flight.
+func (a *activity) drain() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.draining = true
+	idle := make(chan struct{})
+	if a.inFlight == 0 {
+		close(idle)
+	} else {
+		a.idle = idle
+	}
+	return idle
+}
+
+// stop prevents any further command from being handled.
+func (a *activity) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.stopped {
+		a.stopped = true
+		if a.stopCh != nil {
+			close(a.stopCh)
+		}
+	}
+}
+
+// done returns a channel which is closed once the activity has stopped.
+func (a *activity) done() <-chan struct{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.stopCh == nil {
+		a.stopCh = make(chan struct{})
+		if a.stopped {
+			close(a.stopCh)
+		}
+	}
+	return a.stopCh
+}
+
+// Shutdown gracefully shuts down the handler. New connections are refused, health
+// check reports the handler as unavailable, and every client connection is closed
+// after its current command has been served. Once all in-flight commands have
+// completed, or ctx is done, whichever comes first, the connection pools, the
+// access log, the queue file and monitoring connections are closed.
+// It returns ctx's error if in-flight commands were still running.
+func (r *redisHandler) Shutdown(ctx context.Context) error {
+	var err error
+	select {
+	case <-r.activity.drain():
+	case <-ctx.Done():
+		err = ctx.Err()
+		log.WithField("context", "Draining in-flight commands").Warn(err)
+	}
+	r.activity.stop()
+	r.monitors.closeAll()
+
+	r.settingsMu.RLock()
+	pools := r.settings.pools()
+	accessLog := r.settings.accessLog
+	r.settingsMu.RUnlock()
+
+	for name, pool := range pools {
+		if err := pool.Close(); err != nil {
+			log.WithField("context", "Closing "+name+" pool").Warn(err)
+		}
+	}
+	if accessLog != nil {
+		if err := accessLog.Close(); err != nil {
+			log.WithField("context", "Closing access log").Warn(err)
+		}
+	}
+	if err := r.degraded.close(); err != nil {
+		log.WithField("context", "Closing queue file").Warn(err)
+	}
+
+	return err
+}
@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_redisHandler_Shutdown(t *testing.T) {
+	t.Run(`[Given] a command is in-flight
+		    [When] the handler is shut down
+		    [Then] wait for the command to complete before returning`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.activity.begin()
+
+		completed := make(chan bool, 1)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			completed <- true
+			handler.activity.end()
+		}()
+
+		err := handler.Shutdown(context.Background())
+
+		assert.NoError(t, err, "shutdown should not return error")
+		select {
+		case <-completed:
+		default:
+			t.Error("shutdown should return after the in-flight command completes")
+		}
+	})
+
+	t.Run(`[Given] a command is in-flight
+		    [When] the handler is shut down
+		     [And] the command doesn't complete before the context is done
+		    [Then] returns the context error`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.activity.begin()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		err := handler.Shutdown(ctx)
+
+		assert.Equal(t, context.DeadlineExceeded, err, "shutdown should return the context error")
+	})
+
+	t.Run(`[Given] the handler has stopped serving commands
+		    [When] a request is received on an already accepted connection
+		    [Then] returns error stating remiro is shutting down`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.activity.stop()
+
+		var (
+			rawCmd = "*1\r\n$4\r\nPING\r\n"
+			rawErr = fmt.Sprintf("-%s\r\n", errShutdownMsg)
+		)
+
+		fatal := make(chan error)
+		signal := make(chan error)
+		s := NewServer(":0", handler)
+		go func() {
+			defer s.Close()
+
+			if err := s.ListenServeAndSignal(signal); err != nil {
+				fatal <- err
+			}
+		}()
+
+		done := make(chan bool)
+		go func() {
+			defer func() {
+				done <- true
+			}()
+
+			err := <-signal
+			if err != nil {
+				fatal <- err
+			}
+
+			reply, err := doRequest(s.Addr().String(), rawCmd)
+			if err != nil {
+				fatal <- err
+			}
+
+			assert.Equal(t, rawErr, reply, "reply should be a shutting down error")
+		}()
+
+		waitForComplete(t, done, fatal)
+	})
+}
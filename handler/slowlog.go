@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/redcon"
+)
+
+const (
+	defaultSlowlogSlowerThan = 10 * time.Millisecond
+	defaultSlowlogMaxLen     = 128
+
+	// Like Redis, arguments of slow commands are kept up to a limit, see
+	// SLOWLOG_ENTRY_MAX_ARGC and SLOWLOG_ENTRY_MAX_STRING in Redis
+	slowlogMaxArgs      = 32
+	slowlogMaxArgLength = 128
+)
+
+// SlowlogConfig holds the configuration of the slow log, which keeps the
+// latest commands that took remiro a long time to serve
+type SlowlogConfig struct {
+	// SlowerThan is the time it must take to serve a command for it to be logged,
+	// it defaults to 10ms. The slow log is disabled if it's negative.
+	SlowerThan duration
+
+	// MaxLen is the number of commands kept, it defaults to 128
+	MaxLen int
+}
+
+func (c SlowlogConfig) validate(problems *ConfigError) {
+	if c.MaxLen < 0 {
+		problems.add("Slowlog.MaxLen must not be negative")
+	}
+}
+
+func (c SlowlogConfig) enabled() bool {
+	return c.SlowerThan.Duration >= 0
+}
+
+// slow reports whether a command served in latency should be logged
+func (c SlowlogConfig) slow(latency time.Duration) bool {
+	threshold := c.SlowerThan.Duration
+	if threshold == 0 {
+		threshold = defaultSlowlogSlowerThan
+	}
+
+	return c.enabled() && latency >= threshold
+}
+
+func (c SlowlogConfig) maxLen() int {
+	if c.MaxLen == 0 {
+		return defaultSlowlogMaxLen
+	}
+	return c.MaxLen
+}
+
+// slowlogEntry is a command kept in the slow log
+type slowlogEntry struct {
+	ID       int64         `json:"id"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"-"`
+	Args     []string      `json:"args"`
+	Client   string        `json:"client"`
+	Backends []backendCall `json:"backends,omitempty"`
+}
+
+func (e slowlogEntry) MarshalJSON() ([]byte, error) {
+	type entry slowlogEntry
+	return json.Marshal(struct {
+		entry
+		DurationUs int64 `json:"duration_us"`
+	}{entry(e), int64(e.Duration / time.Microsecond)})
+}
+
+// slowlog is a ring buffer of slow commands, the oldest being dropped first
+type slowlog struct {
+	mu      sync.Mutex
+	entries []slowlogEntry
+	nextID  int64
+}
+
+// add logs a command, keeping at most maxLen commands
+func (l *slowlog) add(maxLen int, entry slowlogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.ID = l.nextID
+	l.nextID++
+
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > maxLen {
+		l.entries = append([]slowlogEntry(nil), l.entries[len(l.entries)-maxLen:]...)
+	}
+}
+
+// get returns the count latest entries, newest first, or every entry if count is negative
+func (l *slowlog) get(count int) []slowlogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if count < 0 || count > len(l.entries) {
+		count = len(l.entries)
+	}
+
+	entries := make([]slowlogEntry, count)
+	for i := range entries {
+		entries[i] = l.entries[len(l.entries)-1-i]
+	}
+
+	return entries
+}
+
+func (l *slowlog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.entries)
+}
+
+func (l *slowlog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = nil
+}
+
+// slowlogArgs trims the arguments of a command the way Redis does for its slow log
+func slowlogArgs(args []string) []string {
+	trimmed := args
+	if len(args) > slowlogMaxArgs {
+		trimmed = append(args[:slowlogMaxArgs-1:slowlogMaxArgs-1],
+			fmt.Sprintf("... (%d more arguments)", len(args)-slowlogMaxArgs+1))
+	}
+
+	for i, arg := range trimmed {
+		if len(arg) > slowlogMaxArgLength {
+			trimmed[i] = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLength], len(arg)-slowlogMaxArgLength)
+		}
+	}
+
+	return trimmed
+}
+
+// handleSlowlog serves the SLOWLOG command from the slow log of remiro,
+// rather than from the one of "destination"
+func (r *redisHandler) handleSlowlog(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'slowlog' command")
+		return
+	}
+
+	subcommand := strings.ToUpper(string(cmd.Args[1]))
+	switch {
+	case subcommand == "GET" && len(cmd.Args) <= 3:
+		count := 10
+		if len(cmd.Args) == 3 {
+			n, err := strconv.Atoi(string(cmd.Args[2]))
+			if err != nil {
+				conn.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			count = n
+		}
+
+		// Entries are replied in the format of Redis, so that clients can parse them,
+		// which has no room for the time spent in each backend: it's only served
+		// by the /slowlog endpoint
+		entries := r.slowlog.get(count)
+		conn.WriteArray(len(entries))
+		for _, entry := range entries {
+			conn.WriteArray(6)
+			conn.WriteInt64(entry.ID)
+			conn.WriteInt64(entry.Time.Unix())
+			conn.WriteInt64(int64(entry.Duration / time.Microsecond))
+			conn.WriteArray(len(entry.Args))
+			for _, arg := range entry.Args {
+				conn.WriteBulkString(arg)
+			}
+			conn.WriteBulkString(entry.Client)
+			conn.WriteBulkString("")
+		}
+
+	case subcommand == "LEN" && len(cmd.Args) == 2:
+		conn.WriteInt(r.slowlog.len())
+
+	case subcommand == "RESET" && len(cmd.Args) == 2:
+		r.slowlog.reset()
+		conn.WriteString("OK")
+
+	default:
+		conn.WriteError(fmt.Sprintf("ERR unknown subcommand or wrong number of arguments for '%s'", cmd.Args[1]))
+	}
+}
+
+// Slowlog writes the slow log as JSON, newest command first. The number of commands
+// can be limited with the "count" query parameter. As commands hold their arguments,
+// requests must bear the admin token, like the admin API.
+func (r *redisHandler) Slowlog(w http.ResponseWriter, req *http.Request) {
+	if !r.authorizedAdmin(w, req) {
+		return
+	}
+
+	count := -1
+	if value := req.URL.Query().Get("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "count must be an integer", http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r.slowlog.get(count)); err != nil {
+		log.Error(err)
+	}
+}
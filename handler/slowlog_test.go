@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_slowlog(t *testing.T) {
+	t.Run(`[Given] more slow commands than the slow log can keep
+		    [When] the slow log is read
+		    [Then] returns the latest commands, newest first`, func(t *testing.T) {
+
+		var l slowlog
+		for i := 0; i < 5; i++ {
+			l.add(3, slowlogEntry{Args: []string{"GET", fmt.Sprint(i)}})
+		}
+
+		entries := l.get(-1)
+
+		assert.Equal(t, 3, l.len(), "only the latest commands should be kept")
+		if assert.Len(t, entries, 3) {
+			assert.Equal(t, []int64{4, 3, 2}, []int64{entries[0].ID, entries[1].ID, entries[2].ID}, "entries should be newest first")
+		}
+		assert.Len(t, l.get(2), 2, "entries should be limited to count")
+
+		l.reset()
+		assert.Equal(t, 0, l.len(), "slow log should be empty after reset")
+	})
+}
+
+func Test_redisHandler_HandleSLOWLOG(t *testing.T) {
+	var (
+		key, value = "mykey", "hello"
+		rawGET     = fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+	)
+
+	t.Run(`[Given] a command slower than the slow log threshold has been served
+		    [When] SLOWLOG commands are received
+		    [Then] reply from the slow log of remiro`, func(t *testing.T) {
+
+		handler, _, dstMock := initHandlerMock()
+		handler.settings.config.Slowlog = SlowlogConfig{SlowerThan: duration{time.Nanosecond}}
+		dstMock.Command("GET", []byte(key)).Expect(value)
+
+		serveRequest(t, handler, rawGET)
+
+		reply := serveRequest(t, handler, "*2\r\n$7\r\nSLOWLOG\r\n$3\r\nLEN\r\n")
+		assert.Equal(t, ":1\r\n", reply, "SLOWLOG LEN should count the slow command")
+
+		reply = serveRequest(t, handler, "*2\r\n$7\r\nSLOWLOG\r\n$3\r\nGET\r\n")
+		assert.True(t, strings.HasPrefix(reply, "*1\r\n*6\r\n:0\r\n"), "SLOWLOG GET should list the slow command, got %q", reply)
+		assert.Contains(t, reply, "*2\r\n$3\r\nGET\r\n$5\r\nmykey\r\n", "SLOWLOG GET should list the command arguments")
+
+		reply = serveRequest(t, handler, "*2\r\n$7\r\nSLOWLOG\r\n$5\r\nRESET\r\n")
+		assert.Equal(t, "+OK\r\n", reply, "SLOWLOG RESET should reply OK")
+		assert.Equal(t, 0, handler.slowlog.len(), "SLOWLOG RESET should empty the slow log")
+	})
+
+	t.Run(`[Given] the slow log is disabled
+		    [When] a command is served
+		    [Then] don't log the command`, func(t *testing.T) {
+
+		handler, _, dstMock := initHandlerMock()
+		handler.settings.config.Slowlog = SlowlogConfig{SlowerThan: duration{-1}}
+		dstMock.Command("GET", []byte(key)).Expect(value)
+
+		serveRequest(t, handler, rawGET)
+
+		assert.Equal(t, 0, handler.slowlog.len(), "command should not be logged")
+	})
+}
+
+func Test_redisHandler_Slowlog(t *testing.T) {
+	t.Run(`[Given] slow commands have been logged
+		    [When] the slow log is requested over HTTP
+		    [Then] returns the slow commands as JSON, with the time spent in each backend`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.settings.config.Admin.Token = "s3cr3t"
+		handler.slowlog.add(10, slowlogEntry{
+			Time:     time.Unix(1570000000, 0),
+			Duration: 15 * time.Millisecond,
+			Args:     []string{"GET", "mykey"},
+			Client:   "10.0.0.1:50000",
+			Backends: []backendCall{{Target: "destination", Command: "GET", LatencyMs: 12}},
+		})
+		handler.slowlog.add(10, slowlogEntry{Args: []string{"PING"}})
+
+		req := httptest.NewRequest("GET", "/slowlog?count=5", nil)
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+		w := httptest.NewRecorder()
+		handler.Slowlog(w, req)
+
+		var entries []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, float64(1), entries[0]["id"], "newest command should come first")
+			assert.Equal(t, float64(15000), entries[1]["duration_us"], "duration should be in microseconds")
+			assert.Equal(t, []interface{}{map[string]interface{}{
+				"target": "destination", "command": "GET", "latency_ms": float64(12),
+			}}, entries[1]["backends"], "time spent in each backend should be listed")
+		}
+	})
+
+	t.Run(`[Given] slow commands have been logged
+		    [When] the slow log is requested over HTTP without the admin token
+		    [Then] returns not found if there's no token, unauthorized otherwise`, func(t *testing.T) {
+
+		handler, _, _ := initHandlerMock()
+		handler.slowlog.add(10, slowlogEntry{Args: []string{"AUTH", "s3cr3t"}})
+
+		w := httptest.NewRecorder()
+		handler.Slowlog(w, httptest.NewRequest("GET", "/slowlog", nil))
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		handler.settings.config.Admin.Token = "s3cr3t"
+		req := httptest.NewRequest("GET", "/slowlog", nil)
+		req.Header.Set("Authorization", "Bearer wrong")
+		w = httptest.NewRecorder()
+		handler.Slowlog(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.NotContains(t, w.Body.String(), "AUTH", "commands should not be returned")
+	})
+}
+
+func Test_slowlogArgs(t *testing.T) {
+	args := make([]string, 40)
+	for i := range args {
+		args[i] = "a"
+	}
+	args[1] = strings.Repeat("v", 200)
+
+	trimmed := slowlogArgs(args)
+
+	if assert.Len(t, trimmed, slowlogMaxArgs) {
+		assert.Equal(t, strings.Repeat("v", 128)+"... (72 more bytes)", trimmed[1], "long arguments should be truncated")
+		assert.Equal(t, "... (9 more arguments)", trimmed[slowlogMaxArgs-1], "extra arguments should be counted")
+	}
+}
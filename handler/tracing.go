@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	stdlog "log"
+	"os"
+	"sync"
+	"time"
+
+	"contrib.go.opencensus.io/exporter/zipkin"
+	"github.com/openzipkin/zipkin-go/model"
+	"github.com/openzipkin/zipkin-go/reporter"
+	zipkinhttp "github.com/openzipkin/zipkin-go/reporter/http"
+	log "github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+)
+
+const (
+	exporterZipkin = "zipkin"
+	exporterStdout = "stdout"
+
+	serviceName = "remiro"
+
+	// zipkinFlushInterval is how often buffered spans are sent to the collector
+	zipkinFlushInterval = time.Second
+	// zipkinMaxBuffered is the number of spans buffered at most between two
+	// flushes, the oldest spans are dropped beyond it
+	zipkinMaxBuffered = 10000
+)
+
+// Attributes of trace spans
+const (
+	attrCommand = "command"
+	attrKeyHash = "key.hash"
+	attrOutcome = "outcome"
+	attrTarget  = "target"
+)
+
+// ConfigureTracing sets up the sampling and exporting of trace spans described by
+// config. The returned function sends the spans which haven't been exported yet,
+// and should be called before exiting.
+func ConfigureTracing(config TracingConfig) (stop func()) {
+	if config.Exporter == "" {
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.NeverSample()})
+		return func() {}
+	}
+
+	rate := config.SampleRate
+	if rate == 0 {
+		rate = 1
+	}
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(rate)})
+
+	var r reporter.Reporter
+	switch config.Exporter {
+	case exporterZipkin:
+		r = newZipkinReporter(config.Endpoint, zipkinFlushInterval)
+	default:
+		r = &lineReporter{w: os.Stdout}
+	}
+
+	exporter := newExporter(r)
+	trace.RegisterExporter(exporter)
+	return func() {
+		trace.UnregisterExporter(exporter)
+		r.Close()
+	}
+}
+
+// startCommandSpan starts the span tracing a command received from a client
+func startCommandSpan(command string, args [][]byte) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(context.Background(), commandTag(command), trace.WithSpanKind(trace.SpanKindServer))
+	if span.IsRecordingEvents() {
+		span.AddAttributes(trace.StringAttribute(attrCommand, commandTag(command)))
+		// The first argument of AUTH is a password rather than a key, which isn't
+		// traced even hashed
+		if len(args) > 0 && !secretArgs(command, [][]byte{nil, args[0]})[1] {
+			span.AddAttributes(trace.StringAttribute(attrKeyHash, keyHash(args[0])))
+		}
+	}
+
+	return ctx, span
+}
+
+// startBackendSpan starts the span tracing a command sent to target, as a child of
+// the span in ctx, if any
+func startBackendSpan(ctx context.Context, target, command string, args []interface{}) *trace.Span {
+	_, span := trace.StartSpan(ctx, target+" "+commandTag(command), trace.WithSpanKind(trace.SpanKindClient))
+	if span.IsRecordingEvents() {
+		span.AddAttributes(
+			trace.StringAttribute(attrTarget, target),
+			trace.StringAttribute(attrCommand, commandTag(command)),
+		)
+		if len(args) > 0 {
+			if key, ok := args[0].([]byte); ok {
+				span.AddAttributes(trace.StringAttribute(attrKeyHash, keyHash(key)))
+			}
+		}
+	}
+
+	return span
+}
+
+// endSpan records the outcome of span, failed if err is not nil, and ends it
+func endSpan(span *trace.Span, err error) {
+	if span.IsRecordingEvents() {
+		span.AddAttributes(trace.StringAttribute(attrOutcome, outcomeOf(err == nil)))
+		if err != nil {
+			span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+		}
+	}
+	span.End()
+}
+
+// keyHash identifies a key in traces without revealing it
+func keyHash(key []byte) string {
+	h := fnv.New64a()
+	h.Write(key)
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// lineReporter writes spans to w, one Zipkin JSON span per line
+type lineReporter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (r *lineReporter) Send(s model.SpanModel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := json.NewEncoder(r.w).Encode(s); err != nil {
+		log.WithFields(log.Fields{
+			"context": "Export trace span",
+		}).Error(err)
+	}
+}
+
+func (r *lineReporter) Close() error {
+	return nil
+}
+
+// newZipkinReporter returns a reporter sending spans to a collector implementing
+// the Zipkin v2 HTTP API, every interval and once more when it's closed
+func newZipkinReporter(endpoint string, interval time.Duration) reporter.Reporter {
+	logger := log.WithFields(log.Fields{
+		"context": "Export trace spans",
+	}).WriterLevel(log.ErrorLevel)
+
+	return zipkinhttp.NewReporter(endpoint,
+		zipkinhttp.BatchInterval(interval),
+		zipkinhttp.MaxBacklog(zipkinMaxBuffered),
+		zipkinhttp.Logger(stdlog.New(logger, "", 0)),
+	)
+}
+
+// newExporter returns an exporter converting spans to the Zipkin format and
+// handing them to r
+func newExporter(r reporter.Reporter) trace.Exporter {
+	return zipkin.NewExporter(r, &model.Endpoint{ServiceName: serviceName})
+}
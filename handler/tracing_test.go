@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/trace"
+)
+
+func Test_redisHandler_Tracing(t *testing.T) {
+	var (
+		key, value = "mykey", "hello"
+		rawMessage = fmt.Sprintf("*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(key), key)
+	)
+
+	exporter := &spanRecorder{}
+	trace.RegisterExporter(exporter)
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	defer func() {
+		trace.UnregisterExporter(exporter)
+		trace.ApplyConfig(trace.Config{DefaultSampler: trace.NeverSample()})
+	}()
+
+	t.Run(`[Given] a key is not available in "destination"
+			 [And] the key is available in "source"
+		    [When] a GET request for the key is received
+		    [Then] trace the request with a span for every command sent to "source" and "destination"`, func(t *testing.T) {
+
+		handler, srcMock, dstMock := initHandlerMock()
+
+		dstMock.Command("GET", []byte(key)).Expect(nil)
+		dstMock.Command("SET", []byte(key), value).Expect("OK")
+		srcMock.Command("GET", []byte(key)).Expect(value)
+
+		fatal := make(chan error)
+		signal := make(chan error)
+		s := NewServer(":0", handler)
+		go func() {
+			defer s.Close()
+
+			if err := s.ListenServeAndSignal(signal); err != nil {
+				fatal <- err
+			}
+		}()
+
+		done := make(chan bool)
+		go func() {
+			defer func() {
+				done <- true
+			}()
+
+			err := <-signal
+			if err != nil {
+				fatal <- err
+			}
+
+			if _, err := doRequest(s.Addr().String(), rawMessage); err != nil {
+				fatal <- err
+			}
+		}()
+
+		waitForComplete(t, done, fatal)
+
+		spans := exporter.byName()
+		root, ok := spans["GET"]
+		if !assert.True(t, ok, "request should be traced") {
+			return
+		}
+		assert.Equal(t, keyHash([]byte(key)), root.Attributes[attrKeyHash], "request span should be tagged with the key hash")
+		assert.Equal(t, "success", root.Attributes[attrOutcome], "request span should be tagged with the outcome")
+
+		for _, name := range []string{"destination GET", "source GET", "destination SET"} {
+			child, ok := spans[name]
+			if assert.True(t, ok, "%s should be traced", name) {
+				assert.Equal(t, root.TraceID, child.TraceID, "%s should be in the request trace", name)
+				assert.Equal(t, root.SpanID, child.ParentSpanID, "%s should be a child of the request span", name)
+				assert.Equal(t, keyHash([]byte(key)), child.Attributes[attrKeyHash], "%s should be tagged with the key hash", name)
+			}
+		}
+	})
+}
+
+func Test_zipkinExporter(t *testing.T) {
+	t.Run(`[Given] spans have been exported
+		    [When] the exporter is closed
+		    [Then] send the spans to the collector in the Zipkin format`, func(t *testing.T) {
+
+		var body []byte
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ = ioutil.ReadAll(req.Body)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer collector.Close()
+
+		reporter := newZipkinReporter(collector.URL, time.Hour)
+		newExporter(reporter).ExportSpan(failedSpanData())
+		reporter.Close()
+
+		var spans []map[string]interface{}
+		if err := json.Unmarshal(body, &spans); err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, spans, 1) {
+			assert.Equal(t, "destination GET", spans[0]["name"], "span name should be sent")
+			assert.Equal(t, "CLIENT", spans[0]["kind"], "span kind should be sent")
+			assert.Equal(t, "0102030405060708", spans[0]["parentId"], "parent span should be sent")
+			assert.Equal(t, float64(1500), spans[0]["duration"], "duration should be in microseconds")
+			assert.Equal(t, map[string]interface{}{"serviceName": "remiro"}, spans[0]["localEndpoint"])
+			assert.Equal(t, map[string]interface{}{
+				"target":                        "destination",
+				"error":                         "UNKNOWN",
+				"opencensus.status_description": "ERR something went wrong",
+			}, spans[0]["tags"], "attributes and status should be sent as tags")
+		}
+	})
+}
+
+func Test_lineReporter(t *testing.T) {
+	t.Run(`[When] a span is exported
+		   [Then] write the span as a line of JSON`, func(t *testing.T) {
+
+		var buf bytes.Buffer
+		newExporter(&lineReporter{w: &buf}).ExportSpan(failedSpanData())
+
+		var span map[string]interface{}
+		assert.NoError(t, json.Unmarshal(buf.Bytes(), &span), "line should be a JSON span")
+		assert.Equal(t, "destination GET", span["name"], "span name should be written")
+		assert.Equal(t, byte('\n'), buf.Bytes()[buf.Len()-1], "span should end with a line break")
+	})
+}
+
+func TestTracingConfig_validate(t *testing.T) {
+	var tc = []struct {
+		config TracingConfig
+		valid  bool
+	}{
+		{TracingConfig{}, true},
+		{TracingConfig{Exporter: "stdout", SampleRate: 0.5}, true},
+		{TracingConfig{Exporter: "zipkin", Endpoint: "http://localhost:9411/api/v2/spans"}, true},
+		{TracingConfig{Exporter: "zipkin"}, false},
+		{TracingConfig{Exporter: "zipkin", Endpoint: "localhost:9411"}, false},
+		{TracingConfig{Exporter: "jaeger"}, false},
+		{TracingConfig{Exporter: "stdout", SampleRate: 2}, false},
+	}
+
+	for _, tt := range tc {
+		problems := &ConfigError{}
+		tt.config.validate(problems)
+
+		assert.Equal(t, tt.valid, problems.orNil() == nil, "validating %+v", tt.config)
+	}
+}
+
+// spanRecorder is an exporter keeping spans in memory
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.spans = append(r.spans, s)
+}
+
+func (r *spanRecorder) byName() map[string]*trace.SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	spans := make(map[string]*trace.SpanData)
+	for _, s := range r.spans {
+		spans[s.Name] = s
+	}
+
+	return spans
+}
+
+func failedSpanData() *trace.SpanData {
+	start := time.Now()
+	return &trace.SpanData{
+		SpanContext:  trace.SpanContext{TraceID: trace.TraceID{1}, SpanID: trace.SpanID{2}},
+		ParentSpanID: trace.SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		SpanKind:     trace.SpanKindClient,
+		Name:         "destination GET",
+		StartTime:    start,
+		EndTime:      start.Add(1500 * time.Microsecond),
+		Attributes:   map[string]interface{}{"target": "destination"},
+		Status:       trace.Status{Code: trace.StatusCodeUnknown, Message: "ERR something went wrong"},
+	}
+}
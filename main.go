@@ -1,27 +1,55 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/BurntSushi/toml"
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
+	"github.com/tidwall/redcon"
 
 	"github.com/tiket-oss/remiro/handler"
 )
 
 func main() {
 	var host, port, instruPort, configPath string
-	var verbose bool
+	var drainTimeout, watchInterval time.Duration
+	var verbose, ping bool
 
 	flag.StringVarP(&host, "host", "h", "127.0.0.1", "server host address")
 	flag.StringVarP(&port, "port", "p", "6379", "port the server will listen to")
 	flag.StringVarP(&instruPort, "instru-port", "i", "8888", "configure the port for providing instrumentation")
 	flag.StringVarP(&configPath, "config", "c", "config.toml", "configuration file to use")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "maximum time to wait for in-flight commands on shutdown")
+	flag.DurationVar(&watchInterval, "watch-interval", 10*time.Second, "how often to check the configuration file for changes, 0 disables it")
 	flag.BoolVarP(&verbose, "verbose", "v", false, "Set remiro to be verbose, logging every events that happened")
+	flag.BoolVar(&ping, "ping", false, "with \"config check\", also check that both Redis servers answer to PING")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n  remiro [flags]\n  remiro config check [-c config.toml] [--ping]\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	setFlagsFromEnv()
+
+	if args := flag.Args(); len(args) > 0 {
+		if len(args) != 2 || args[0] != "config" || args[1] != "check" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(checkConfig(configPath, ping))
+	}
 
-	config, _ := readConfig(configPath)
+	config, err := handler.LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Failed to load configuration from %s: %v", configPath, err)
+	}
+	stopTracing := handler.ConfigureTracing(config.Tracing)
 	redisHandler := handler.NewRedisHandler(config)
 	addr := fmt.Sprintf("%s:%s", host, port)
 	instruAddr := fmt.Sprintf("%s:%s", host, instruPort)
@@ -31,22 +59,143 @@ func main() {
 
 	fmt.Printf("Preparing instrumentation endpoints...\n")
 	runInstruErr := make(chan error)
-	if err := handler.RunInstrumentation(instruAddr, redisHandler, runInstruErr); err != nil {
+	instruServer, err := handler.RunInstrumentation(instruAddr, redisHandler, runInstruErr)
+	if err != nil {
 		log.Fatalf("Failed to run instrumentation server: %v", err)
 	} else {
 		go func() { log.Warn(<-runInstruErr) }()
 		fmt.Printf("Instrumentation is available at %s\n", instruAddr)
 	}
 
+	server := handler.NewServer(addr, redisHandler)
+	runErr := make(chan error, 1)
+	go func() { runErr <- server.ListenAndServe() }()
 	fmt.Printf("Remiro is now running at %s\n", addr)
-	if err := handler.Run(addr, redisHandler); err != nil {
-		log.Fatal(err)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	configChanged := make(chan bool)
+	if watchInterval > 0 {
+		go watchFile(configPath, watchInterval, configChanged)
+	}
+
+serve:
+	for {
+		select {
+		case err := <-runErr:
+			log.Fatal(err)
+		case <-reload:
+			handler.ReloadConfig(redisHandler, configPath)
+		case <-configChanged:
+			handler.ReloadConfig(redisHandler, configPath)
+		case sig := <-stop:
+			fmt.Printf("Received %s, shutting down...\n", sig)
+			break serve
+		}
+	}
+
+	err = shutdown(server, instruServer, redisHandler, drainTimeout)
+	stopTracing()
+	if err != nil {
+		log.Fatalf("Failed to shut down gracefully: %v", err)
+	}
+	fmt.Printf("Remiro has been shut down\n")
+}
+
+// shutdown stops remiro from accepting connections, waits up to drainTimeout for
+// in-flight commands to complete, and then closes every server and connection pool.
+func shutdown(server *redcon.Server, instruServer *http.Server, redisHandler handler.Handler, drainTimeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	drainErr := redisHandler.Shutdown(ctx)
+	if err := server.Close(); err != nil {
+		log.Warn(err)
+	}
+
+	// The instrumentation server is given a moment to finish serving
+	// requests even if draining has used up the whole timeout.
+	instruCtx, instruCancel := context.WithTimeout(context.Background(), time.Second)
+	defer instruCancel()
+	if err := instruServer.Shutdown(instruCtx); err != nil {
+		log.Warn(err)
+	}
+
+	return drainErr
+}
+
+// setFlagsFromEnv sets every flag which isn't given on the command line from its
+// environment variable if any, e.g. REMIRO_INSTRU_PORT for --instru-port.
+func setFlagsFromEnv() {
+	flag.VisitAll(func(f *flag.Flag) {
+		name := handler.EnvPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		value, ok := os.LookupEnv(name)
+		if !ok || f.Changed {
+			return
+		}
+
+		if err := flag.Set(f.Name, value); err != nil {
+			log.Fatalf("Invalid value %q for %s: %v", value, name, err)
+		}
+	})
+}
+
+// checkConfig validates the configuration file at configPath, and optionally pings
+// the Redis servers it describes, printing the result. It returns the exit status.
+func checkConfig(configPath string, ping bool) int {
+	config, err := handler.LoadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configPath, err)
+		return 1
 	}
+	fmt.Printf("%s: configuration is valid\n", configPath)
+
+	if !ping {
+		return 0
+	}
+
+	status := 0
+	for _, target := range []struct {
+		name   string
+		config handler.ClientConfig
+	}{
+		{"source", config.Source},
+		{"destination", config.Destination},
+	} {
+		if err := target.config.Ping(5 * time.Second); err != nil {
+			fmt.Fprintf(os.Stderr, "%s redis at %s: %v\n", target.name, target.config.Addr, err)
+			status = 1
+		} else {
+			fmt.Printf("%s redis at %s: PONG\n", target.name, target.config.Addr)
+		}
+	}
+
+	return status
 }
 
-func readConfig(configPath string) (handler.RedisConfig, error) {
-	var config handler.RedisConfig
-	_, err := toml.DecodeFile(configPath, &config)
+// watchFile checks the modification time and size of the file at path every
+// interval, sending to changed whenever either of them is different.
+func watchFile(path string, interval time.Duration, changed chan<- bool) {
+	var lastMod time.Time
+	var lastSize int64
+	if info, err := os.Stat(path); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+			continue
+		}
 
-	return config, err
+		lastMod, lastSize = info.ModTime(), info.Size()
+		changed <- true
+	}
 }